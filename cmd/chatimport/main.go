@@ -0,0 +1,177 @@
+/*
+Chatimport is an admin command that imports a chat exported by WhatsApp into a conversation, with its original times.
+It runs the same import as the web API server (see `service/chatimport`) on behalf of the owner, and prints a report.
+Importing the same chat again into the same conversation only adds the messages that are new.
+
+It must be run from the same working directory as the web API server, as attached photos are stored in `./static`.
+
+Usage:
+
+	chatimport [flags] <export>
+
+The export is the zip made by WhatsApp, a directory with its content, or the chat text alone.
+
+The flags are:
+
+	-db <path>
+		The SQLite database file (default: /tmp/decaf.db, like the web API server).
+	-owner <name>
+		The user importing the chat (required). Only the messages of the sender with this name are attributed to the
+		user: the other senders become placeholder users.
+	-conversation <id>
+		The group the chat is imported into, where the owner is an admin (default: the 1-on-1 conversation with the
+		other sender, or the group created by a previous import of the chat, or a new group).
+	-name <name>
+		The name of the group, if a group is created (default: from the name of the export).
+	-tz <zone>
+		The time zone of the phone that exported the chat, like Europe/Rome (default: UTC).
+	-map <sender>=<name>
+		Imports the messages of the sender with the given name. Can be repeated.
+
+Return values (exit codes):
+
+	0
+		The import was successful
+
+	> 0
+		The import failed
+*/
+package main
+
+import (
+	"archive/zip"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"git.phoebe2z/WASAText/service/chatimport"
+	"git.phoebe2z/WASAText/service/database"
+	"git.phoebe2z/WASAText/service/mediastore"
+	"github.com/sirupsen/logrus"
+	_ "modernc.org/sqlite"
+)
+
+func main() {
+	var dbFilename = flag.String("db", "/tmp/decaf.db", "SQLite database file")
+	var owner = flag.String("owner", "", "user importing the chat (required)")
+	var conversationId = flag.Int64("conversation", 0, "group the chat is imported into (default: the 1-on-1 conversation, or the group of a previous import or a new one)")
+	var name = flag.String("name", "", "name of the group (default: from the name of the export)")
+	var tz = flag.String("tz", "UTC", "time zone of the phone that exported the chat")
+	names := make(map[string]string)
+	flag.Func("map", "import the messages of a sender with another name (`sender=name`)", func(s string) error {
+		sender, name, ok := strings.Cut(s, "=")
+		if !ok || sender == "" || name == "" {
+			return errors.New("expected sender=name")
+		}
+		names[sender] = name
+		return nil
+	})
+
+	flag.Parse()
+	if flag.NArg() != 1 || *owner == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if err := run(*dbFilename, flag.Arg(0), *owner, *conversationId, *name, *tz, names); err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, "error: ", err)
+		os.Exit(1)
+	}
+}
+
+func run(dbFilename string, export string, owner string, conversationId int64, name string, tz string, names map[string]string) error {
+	logger := logrus.New()
+	logger.SetOutput(os.Stderr)
+
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		return fmt.Errorf("loading time zone: %w", err)
+	}
+
+	// The chat and the directory (or zip) holding its attachments
+	var files fs.FS
+	chatName := export
+	info, err := os.Stat(export)
+	if err != nil {
+		return err
+	}
+	switch {
+	case info.IsDir():
+		files = os.DirFS(export)
+		chatName, err = chatimport.FindChat(files)
+	case strings.EqualFold(filepath.Ext(export), ".zip"):
+		var archive *zip.ReadCloser
+		archive, err = zip.OpenReader(export)
+		if err != nil {
+			return fmt.Errorf("opening export: %w", err)
+		}
+		defer archive.Close()
+		files = archive
+		chatName, err = chatimport.FindChat(files)
+	default:
+		files = os.DirFS(filepath.Dir(export))
+		chatName = filepath.Base(export)
+	}
+	if err != nil {
+		return err
+	}
+	chat, err := files.Open(chatName)
+	if err != nil {
+		return fmt.Errorf("opening chat: %w", err)
+	}
+	defer chat.Close()
+
+	if name == "" {
+		name = chatimport.ChatName(filepath.Base(filepath.Clean(export)))
+	}
+
+	dbconn, err := sql.Open("sqlite", dbFilename)
+	if err != nil {
+		return fmt.Errorf("opening SQLite: %w", err)
+	}
+	defer dbconn.Close()
+	dbconn.SetMaxOpenConns(1)
+
+	db, err := database.New(dbconn)
+	if err != nil {
+		return fmt.Errorf("creating AppDatabase: %w", err)
+	}
+
+	u, err := db.GetUserByName(owner)
+	if err != nil {
+		return fmt.Errorf("getting owner %q: %w", owner, err)
+	}
+
+	result, err := chatimport.Import(chatimport.Config{
+		Database: db,
+		Store:    mediastore.New(filepath.Join("static", "media")),
+		Logger:   logger,
+	}, chat, chatimport.Options{
+		Name:           name,
+		OwnerId:        u.ID,
+		ConversationId: conversationId,
+		Names:          names,
+		Location:       loc,
+		Files:          files,
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, p := range result.Placeholders {
+		fmt.Printf("created placeholder user %s\n", p)
+	}
+	verb := "imported into"
+	if result.Created {
+		verb = "created"
+	}
+	fmt.Printf("%s conversation %d\n", verb, result.ConversationId)
+	fmt.Printf("imported %d of %d messages, %d photos\n", result.Imported, result.Messages, result.Photos)
+	return nil
+}
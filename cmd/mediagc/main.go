@@ -0,0 +1,101 @@
+/*
+Mediagc is an admin command that removes uploaded files not referenced anymore by users, groups or messages, expired
+resumable uploads and expired account takeouts. It runs the same garbage collection that the web API server runs periodically (see `service/mediagc`) once, and prints a report.
+
+It must be run from the same working directory as the web API server, as uploaded files are stored in `./static`.
+It can run while the server is running: media and files that the server references again meanwhile are kept.
+
+Usage:
+
+	mediagc [flags]
+
+The flags are:
+
+	-db <path>
+		The SQLite database file (default: /tmp/decaf.db, like the web API server).
+	-grace <duration>
+		Files and media younger than this are never removed (default: 24h).
+	-dry-run
+		Only report what would be removed, without removing anything.
+
+Return values (exit codes):
+
+	0
+		The garbage collection was successful
+
+	> 0
+		The garbage collection failed
+*/
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"git.phoebe2z/WASAText/service/database"
+	"git.phoebe2z/WASAText/service/mediagc"
+	"git.phoebe2z/WASAText/service/mediastore"
+	"github.com/sirupsen/logrus"
+	_ "modernc.org/sqlite"
+)
+
+func main() {
+	var dbFilename = flag.String("db", "/tmp/decaf.db", "SQLite database file")
+	var grace = flag.Duration("grace", 24*time.Hour, "minimum age of removed files")
+	var dryRun = flag.Bool("dry-run", false, "report without removing anything")
+
+	flag.Parse()
+
+	if err := run(*dbFilename, *grace, *dryRun); err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, "error: ", err)
+		os.Exit(1)
+	}
+}
+
+func run(dbFilename string, grace time.Duration, dryRun bool) error {
+	logger := logrus.New()
+	logger.SetOutput(os.Stderr)
+
+	dbconn, err := sql.Open("sqlite", dbFilename)
+	if err != nil {
+		return fmt.Errorf("opening SQLite: %w", err)
+	}
+	defer dbconn.Close()
+	dbconn.SetMaxOpenConns(1)
+
+	db, err := database.New(dbconn)
+	if err != nil {
+		return fmt.Errorf("creating AppDatabase: %w", err)
+	}
+
+	report, err := mediagc.Run(mediagc.Config{
+		Database:    db,
+		Store:       mediastore.New(filepath.Join("static", "media")),
+		StaticDir:   "static",
+		UploadsDir:  filepath.Join("static", "uploads"),
+		TakeoutsDir: filepath.Join("static", "takeouts"),
+		GracePeriod: grace,
+		DryRun:      dryRun,
+		Logger:      logger,
+	})
+	if err != nil {
+		return err
+	}
+
+	verb := "removed"
+	if dryRun {
+		verb = "would remove"
+	}
+	for _, id := range report.Media {
+		fmt.Printf("%s media %s\n", verb, id)
+	}
+	for _, f := range report.Files {
+		fmt.Printf("%s file %s\n", verb, f)
+	}
+	fmt.Printf("%s %d media, %d files, %d bytes\n", verb, len(report.Media), len(report.Files), report.Bytes)
+	return nil
+}
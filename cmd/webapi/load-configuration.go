@@ -28,6 +28,16 @@ type WebAPIConfiguration struct {
 	DB    struct {
 		Filename string `conf:"default:/tmp/decaf.db"`
 	}
+	Media struct {
+		GCInterval    time.Duration `conf:"default:1h"`
+		GCGracePeriod time.Duration `conf:"default:24h"`
+		// KeyFile holds the key signing media and takeout URLs, created if it doesn't exist
+		KeyFile string `conf:"default:/tmp/decaf.key"`
+	}
+	Accounts struct {
+		// DeletedMessages is what happens to the messages of deleted accounts: keep or redact
+		DeletedMessages string `conf:"default:keep"`
+	}
 }
 
 // loadConfiguration creates a WebAPIConfiguration starting from flags, environment variables and configuration file.
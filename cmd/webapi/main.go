@@ -32,11 +32,13 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"syscall"
 
 	"git.phoebe2z/WASAText/service/api"
 	"git.phoebe2z/WASAText/service/database"
 	"git.phoebe2z/WASAText/service/globaltime"
+	"git.phoebe2z/WASAText/service/mediastore"
 	"github.com/ardanlabs/conf"
 	"github.com/sirupsen/logrus"
 	_ "modernc.org/sqlite"
@@ -121,10 +123,17 @@ func run() error {
 	// buffered channel so the goroutine can exit if we don't collect this error.
 	serverErrors := make(chan error, 1)
 
+	// The media store is shared between the API and the media garbage collector
+	store := mediastore.New(filepath.Join(staticDir, "media"))
+
 	// Create the API router
 	apirouter, err := api.New(api.Config{
-		Logger:   logger,
-		Database: db,
+		Logger:       logger,
+		Database:     db,
+		MediaStore:   store,
+		MediaKeyFile: cfg.Media.KeyFile,
+
+		DeletedMessages: cfg.Accounts.DeletedMessages,
 	})
 	if err != nil {
 		logger.WithError(err).Error("error creating the API server instance")
@@ -157,6 +166,10 @@ func run() error {
 		logger.Infof("stopping API server")
 	}()
 
+	// Start the media garbage collector in background
+	stopMediaGC := startMediaGC(cfg, logger, db, store, apirouter)
+	defer stopMediaGC()
+
 	// Waiting for shutdown signal or POSIX signals
 	select {
 	case err := <-serverErrors:
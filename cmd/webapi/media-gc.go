@@ -0,0 +1,65 @@
+package main
+
+import (
+	"path/filepath"
+	"time"
+
+	"git.phoebe2z/WASAText/service/api"
+	"git.phoebe2z/WASAText/service/database"
+	"git.phoebe2z/WASAText/service/mediagc"
+	"git.phoebe2z/WASAText/service/mediastore"
+	"github.com/sirupsen/logrus"
+)
+
+// staticDir is the directory where uploaded files are stored
+const staticDir = "static"
+
+// startMediaGC runs the media garbage collector every cfg.Media.GCInterval, until the returned function is called. The
+// function waits for a collection in progress, so that the database is not closed while blobs are being removed. A
+// zero interval disables the collector. The expired uploads it removes are forgotten by apirouter.
+func startMediaGC(cfg WebAPIConfiguration, logger *logrus.Logger, db database.AppDatabase, store *mediastore.Store, apirouter api.Router) func() {
+	if cfg.Media.GCInterval <= 0 {
+		return func() {}
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(cfg.Media.GCInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				report, err := mediagc.Run(mediagc.Config{
+					Database:    db,
+					Store:       store,
+					StaticDir:   staticDir,
+					UploadsDir:  filepath.Join(staticDir, "uploads"),
+					TakeoutsDir: filepath.Join(staticDir, "takeouts"),
+					GracePeriod: cfg.Media.GCGracePeriod,
+					Logger:      logger,
+
+					OnUploadRemoved: apirouter.ForgetUpload,
+				})
+				if err != nil {
+					logger.WithError(err).Error("media garbage collection failed")
+					continue
+				}
+				logger.WithFields(logrus.Fields{
+					"media": len(report.Media),
+					"files": len(report.Files),
+					"bytes": report.Bytes,
+				}).Info("media garbage collection completed")
+			}
+		}
+	}()
+
+	return func() {
+		close(stop)
+		<-done
+	}
+}
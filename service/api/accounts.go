@@ -0,0 +1,135 @@
+package api
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Policies for the messages of deleted accounts
+const (
+	// DeletedMessagesKeep keeps the messages, attributed to the deleted account
+	DeletedMessagesKeep = "keep"
+	// DeletedMessagesRedact deletes the messages, as if the user deleted them one by one
+	DeletedMessagesRedact = "redact"
+)
+
+// rejectDisabledUsers answers 401 to the requests authenticated as a deactivated or deleted user. Deactivated users
+// reactivate their account by logging in again.
+func (rt *_router) rejectDisabledUsers(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if userId, err := extractBearer(r); err == nil {
+			disabled, err := rt.db.IsUserDisabled(userId)
+			if err != nil {
+				rt.baseLogger.WithError(err).Error("error checking user")
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			if disabled {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// isActiveUser reports whether the user exists and is not deactivated, deleted nor a placeholder, so that it can be
+// added to groups and communities.
+func (rt *_router) isActiveUser(userId int64) (bool, error) {
+	_, err := rt.db.GetUser(userId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	disabled, err := rt.db.IsUserDisabled(userId)
+	return !disabled, err
+}
+
+// deactivateAccount deactivates the account of the user: the user is not listed anymore and cannot log in, until the
+// account is reactivated by logging in with `reactivate`.
+func (rt *_router) deactivateAccount(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	userId, err := extractBearer(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	err = rt.db.SetUserDeactivated(userId, true)
+	if errors.Is(err, sql.ErrNoRows) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		rt.baseLogger.WithError(err).Error("error deactivating account")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// deleteAccount permanently deletes the account of the user: the user leaves all groups, loses name and photo, and the
+// messages of the user are kept or redacted according to the configured policy.
+func (rt *_router) deleteAccount(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	userId, err := extractBearer(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	user, err := rt.db.GetUser(userId)
+	if errors.Is(err, sql.ErrNoRows) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		rt.baseLogger.WithError(err).Error("error getting user")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	groupIds, err := rt.db.DeleteUser(userId, rt.deletedMessages == DeletedMessagesRedact)
+	if errors.Is(err, sql.ErrNoRows) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		rt.baseLogger.WithError(err).Error("error deleting account")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	for _, groupId := range groupIds {
+		rt.postSystemMessage(groupId, systemEvent{Actor: userId, Action: systemMemberLeft})
+	}
+	rt.removeUserPhoto(user.PhotoURL)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// removeUserPhoto removes the photo of a deleted user. Errors are only logged: leftovers are removed by the media
+// garbage collector.
+func (rt *_router) removeUserPhoto(photoURL string) {
+	if _, ok := mediaIdFromURL(photoURL); ok {
+		rt.releaseMediaURL(photoURL)
+		return
+	}
+
+	// Photos uploaded before media objects are files in the static directory
+	if !strings.HasPrefix(photoURL, "/static/") {
+		return
+	}
+	referenced, err := rt.db.IsURLReferenced(photoURL)
+	if err != nil || referenced {
+		return
+	}
+	err = os.Remove(filepath.Join(staticDir, path.Base(photoURL)))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		rt.baseLogger.WithError(err).Warn("error removing user photo")
+	}
+}
@@ -13,5 +13,5 @@ func (rt *_router) Handler() http.Handler {
 	// Special routes
 	rt.router.GET("/liveness", rt.liveness)
 
-	return rt.router
+	return rt.rejectDisabledUsers(rt.router)
 }
@@ -38,9 +38,13 @@ package api
 
 import (
 	"errors"
+	"fmt"
 	"net/http"
+	"path/filepath"
+	"sync"
 
 	"git.phoebe2z/WASAText/service/database"
+	"git.phoebe2z/WASAText/service/mediastore"
 	"github.com/julienschmidt/httprouter"
 	"github.com/sirupsen/logrus"
 )
@@ -52,6 +56,17 @@ type Config struct {
 
 	// Database is the instance of database.AppDatabase where data are saved
 	Database database.AppDatabase
+
+	// MediaStore is where the content of uploaded media is saved. If nil, a store in the static directory is used.
+	MediaStore *mediastore.Store
+
+	// MediaKeyFile holds the key signing the URLs of media and takeouts, and is created with a random key if it
+	// doesn't exist. If empty, a random key is used, and the URLs signed before a restart stop working.
+	MediaKeyFile string
+
+	// DeletedMessages is the policy for the messages of deleted accounts: DeletedMessagesKeep (the default) or
+	// DeletedMessagesRedact
+	DeletedMessages string
 }
 
 // Router is the package API interface representing an API handler builder
@@ -59,6 +74,9 @@ type Router interface {
 	// Handler returns an HTTP handler for APIs provided in this package
 	Handler() http.Handler
 
+	// ForgetUpload releases what is held for a resumable upload removed by the media garbage collector
+	ForgetUpload(id string)
+
 	// Close terminates any resource used in the package
 	Close() error
 }
@@ -72,6 +90,13 @@ func New(cfg Config) (Router, error) {
 	if cfg.Database == nil {
 		return nil, errors.New("database is required")
 	}
+	switch cfg.DeletedMessages {
+	case "":
+		cfg.DeletedMessages = DeletedMessagesKeep
+	case DeletedMessagesKeep, DeletedMessagesRedact:
+	default:
+		return nil, fmt.Errorf("unknown policy for the messages of deleted accounts: %q", cfg.DeletedMessages)
+	}
 
 	// Create a new router where we will register HTTP endpoints. The server will pass requests to this router to be
 	// handled.
@@ -79,10 +104,35 @@ func New(cfg Config) (Router, error) {
 	router.RedirectTrailingSlash = false
 	router.RedirectFixedPath = false
 
+	if cfg.MediaStore == nil {
+		cfg.MediaStore = mediastore.New(filepath.Join(staticDir, mediaSubdir))
+	}
+
+	// Key used to sign short-lived URLs
+	mediaKey, err := loadMediaKey(cfg.MediaKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("loading media signing key: %w", err)
+	}
+
 	r := &_router{
 		router:     router,
 		baseLogger: cfg.Logger,
 		db:         cfg.Database,
+		mediaKey:   mediaKey,
+		media:      cfg.MediaStore,
+
+		deletedMessages: cfg.DeletedMessages,
+	}
+
+	if err := r.migrateLegacyMedia(); err != nil {
+		return nil, fmt.Errorf("migrating legacy media: %w", err)
+	}
+	if err := r.protectLegacyGroupPhotos(); err != nil {
+		return nil, fmt.Errorf("protecting legacy group photos: %w", err)
+	}
+	// Takeouts being built when the server stopped are never completed
+	if err := cfg.Database.FailPendingTakeouts(); err != nil {
+		return nil, fmt.Errorf("failing interrupted takeouts: %w", err)
 	}
 
 	// Register Routes
@@ -90,11 +140,38 @@ func New(cfg Config) (Router, error) {
 	router.PUT("/user/name", r.setMyUserName)
 	router.PUT("/user/photo", r.setMyPhoto)
 	router.GET("/user/me", r.getMyProfile)
+	router.DELETE("/user/me", r.deleteAccount)
+	router.POST("/user/me/deactivate", r.deactivateAccount)
+	router.POST("/user/me/export", r.requestTakeout)
+	router.GET("/user/me/export/:exportId", r.getTakeout)
+	router.GET("/user/saved-messages", r.getSavedMessages)
+	router.GET("/user/blocked", r.getBlockedUsers)
+	router.PUT("/user/blocked/:userId", r.blockUser)
+	router.DELETE("/user/blocked/:userId", r.unblockUser)
 	router.GET("/users", r.listUsers)
 
 	router.POST("/conversations", r.createConversation)
 	router.GET("/conversations", r.getMyConversations)
 	router.GET("/conversations/:conversationId", r.getConversation)
+	router.DELETE("/conversations/:conversationId", r.deleteConversation)
+	router.DELETE("/conversations/:conversationId/messages", r.clearHistory)
+	router.GET("/conversations/:conversationId/export", r.exportConversation)
+	router.POST("/conversations/:conversationId/media", r.uploadMedia)
+	router.PUT("/conversations/:conversationId/archive", r.archiveConversation)
+	router.DELETE("/conversations/:conversationId/archive", r.unarchiveConversation)
+	router.PUT("/conversations/:conversationId/mute", r.muteConversation)
+	router.DELETE("/conversations/:conversationId/mute", r.unmuteConversation)
+	router.PUT("/conversations/:conversationId/pin", r.pinConversation)
+	router.DELETE("/conversations/:conversationId/pin", r.unpinConversation)
+	router.POST("/conversations/:conversationId/request/accept", r.acceptMessageRequest)
+	router.DELETE("/conversations/:conversationId/request", r.declineMessageRequest)
+
+	router.POST("/imports/whatsapp", r.importChat)
+
+	router.GET("/folders", r.getFolders)
+	router.POST("/folders", r.createFolder)
+	router.PUT("/folders/:folderId", r.updateFolder)
+	router.DELETE("/folders/:folderId", r.deleteFolder)
 
 	router.POST("/messages", r.sendMessage)
 	router.DELETE("/messages/:messageId", r.deleteMessage)
@@ -103,14 +180,59 @@ func New(cfg Config) (Router, error) {
 	router.DELETE("/messages/:messageId/reaction", r.uncommentMessage)
 
 	router.POST("/groups", r.createGroup)
+	router.GET("/groups/:groupId", r.getGroup)
+	router.PATCH("/groups/:groupId", r.updateGroup)
 	router.GET("/groups/:groupId/members", r.getGroupMembers)
 	router.POST("/groups/:groupId/members", r.addToGroup)
 	router.DELETE("/groups/:groupId/me", r.leaveGroup)
 	router.PUT("/groups/:groupId/name", r.setGroupName)
 	router.PUT("/groups/:groupId/photo", r.setGroupPhoto)
+	router.DELETE("/groups/:groupId/members/:userId", r.removeFromGroup)
+	router.PUT("/groups/:groupId/members/:userId/role", r.setMemberRole)
+	router.GET("/groups/:groupId/bans", r.getGroupBans)
+	router.GET("/groups/:groupId/audit", r.getGroupAudit)
+	router.DELETE("/groups/:groupId/bans/:userId", r.unbanMember)
+	router.POST("/groups/:groupId/invites", r.createInvite)
+	router.GET("/groups/:groupId/invites", r.getInvites)
+	router.DELETE("/groups/:groupId/invites/:token", r.revokeInvite)
+	router.GET("/groups/:groupId/requests", r.getJoinRequests)
+	router.POST("/groups/:groupId/requests", r.requestToJoinGroup)
+	router.POST("/groups/:groupId/requests/:requestId/approve", r.approveJoinRequest)
+	router.POST("/groups/:groupId/requests/:requestId/reject", r.rejectJoinRequest)
+	router.POST("/channels", r.createChannel)
+	router.GET("/channels", r.searchChannels)
+	router.PUT("/channels/:channelId/subscription", r.subscribeChannel)
+	router.DELETE("/channels/:channelId/subscription", r.unsubscribeChannel)
+	router.POST("/communities", r.createCommunity)
+	router.GET("/communities/:communityId", r.getCommunity)
+	router.DELETE("/communities/:communityId/me", r.leaveCommunity)
+	router.GET("/communities/:communityId/members", r.getCommunityMembers)
+	router.POST("/communities/:communityId/members", r.addCommunityMember)
+	router.DELETE("/communities/:communityId/members/:userId", r.removeCommunityMember)
+	router.PUT("/communities/:communityId/members/:userId/role", r.setCommunityRole)
+	router.GET("/communities/:communityId/groups", r.getCommunityGroups)
+	router.POST("/communities/:communityId/groups", r.addCommunityGroup)
+	router.DELETE("/communities/:communityId/groups/:groupId", r.removeCommunityGroup)
+	router.POST("/communities/:communityId/groups/:groupId/join", r.joinCommunityGroup)
+	router.GET("/invites/:token", r.previewInvite)
+	router.POST("/invites/:token/join", r.joinByInvite)
+	router.GET("/notifications", r.getNotifications)
+	router.PUT("/notifications/:notificationId/read", r.markNotificationRead)
+	router.PUT("/groups/:groupId/owner", r.transferOwnership)
 
-	// Serve static files
-	router.ServeFiles("/static/*filepath", http.Dir("./static"))
+	router.OPTIONS("/uploads", r.optionsUploads)
+	router.POST("/uploads", r.createUpload)
+	router.HEAD("/uploads/:uploadId", r.getUploadOffset)
+	router.PATCH("/uploads/:uploadId", r.patchUpload)
+	router.DELETE("/uploads/:uploadId", r.deleteUpload)
+
+	// Serve public static files and access-controlled media
+	router.GET("/static/*filepath", r.getStatic)
+	router.GET("/media/:mediaId", r.getMedia)
+	router.GET("/takeouts/:exportId", r.downloadTakeout)
+	router.GET("/avatars/users/:userId", r.getUserAvatar)
+	router.GET("/avatars/groups/:groupId", r.getGroupAvatar)
+	router.GET("/avatars/saved", r.getSavedMessagesIcon)
 
 	return r, nil
 }
@@ -123,4 +245,16 @@ type _router struct {
 	baseLogger logrus.FieldLogger
 
 	db database.AppDatabase
+
+	// mediaKey is the HMAC key used to sign media and group avatar URLs
+	mediaKey []byte
+
+	// media is where the content of uploaded media is stored
+	media *mediastore.Store
+
+	// background tracks the goroutines building takeouts, which Close waits for
+	background sync.WaitGroup
+
+	// deletedMessages is the policy for the messages of deleted accounts
+	deletedMessages string
 }
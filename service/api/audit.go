@@ -0,0 +1,69 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"git.phoebe2z/WASAText/service/database"
+	"github.com/julienschmidt/httprouter"
+)
+
+// Page sizes of the audit log
+const (
+	defaultAuditPage = 50
+	maxAuditPage     = 100
+)
+
+// getGroupAudit returns a page of the audit log of the group, newest first. The next page starts before the ID of the
+// last entry returned.
+func (rt *_router) getGroupAudit(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	userId, err := extractBearer(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	groupId, err := strconv.ParseInt(ps.ByName("groupId"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	query := r.URL.Query()
+	filter := database.AuditFilter{Action: query.Get("action"), Limit: defaultAuditPage}
+	for name, dest := range map[string]*int64{"actor": &filter.ActorId, "before": &filter.Before} {
+		if v := query.Get(name); v != "" {
+			*dest, err = strconv.ParseInt(v, 10, 64)
+			if err != nil || *dest <= 0 {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		}
+	}
+	if v := query.Get("limit"); v != "" {
+		filter.Limit, err = strconv.Atoi(v)
+		if err != nil || filter.Limit < 1 || filter.Limit > maxAuditPage {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	if !rt.checkGroupPermission(w, groupId, userId, actionViewAudit) {
+		return
+	}
+
+	entries, err := rt.db.GetAuditLog(groupId, filter)
+	if err != nil {
+		rt.baseLogger.WithError(err).Error("error getting audit log")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	if entries == nil {
+		_, _ = w.Write([]byte("[]"))
+		return
+	}
+	_ = json.NewEncoder(w).Encode(entries)
+}
@@ -0,0 +1,138 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"html"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"git.phoebe2z/WASAText/service/database"
+	"github.com/julienschmidt/httprouter"
+)
+
+// Users and groups without a photo get a generated avatar: their initials on a background color chosen from their ID.
+// Avatars are generated on each request, so they always reflect the current name; the ETag changes with the name, so
+// that clients revalidating their cache get the new avatar after SetUserName or SetGroupName.
+
+const (
+	userAvatarURLPrefix  = "/avatars/users/"
+	groupAvatarURLPrefix = "/avatars/groups/"
+)
+
+// avatarColors is the palette of avatar backgrounds
+var avatarColors = []string{
+	"#e57373", "#f06292", "#ba68c8", "#9575cd", "#7986cb", "#64b5f6", "#4fc3f7", "#4dd0e1",
+	"#4db6ac", "#81c784", "#aed581", "#ff8a65", "#d4a373", "#a1887f", "#90a4ae", "#f4a261",
+}
+
+// initials returns the uppercase first letters of the first two words of name.
+func initials(name string) string {
+	var letters []rune
+	for _, word := range strings.Fields(name) {
+		for _, r := range word {
+			if unicode.IsLetter(r) || unicode.IsDigit(r) {
+				letters = append(letters, unicode.ToUpper(r))
+				break
+			}
+		}
+		if len(letters) == 2 {
+			break
+		}
+	}
+	if len(letters) == 0 {
+		return "?"
+	}
+	return string(letters)
+}
+
+// avatarSVG returns the generated avatar for the given ID and name. The same input always gives the same output.
+func avatarSVG(id int64, name string) []byte {
+	color := avatarColors[uint64(id)%uint64(len(avatarColors))]
+	return []byte(fmt.Sprintf(`<svg xmlns="http://www.w3.org/2000/svg" width="128" height="128" viewBox="0 0 128 128">`+
+		`<circle cx="64" cy="64" r="64" fill="%s"/>`+
+		`<text x="64" y="64" dy=".35em" text-anchor="middle" font-family="Helvetica, Arial, sans-serif" font-size="52" fill="#ffffff">%s</text>`+
+		`</svg>`, color, html.EscapeString(initials(name))))
+}
+
+// serveAvatar writes the avatar, answering 304 if the client already has the current version.
+func serveAvatar(w http.ResponseWriter, r *http.Request, svg []byte, cacheControl string) {
+	sum := sha256.Sum256(svg)
+	etag := `"` + hex.EncodeToString(sum[:8]) + `"`
+
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", cacheControl)
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "image/svg+xml")
+	_, _ = w.Write(svg)
+}
+
+// userPhotoURL returns the photo of the user, or the URL of the generated avatar if the user has no photo.
+func userPhotoURL(u database.User) string {
+	if u.PhotoURL != "" {
+		return u.PhotoURL
+	}
+	return userAvatarURLPrefix + strconv.FormatInt(u.ID, 10)
+}
+
+// groupPhotoURL returns the (signed) photo of the group, or the signed URL of the generated avatar if the group has no
+// photo.
+func (rt *_router) groupPhotoURL(groupId int64, photoURL string) string {
+	if photoURL != "" {
+		return rt.signMediaURL(photoURL)
+	}
+	return rt.signURL(groupAvatarURLPrefix + strconv.FormatInt(groupId, 10))
+}
+
+func (rt *_router) getUserAvatar(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	userId, err := strconv.ParseInt(ps.ByName("userId"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	user, err := rt.db.GetUser(userId)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	serveAvatar(w, r, avatarSVG(user.ID, user.Name), "public, no-cache")
+}
+
+// getGroupAvatar returns the generated avatar of a group. As it shows the initials of the group name, it's only
+// returned to members of the group, or to requests carrying a valid signature (see groupPhotoURL).
+func (rt *_router) getGroupAvatar(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	groupId, err := strconv.ParseInt(ps.ByName("groupId"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if !rt.validURLSignature(r) {
+		userId, err := extractBearer(r)
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		in, err := rt.db.IsUserInConversation(groupId, userId)
+		if err != nil || !in {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+	}
+
+	group, err := rt.db.GetConversation(groupId)
+	if err != nil || !group.IsGroup {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	serveAvatar(w, r, avatarSVG(group.ID, group.Name), "private, no-cache")
+}
@@ -0,0 +1,154 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"git.phoebe2z/WASAText/service/database"
+	"github.com/julienschmidt/httprouter"
+)
+
+// Blocking a user stops them from messaging the blocker: in 1-on-1 conversations neither of them can send messages
+// or start a conversation until the block is lifted, and the blocked user cannot add the blocker to groups. The
+// existing messages stay visible. Users who blocked someone show them their generated avatar instead of their photo.
+
+// blockedBetween reports whether either user blocked the other.
+func (rt *_router) blockedBetween(userId1 int64, userId2 int64) (bool, error) {
+	blocked, err := rt.db.IsBlocked(userId1, userId2)
+	if err != nil || blocked {
+		return blocked, err
+	}
+	return rt.db.IsBlocked(userId2, userId1)
+}
+
+// directPeer returns the other participant of a 1-on-1 conversation, or 0 if there is none.
+func (rt *_router) directPeer(conversationId int64, userId int64) (int64, error) {
+	members, err := rt.db.GetConversationMembers(conversationId)
+	if err != nil {
+		return 0, err
+	}
+	for _, id := range members {
+		if id != userId {
+			return id, nil
+		}
+	}
+	return 0, nil
+}
+
+// blockedInDirect reports whether the user cannot send messages to the 1-on-1 conversation because of a block.
+func (rt *_router) blockedInDirect(conversationId int64, userId int64) (bool, error) {
+	peerId, err := rt.directPeer(conversationId, userId)
+	if err != nil || peerId == 0 {
+		return false, err
+	}
+	return rt.blockedBetween(userId, peerId)
+}
+
+// blockers returns the set of users who blocked viewerId.
+func (rt *_router) blockers(viewerId int64) (map[int64]bool, error) {
+	ids, err := rt.db.GetBlockers(viewerId)
+	if err != nil {
+		return nil, err
+	}
+	set := make(map[int64]bool, len(ids))
+	for _, id := range ids {
+		set[id] = true
+	}
+	return set, nil
+}
+
+// userPhotoURLFor returns the photo of the user as seen by a viewer blocked by blockers: users who blocked the viewer
+// show the generated avatar.
+func userPhotoURLFor(u database.User, blockers map[int64]bool) string {
+	if blockers[u.ID] {
+		u.PhotoURL = ""
+	}
+	return userPhotoURL(u)
+}
+
+func (rt *_router) getBlockedUsers(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	userId, err := extractBearer(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	users, err := rt.db.GetBlockedUsers(userId)
+	if err != nil {
+		rt.baseLogger.WithError(err).Error("error getting blocked users")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	for i := range users {
+		users[i].PhotoURL = userPhotoURL(users[i])
+	}
+
+	w.WriteHeader(http.StatusOK)
+	if users == nil {
+		_, _ = w.Write([]byte("[]"))
+		return
+	}
+	_ = json.NewEncoder(w).Encode(users)
+}
+
+func (rt *_router) blockUser(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	userId, err := extractBearer(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	blockedId, err := strconv.ParseInt(ps.ByName("userId"), 10, 64)
+	if err != nil || blockedId == userId {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	_, err = rt.db.GetUser(blockedId)
+	if errors.Is(err, sql.ErrNoRows) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		rt.baseLogger.WithError(err).Error("error getting user")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	err = rt.db.BlockUser(userId, blockedId)
+	if err != nil {
+		rt.baseLogger.WithError(err).Error("error blocking user")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (rt *_router) unblockUser(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	userId, err := extractBearer(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	blockedId, err := strconv.ParseInt(ps.ByName("userId"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	err = rt.db.UnblockUser(userId, blockedId)
+	if errors.Is(err, sql.ErrNoRows) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		rt.baseLogger.WithError(err).Error("error unblocking user")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,164 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Channels are groups where only the admins can send messages, while any number of subscribers can read and react.
+// Users subscribe and unsubscribe by themselves; the list of subscribers is not shown, only their count.
+
+func (rt *_router) createChannel(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	userId, err := extractBearer(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		Name        string `json:"name"`
+		Description string `json:"description"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// Validation
+	if !validGroupName(req.Name) || len(req.Description) > maxGroupDescription {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	channel, err := rt.db.CreateChannel(req.Name, req.Description, userId)
+	if err != nil {
+		rt.baseLogger.WithError(err).Error("error creating channel")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(map[string]int64{"channelId": channel.ID})
+}
+
+func (rt *_router) searchChannels(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	_, err := extractBearer(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	channels, err := rt.db.SearchChannels(r.URL.Query().Get("query"))
+	if err != nil {
+		rt.baseLogger.WithError(err).Error("error searching channels")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	for i := range channels {
+		channels[i].PhotoURL = rt.groupPhotoURL(channels[i].ID, channels[i].PhotoURL)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	if channels == nil {
+		_, _ = w.Write([]byte("[]"))
+		return
+	}
+	_ = json.NewEncoder(w).Encode(channels)
+}
+
+func (rt *_router) subscribeChannel(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	userId, err := extractBearer(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	channelId, err := strconv.ParseInt(ps.ByName("channelId"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	channel, err := rt.db.GetConversation(channelId)
+	if err != nil || !channel.IsChannel {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	// Announcement channels follow the community membership
+	if channel.CommunityId != nil {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	banned, err := rt.db.IsBanned(channelId, userId)
+	if err != nil {
+		rt.baseLogger.WithError(err).Error("error checking channel ban")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if banned {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	// Subscribing twice is not an error
+	in, err := rt.db.IsUserInConversation(channelId, userId)
+	if err != nil {
+		rt.baseLogger.WithError(err).Error("error checking subscription")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if !in {
+		err = rt.db.AddMember(channelId, userId, userId)
+		if err != nil {
+			rt.baseLogger.WithError(err).Error("error subscribing to channel")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (rt *_router) unsubscribeChannel(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	userId, err := extractBearer(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	channelId, err := strconv.ParseInt(ps.ByName("channelId"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	channel, err := rt.db.GetConversation(channelId)
+	if err != nil || !channel.IsChannel {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	// Announcement channels follow the community membership
+	if channel.CommunityId != nil {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	// If the user is the owner, RemoveMember passes the ownership to another admin or subscriber
+	err = rt.db.RemoveMember(channelId, userId, userId)
+	if errors.Is(err, sql.ErrNoRows) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		rt.baseLogger.WithError(err).Error("error unsubscribing from channel")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
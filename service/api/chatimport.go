@@ -0,0 +1,132 @@
+package api
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"git.phoebe2z/WASAText/service/chatimport"
+	"github.com/julienschmidt/httprouter"
+)
+
+// maxImportSize is the maximum size of an uploaded chat export
+const maxImportSize = 200 << 20
+
+// writeImportError answers 400 with the reason why the export cannot be imported.
+func writeImportError(w http.ResponseWriter, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	_ = json.NewEncoder(w).Encode(map[string]string{"message": message})
+}
+
+// importChat imports a WhatsApp chat export, uploaded as the zip made by WhatsApp or as the chat text alone. The user
+// becomes a member of the conversation, and the other senders placeholder users. Optional form fields: the group to
+// import the chat into, the name of the group, the time zone of the phone that exported the chat, and names, a JSON
+// object mapping the senders to other names.
+func (rt *_router) importChat(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	userId, err := extractBearer(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportSize)
+	err = r.ParseMultipartForm(32 << 20)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	opts := chatimport.Options{
+		Name:    r.FormValue("name"),
+		OwnerId: userId,
+	}
+	if opts.Name == "" {
+		opts.Name = chatimport.ChatName(header.Filename)
+	}
+	if id := r.FormValue("conversationId"); id != "" {
+		opts.ConversationId, err = strconv.ParseInt(id, 10, 64)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	if tz := r.FormValue("timezone"); tz != "" {
+		opts.Location, err = time.LoadLocation(tz)
+		if err != nil {
+			writeImportError(w, "unknown time zone")
+			return
+		}
+	}
+	if names := r.FormValue("names"); names != "" {
+		if err := json.Unmarshal([]byte(names), &opts.Names); err != nil {
+			writeImportError(w, "invalid names")
+			return
+		}
+	}
+
+	// WhatsApp exports are zips with the chat and its attachments
+	var chat io.Reader = file
+	if strings.HasSuffix(strings.ToLower(header.Filename), ".zip") {
+		archive, err := zip.NewReader(file, header.Size)
+		if err != nil {
+			writeImportError(w, "invalid zip")
+			return
+		}
+		name, err := chatimport.FindChat(archive)
+		if err != nil {
+			writeImportError(w, err.Error())
+			return
+		}
+		f, err := archive.Open(name)
+		if err != nil {
+			writeImportError(w, "invalid zip")
+			return
+		}
+		defer f.Close()
+		chat = f
+		opts.Files = archive
+	}
+
+	result, err := chatimport.Import(chatimport.Config{
+		Database: rt.db,
+		Store:    rt.media,
+		Logger:   rt.baseLogger,
+	}, chat, opts)
+	switch {
+	case errors.Is(err, chatimport.ErrNoMessages), errors.Is(err, chatimport.ErrInvalidNames),
+		errors.Is(err, chatimport.ErrInvalidGroupName), errors.Is(err, chatimport.ErrSingleParticipant),
+		errors.Is(err, chatimport.ErrTooManySenders), errors.Is(err, zip.ErrFormat), errors.Is(err, zip.ErrChecksum):
+		writeImportError(w, err.Error())
+		return
+	case errors.Is(err, chatimport.ErrNoConversation):
+		w.WriteHeader(http.StatusNotFound)
+		return
+	case errors.Is(err, chatimport.ErrNotAdmin):
+		w.WriteHeader(http.StatusForbidden)
+		return
+	case err != nil:
+		rt.baseLogger.WithError(err).Error("error importing chat")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if result.Created {
+		w.WriteHeader(http.StatusCreated)
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+	_ = json.NewEncoder(w).Encode(result)
+}
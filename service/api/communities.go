@@ -0,0 +1,562 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"git.phoebe2z/WASAText/service/database"
+	"github.com/julienschmidt/httprouter"
+)
+
+// Communities group several related groups. Every community has an announcement channel that all its members are
+// subscribed to, and only the community admins can post in. Community admins are admins of all the groups of the
+// community, see effectiveRole.
+
+// checkCommunityRole checks whether userId has at least minRole in the community. If not, it writes the error
+// response and returns false.
+func (rt *_router) checkCommunityRole(w http.ResponseWriter, communityId int64, userId int64, minRole string) bool {
+	_, err := rt.db.GetCommunity(communityId)
+	if errors.Is(err, sql.ErrNoRows) {
+		w.WriteHeader(http.StatusNotFound)
+		return false
+	} else if err != nil {
+		rt.baseLogger.WithError(err).Error("error getting community")
+		w.WriteHeader(http.StatusInternalServerError)
+		return false
+	}
+
+	role, err := rt.db.GetCommunityRole(communityId, userId)
+	if errors.Is(err, sql.ErrNoRows) {
+		w.WriteHeader(http.StatusForbidden)
+		return false
+	} else if err != nil {
+		rt.baseLogger.WithError(err).Error("error getting community role")
+		w.WriteHeader(http.StatusInternalServerError)
+		return false
+	}
+
+	if roleRank(role) < roleRank(minRole) {
+		w.WriteHeader(http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+func (rt *_router) createCommunity(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	userId, err := extractBearer(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		Name        string `json:"name"`
+		Description string `json:"description"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// Validation
+	if !validGroupName(req.Name) || len(req.Description) > maxGroupDescription {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	community, err := rt.db.CreateCommunity(req.Name, req.Description, userId)
+	if err != nil {
+		rt.baseLogger.WithError(err).Error("error creating community")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(community)
+}
+
+func (rt *_router) getCommunity(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	userId, err := extractBearer(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	communityId, err := strconv.ParseInt(ps.ByName("communityId"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if !rt.checkCommunityRole(w, communityId, userId, database.RoleMember) {
+		return
+	}
+
+	community, err := rt.db.GetCommunity(communityId)
+	if err != nil {
+		rt.baseLogger.WithError(err).Error("error getting community")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(community)
+}
+
+func (rt *_router) getCommunityMembers(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	userId, err := extractBearer(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	communityId, err := strconv.ParseInt(ps.ByName("communityId"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if !rt.checkCommunityRole(w, communityId, userId, database.RoleMember) {
+		return
+	}
+
+	members, err := rt.db.GetCommunityMembers(communityId)
+	if err != nil {
+		rt.baseLogger.WithError(err).Error("error getting community members")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	blockers, err := rt.blockers(userId)
+	if err != nil {
+		rt.baseLogger.WithError(err).Error("error getting blockers")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	for i := range members {
+		members[i].PhotoURL = userPhotoURLFor(members[i], blockers)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	if members == nil {
+		_, _ = w.Write([]byte("[]"))
+		return
+	}
+	_ = json.NewEncoder(w).Encode(members)
+}
+
+// addCommunityMember adds a user to the community and subscribes them to the announcement channel. Only the community
+// admins can do it.
+func (rt *_router) addCommunityMember(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	userId, err := extractBearer(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	communityId, err := strconv.ParseInt(ps.ByName("communityId"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		UserId int64 `json:"userId"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if !rt.checkCommunityRole(w, communityId, userId, database.RoleAdmin) {
+		return
+	}
+
+	active, err := rt.isActiveUser(req.UserId)
+	if err != nil {
+		rt.baseLogger.WithError(err).Error("error checking user")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if !active {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	_, err = rt.db.GetCommunityRole(communityId, req.UserId)
+	if err == nil {
+		w.WriteHeader(http.StatusConflict)
+		return
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		rt.baseLogger.WithError(err).Error("error getting community role")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	err = rt.db.AddCommunityMember(communityId, req.UserId, userId)
+	if err != nil {
+		rt.baseLogger.WithError(err).Error("error adding community member")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// leaveCommunity removes the user from the community and its announcement channel. The user stays in the groups of
+// the community they joined.
+func (rt *_router) leaveCommunity(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	userId, err := extractBearer(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	communityId, err := strconv.ParseInt(ps.ByName("communityId"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// If the user is the owner, RemoveCommunityMember passes the ownership to another admin or member
+	err = rt.db.RemoveCommunityMember(communityId, userId, userId)
+	if errors.Is(err, sql.ErrNoRows) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		rt.baseLogger.WithError(err).Error("error leaving community")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// removeCommunityMember removes a member from the community. Admins can remove members, and only the owner can remove
+// admins.
+func (rt *_router) removeCommunityMember(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	userId, err := extractBearer(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	communityId, err := strconv.ParseInt(ps.ByName("communityId"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	memberId, err := strconv.ParseInt(ps.ByName("userId"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	// Users leave a community with leaveCommunity
+	if memberId == userId {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if !rt.checkCommunityRole(w, communityId, userId, database.RoleAdmin) {
+		return
+	}
+
+	role, err := rt.db.GetCommunityRole(communityId, userId)
+	if err != nil {
+		rt.baseLogger.WithError(err).Error("error getting community role")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	memberRole, err := rt.db.GetCommunityRole(communityId, memberId)
+	if errors.Is(err, sql.ErrNoRows) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		rt.baseLogger.WithError(err).Error("error getting community role")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if roleRank(memberRole) >= roleRank(role) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	err = rt.db.RemoveCommunityMember(communityId, memberId, userId)
+	if errors.Is(err, sql.ErrNoRows) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		rt.baseLogger.WithError(err).Error("error removing community member")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// setCommunityRole promotes a member to community admin or demotes an admin to member. Only the owner can do it.
+func (rt *_router) setCommunityRole(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	userId, err := extractBearer(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	communityId, err := strconv.ParseInt(ps.ByName("communityId"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	memberId, err := strconv.ParseInt(ps.ByName("userId"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		Role string `json:"role"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if req.Role != database.RoleAdmin && req.Role != database.RoleMember {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if !rt.checkCommunityRole(w, communityId, userId, database.RoleOwner) {
+		return
+	}
+	if memberId == userId {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	err = rt.db.SetCommunityRole(communityId, memberId, req.Role)
+	if errors.Is(err, sql.ErrNoRows) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		rt.baseLogger.WithError(err).Error("error setting community role")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (rt *_router) getCommunityGroups(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	userId, err := extractBearer(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	communityId, err := strconv.ParseInt(ps.ByName("communityId"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if !rt.checkCommunityRole(w, communityId, userId, database.RoleMember) {
+		return
+	}
+
+	groups, err := rt.db.GetCommunityGroups(communityId, userId)
+	if err != nil {
+		rt.baseLogger.WithError(err).Error("error getting community groups")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	for i := range groups {
+		groups[i].PhotoURL = rt.groupPhotoURL(groups[i].ID, groups[i].PhotoURL)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	if groups == nil {
+		_, _ = w.Write([]byte("[]"))
+		return
+	}
+	_ = json.NewEncoder(w).Encode(groups)
+}
+
+// addCommunityGroup moves an existing group into the community. The user must be an admin of both.
+func (rt *_router) addCommunityGroup(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	userId, err := extractBearer(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	communityId, err := strconv.ParseInt(ps.ByName("communityId"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		GroupId int64 `json:"groupId"`
+		Listed  bool  `json:"listed"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if !rt.checkCommunityRole(w, communityId, userId, database.RoleAdmin) {
+		return
+	}
+	if !rt.checkGroupPermission(w, req.GroupId, userId, actionEditSettings) {
+		return
+	}
+
+	group, err := rt.db.GetConversation(req.GroupId)
+	if err != nil {
+		rt.baseLogger.WithError(err).Error("error getting group")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	// A group belongs to at most one community; re-adding it only updates whether it is listed
+	if group.CommunityId != nil && *group.CommunityId != communityId {
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+
+	err = rt.db.SetGroupCommunity(req.GroupId, &communityId, req.Listed)
+	if err != nil {
+		rt.baseLogger.WithError(err).Error("error adding group to community")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// removeCommunityGroup takes a group out of the community. The members of the group are not affected.
+func (rt *_router) removeCommunityGroup(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	userId, err := extractBearer(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	communityId, err := strconv.ParseInt(ps.ByName("communityId"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	groupId, err := strconv.ParseInt(ps.ByName("groupId"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if !rt.checkCommunityRole(w, communityId, userId, database.RoleAdmin) {
+		return
+	}
+
+	community, err := rt.db.GetCommunity(communityId)
+	if err != nil {
+		rt.baseLogger.WithError(err).Error("error getting community")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	// The announcement channel cannot leave its community
+	if groupId == community.AnnouncementChannelId {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	group, err := rt.db.GetConversation(groupId)
+	if errors.Is(err, sql.ErrNoRows) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		rt.baseLogger.WithError(err).Error("error getting group")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if group.CommunityId == nil || *group.CommunityId != communityId {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	err = rt.db.SetGroupCommunity(groupId, nil, false)
+	if err != nil {
+		rt.baseLogger.WithError(err).Error("error removing group from community")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// joinCommunityGroup lets a community member join one of the listed groups of the community.
+func (rt *_router) joinCommunityGroup(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	userId, err := extractBearer(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	communityId, err := strconv.ParseInt(ps.ByName("communityId"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	groupId, err := strconv.ParseInt(ps.ByName("groupId"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if !rt.checkCommunityRole(w, communityId, userId, database.RoleMember) {
+		return
+	}
+
+	groups, err := rt.db.GetCommunityGroups(communityId, userId)
+	if err != nil {
+		rt.baseLogger.WithError(err).Error("error getting community groups")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	var group *database.CommunityGroup
+	for i := range groups {
+		if groups[i].ID == groupId {
+			group = &groups[i]
+		}
+	}
+	if group == nil || !group.Listed {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	// Joining twice is not an error
+	if group.Joined {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	banned, err := rt.db.IsBanned(groupId, userId)
+	if err != nil {
+		rt.baseLogger.WithError(err).Error("error checking group ban")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if banned {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	err = rt.db.AddMember(groupId, userId, userId)
+	if err != nil {
+		rt.baseLogger.WithError(err).Error("error joining community group")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	rt.postSystemMessage(groupId, systemEvent{Actor: userId, Action: systemMemberJoined})
+
+	w.WriteHeader(http.StatusOK)
+}
@@ -1,10 +1,13 @@
 package api
 
 import (
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"strconv"
 
+	"git.phoebe2z/WASAText/service/database"
 	"github.com/julienschmidt/httprouter"
 )
 
@@ -15,13 +18,60 @@ func (rt *_router) getMyConversations(w http.ResponseWriter, r *http.Request, ps
 		return
 	}
 
-	conversations, err := rt.db.GetConversations(userId)
+	var filter database.ConversationFilter
+	if q := r.URL.Query().Get("community"); q != "" {
+		communityId, err := strconv.ParseInt(q, 10, 64)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		filter.CommunityId = &communityId
+	}
+	if q := r.URL.Query().Get("folder"); q != "" {
+		folderId, err := strconv.ParseInt(q, 10, 64)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		folder, err := rt.db.GetFolder(folderId, userId)
+		if errors.Is(err, sql.ErrNoRows) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		} else if err != nil {
+			rt.baseLogger.WithError(err).Error("error getting folder")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		filter.Folder = &folder
+		// Folders hold archived conversations and message requests too
+		filter.AnyState = true
+	}
+	filter.Archived = r.URL.Query().Get("archived") == "true"
+	filter.Requests = r.URL.Query().Get("requests") == "true"
+
+	conversations, err := rt.db.GetConversations(userId, filter)
 	if err != nil {
 		rt.baseLogger.WithError(err).Error("error getting conversations")
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
+	blockers, err := rt.blockers(userId)
+	if err != nil {
+		rt.baseLogger.WithError(err).Error("error getting blockers")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	for i, c := range conversations {
+		if c.IsSaved {
+			setSavedMessagesInfo(&conversations[i])
+		} else if c.IsGroup {
+			conversations[i].PhotoURL = rt.groupPhotoURL(c.ID, c.PhotoURL)
+		} else {
+			conversations[i].PhotoURL = userPhotoURLFor(database.User{ID: c.PeerId, PhotoURL: c.PhotoURL}, blockers)
+		}
+	}
+
 	w.WriteHeader(http.StatusOK)
 	if conversations == nil {
 		_, _ = w.Write([]byte("[]"))
@@ -58,13 +108,19 @@ func (rt *_router) getConversation(w http.ResponseWriter, r *http.Request, ps ht
 	// Update last read status
 	_ = rt.db.UpdateParticipantLastRead(conversationId, userId)
 
-	messages, err := rt.db.GetMessages(conversationId)
+	messages, err := rt.db.GetMessages(conversationId, userId)
 	if err != nil {
 		rt.baseLogger.WithError(err).Error("error getting messages")
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
+	for i := range messages {
+		if messages[i].ContentType == "photo" {
+			messages[i].Content = rt.signMediaURL(messages[i].Content)
+		}
+	}
+
 	w.WriteHeader(http.StatusOK)
 	if messages == nil {
 		_, _ = w.Write([]byte("[]"))
@@ -96,11 +152,43 @@ func (rt *_router) createConversation(w http.ResponseWriter, r *http.Request, ps
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
+	// Deactivated users can't be found, like in the user list
+	if user.Deactivated {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
 
-	// Prevent self-chat
+	// Chatting with yourself opens Saved Messages
 	if user.ID == userId {
-		w.WriteHeader(http.StatusBadRequest)
-		_ = json.NewEncoder(w).Encode(map[string]string{"error": "cannot chat with yourself"})
+		conversation, created, err := rt.db.GetSavedMessages(userId)
+		if err != nil {
+			rt.baseLogger.WithError(err).Error("error getting saved messages")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if !created {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{
+				"message":        "conversation already exists",
+				"conversationId": conversation.ID,
+			})
+			return
+		}
+		setSavedMessagesInfo(&conversation)
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(conversation)
+		return
+	}
+
+	blocked, err := rt.blockedBetween(userId, user.ID)
+	if err != nil {
+		rt.baseLogger.WithError(err).Error("error checking blocks")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if blocked {
+		w.WriteHeader(http.StatusForbidden)
 		return
 	}
 
@@ -124,7 +212,8 @@ func (rt *_router) createConversation(w http.ResponseWriter, r *http.Request, ps
 	}
 
 	// Create conversation
-	conversation, err := rt.db.CreateConversation("", false, members)
+	// Users who don't know the user receive the conversation as a message request
+	conversation, err := rt.db.CreateConversation("", false, userId, members)
 	if err != nil {
 		rt.baseLogger.WithError(err).Error("error creating conversation")
 		w.WriteHeader(http.StatusInternalServerError)
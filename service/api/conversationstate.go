@@ -0,0 +1,103 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Users archive, mute, pin, clear and delete conversations for themselves: the other participants are not affected.
+
+// setConversationState applies set to the conversation in the path on behalf of the user.
+func (rt *_router) setConversationState(w http.ResponseWriter, r *http.Request, ps httprouter.Params, set func(conversationId int64, userId int64) error) {
+	userId, err := extractBearer(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	conversationId, err := strconv.ParseInt(ps.ByName("conversationId"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	err = set(conversationId, userId)
+	if errors.Is(err, sql.ErrNoRows) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		rt.baseLogger.WithError(err).Error("error updating conversation state")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (rt *_router) archiveConversation(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	rt.setConversationState(w, r, ps, func(conversationId int64, userId int64) error {
+		return rt.db.SetArchived(conversationId, userId, true)
+	})
+}
+
+func (rt *_router) unarchiveConversation(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	rt.setConversationState(w, r, ps, func(conversationId int64, userId int64) error {
+		return rt.db.SetArchived(conversationId, userId, false)
+	})
+}
+
+// muteConversation mutes the conversation until the time in the body, or forever if there is no body.
+func (rt *_router) muteConversation(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	var req struct {
+		Until *time.Time `json:"until"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	if req.Until != nil && !req.Until.After(time.Now()) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	rt.setConversationState(w, r, ps, func(conversationId int64, userId int64) error {
+		return rt.db.SetMuted(conversationId, userId, true, req.Until)
+	})
+}
+
+func (rt *_router) unmuteConversation(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	rt.setConversationState(w, r, ps, func(conversationId int64, userId int64) error {
+		return rt.db.SetMuted(conversationId, userId, false, nil)
+	})
+}
+
+func (rt *_router) pinConversation(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	rt.setConversationState(w, r, ps, func(conversationId int64, userId int64) error {
+		return rt.db.SetPinned(conversationId, userId, true)
+	})
+}
+
+func (rt *_router) unpinConversation(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	rt.setConversationState(w, r, ps, func(conversationId int64, userId int64) error {
+		return rt.db.SetPinned(conversationId, userId, false)
+	})
+}
+
+// clearHistory hides the messages sent so far from the user.
+func (rt *_router) clearHistory(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	rt.setConversationState(w, r, ps, rt.db.ClearHistory)
+}
+
+// deleteConversation clears the history and removes the conversation from the list of the user until a new message
+// arrives. Group members stay in the group.
+func (rt *_router) deleteConversation(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	rt.setConversationState(w, r, ps, rt.db.HideConversation)
+}
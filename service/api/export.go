@@ -0,0 +1,438 @@
+package api
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"git.phoebe2z/WASAText/service/database"
+	"github.com/julienschmidt/httprouter"
+)
+
+// Conversations are exported as a transcript, written one page of messages at a time so that the history is never
+// held in memory. With ?zip=true the transcript is bundled with the photos it references; otherwise photos are linked
+// with signed URLs, which expire.
+
+const (
+	// exportMediaDir is the directory of the photos inside an export zip
+	exportMediaDir = "media/"
+
+	// exportWriteTimeout is how long each write of an export may take. Exports take longer than the server
+	// WriteTimeout, so the deadline is extended before each write instead.
+	exportWriteTimeout = 30 * time.Second
+)
+
+// deadlineWriter extends the write deadline of the response before each write, so that long responses are only cut
+// when the client stops reading.
+type deadlineWriter struct {
+	http.ResponseWriter
+	rc *http.ResponseController
+}
+
+func newDeadlineWriter(w http.ResponseWriter) deadlineWriter {
+	return deadlineWriter{ResponseWriter: w, rc: http.NewResponseController(w)}
+}
+
+func (w deadlineWriter) Write(p []byte) (int, error) {
+	_ = w.rc.SetWriteDeadline(time.Now().Add(exportWriteTimeout))
+	return w.ResponseWriter.Write(p)
+}
+
+// exportExtensions are the file extensions of the photos inside an export zip
+var exportExtensions = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+}
+
+// transcript writes an export in one format. Messages arrive in chronological order, with the content of photos
+// already replaced by their link.
+type transcript interface {
+	begin(title string, exportedAt time.Time) error
+	message(m database.Message) error
+	end() error
+}
+
+// transcriptTypes are the content types of the export formats, which are also their file extensions
+var transcriptTypes = map[string]string{
+	"json": "application/json",
+	"txt":  "text/plain; charset=utf-8",
+	"html": "text/html; charset=utf-8",
+}
+
+// newTranscript returns the transcript for one of transcriptTypes.
+func newTranscript(format string, w io.Writer) transcript {
+	switch format {
+	case "txt":
+		return &textTranscript{w: w}
+	case "html":
+		return &htmlTranscript{w: w}
+	}
+	return &jsonTranscript{w: w}
+}
+
+// exportedMessage is a message in a JSON transcript
+type exportedMessage struct {
+	ID          int64               `json:"id"`
+	SenderId    int64               `json:"senderId"`
+	SenderName  string              `json:"senderName"`
+	TimeStamp   time.Time           `json:"timeStamp"`
+	ContentType string              `json:"contentType"`
+	Content     string              `json:"content,omitempty"`
+	ReplyToId   *int64              `json:"replyToId,omitempty"`
+	IsDeleted   bool                `json:"isDeleted"`
+	Reactions   []database.Reaction `json:"reactions,omitempty"`
+}
+
+type jsonTranscript struct {
+	w     io.Writer
+	count int
+}
+
+func (t *jsonTranscript) begin(title string, exportedAt time.Time) error {
+	header, err := json.Marshal(map[string]interface{}{"title": title, "exportedAt": exportedAt})
+	if err != nil {
+		return err
+	}
+	// The messages array is appended to the header object
+	_, err = fmt.Fprintf(t.w, "%s,\"messages\":[\n", header[:len(header)-1])
+	return err
+}
+
+func (t *jsonTranscript) message(m database.Message) error {
+	if t.count > 0 {
+		if _, err := io.WriteString(t.w, ",\n"); err != nil {
+			return err
+		}
+	}
+	t.count++
+	data, err := json.Marshal(exportedMessage{
+		ID:          m.ID,
+		SenderId:    m.SenderId,
+		SenderName:  m.SenderName,
+		TimeStamp:   m.TimeStamp,
+		ContentType: m.ContentType,
+		Content:     m.Content,
+		ReplyToId:   m.ReplyToId,
+		IsDeleted:   m.IsDeleted,
+		Reactions:   m.Reactions,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = t.w.Write(data)
+	return err
+}
+
+func (t *jsonTranscript) end() error {
+	_, err := io.WriteString(t.w, "\n]}\n")
+	return err
+}
+
+type textTranscript struct {
+	w io.Writer
+}
+
+func (t *textTranscript) begin(title string, exportedAt time.Time) error {
+	_, err := fmt.Fprintf(t.w, "%s\nExported on %s\n\n", title, exportedAt.UTC().Format(time.RFC1123))
+	return err
+}
+
+func (t *textTranscript) message(m database.Message) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "#%d [%s] %s", m.ID, m.TimeStamp.UTC().Format(time.DateTime), m.SenderName)
+	if m.ReplyToId != nil {
+		fmt.Fprintf(&b, " (reply to #%d)", *m.ReplyToId)
+	}
+	switch {
+	case m.IsDeleted:
+		b.WriteString(": <message deleted>")
+	case m.ContentType == systemContentType:
+		b.WriteString(" " + systemEventText(m.Content))
+	case m.ContentType == "photo":
+		b.WriteString(": <photo " + m.Content + ">")
+	default:
+		// Continuation lines are indented, so that each message starts a line of its own
+		b.WriteString(": " + strings.ReplaceAll(m.Content, "\n", "\n    "))
+	}
+	b.WriteString("\n")
+	if len(m.Reactions) > 0 && !m.IsDeleted {
+		reactions := make([]string, 0, len(m.Reactions))
+		for _, r := range m.Reactions {
+			reactions = append(reactions, r.Emoticon+" "+r.ReactorName)
+		}
+		b.WriteString("    Reactions: " + strings.Join(reactions, ", ") + "\n")
+	}
+	_, err := io.WriteString(t.w, b.String())
+	return err
+}
+
+func (t *textTranscript) end() error {
+	return nil
+}
+
+type htmlTranscript struct {
+	w io.Writer
+}
+
+func (t *htmlTranscript) begin(title string, exportedAt time.Time) error {
+	_, err := fmt.Fprintf(t.w, `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>%[1]s</title>
+<style>
+body { font-family: Helvetica, Arial, sans-serif; max-width: 48em; margin: 2em auto; }
+.message { margin: 0.75em 0; }
+.meta { color: #777; font-size: 0.85em; }
+.content { white-space: pre-wrap; }
+.deleted, .system { color: #777; font-style: italic; }
+.reactions { font-size: 0.85em; }
+img { max-width: 100%%; }
+</style>
+</head>
+<body>
+<h1>%[1]s</h1>
+<p class="meta">Exported on %[2]s</p>
+`, html.EscapeString(title), exportedAt.UTC().Format(time.RFC1123))
+	return err
+}
+
+func (t *htmlTranscript) message(m database.Message) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, `<div class="message" id="m%d">`+"\n", m.ID)
+	fmt.Fprintf(&b, `<div class="meta"><b>%s</b> %s`, html.EscapeString(m.SenderName), m.TimeStamp.UTC().Format(time.DateTime))
+	if m.ReplyToId != nil {
+		fmt.Fprintf(&b, ` &middot; <a href="#m%d">reply</a>`, *m.ReplyToId)
+	}
+	b.WriteString("</div>\n")
+	switch {
+	case m.IsDeleted:
+		b.WriteString(`<div class="deleted">This message was deleted</div>`)
+	case m.ContentType == systemContentType:
+		b.WriteString(`<div class="system">` + html.EscapeString(m.SenderName+" "+systemEventText(m.Content)) + `</div>`)
+	case m.ContentType == "photo":
+		fmt.Fprintf(&b, `<div><img src="%s" alt="Photo"></div>`, html.EscapeString(m.Content))
+	default:
+		b.WriteString(`<div class="content">` + html.EscapeString(m.Content) + `</div>`)
+	}
+	b.WriteString("\n")
+	if len(m.Reactions) > 0 && !m.IsDeleted {
+		reactions := make([]string, 0, len(m.Reactions))
+		for _, r := range m.Reactions {
+			reactions = append(reactions, html.EscapeString(r.Emoticon+" "+r.ReactorName))
+		}
+		b.WriteString(`<div class="reactions">` + strings.Join(reactions, ", ") + "</div>\n")
+	}
+	b.WriteString("</div>\n")
+	_, err := io.WriteString(t.w, b.String())
+	return err
+}
+
+func (t *htmlTranscript) end() error {
+	_, err := io.WriteString(t.w, "</body>\n</html>\n")
+	return err
+}
+
+// systemEventText describes the event of a system message, after the name of the user who caused it. The users
+// affected by the event are not named.
+func systemEventText(content string) string {
+	var event systemEvent
+	if err := json.Unmarshal([]byte(content), &event); err != nil {
+		return "changed the group"
+	}
+	switch event.Action {
+	case systemMemberAdded:
+		if len(event.Targets) == 1 {
+			return "added a member"
+		}
+		return "added " + strconv.Itoa(len(event.Targets)) + " members"
+	case systemMemberRemoved:
+		return "removed a member"
+	case systemMemberJoined:
+		return "joined"
+	case systemMemberLeft:
+		return "left"
+	case systemGroupRenamed:
+		return `renamed the group to "` + event.NewValue + `"`
+	case systemPhotoChanged:
+		return "changed the group photo"
+	case systemDescriptionChanged:
+		return "changed the group description"
+	}
+	return "changed the group settings"
+}
+
+// exportTitle returns the title of the transcript of the conversation, as seen by the user.
+func (rt *_router) exportTitle(c database.Conversation, userId int64) (string, error) {
+	if c.IsSaved {
+		return savedMessagesName, nil
+	}
+	if c.IsGroup {
+		return c.Name, nil
+	}
+	peerId, err := rt.directPeer(c.ID, userId)
+	if err != nil || peerId == 0 {
+		return "Conversation", err
+	}
+	peer, err := rt.db.GetUser(peerId)
+	if err != nil {
+		return "", err
+	}
+	return "Conversation with " + peer.Name, nil
+}
+
+// exportConversation streams the history of the conversation that the user has not cleared. Deleted messages are
+// kept as placeholders, without their content. Messages cannot be edited, so there are no edit markers.
+func (rt *_router) exportConversation(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	userId, err := extractBearer(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	conversationId, err := strconv.ParseInt(ps.ByName("conversationId"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	in, err := rt.db.IsUserInConversation(conversationId, userId)
+	if err != nil {
+		rt.baseLogger.WithError(err).Error("error checking membership")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if !in {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "json"
+	}
+	if _, ok := transcriptTypes[format]; !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	bundle := r.URL.Query().Get("zip") == "true"
+
+	conversation, err := rt.db.GetConversation(conversationId)
+	if err != nil {
+		rt.baseLogger.WithError(err).Error("error getting conversation")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	title, err := rt.exportTitle(conversation, userId)
+	if err != nil {
+		rt.baseLogger.WithError(err).Error("error getting conversation title")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// The photos are listed beforehand, so that the transcript can link them to their path inside the zip
+	var media []database.Media
+	paths := make(map[string]string)
+	if bundle {
+		media, err = rt.db.GetExportMedia(conversationId, userId)
+		if err != nil {
+			rt.baseLogger.WithError(err).Error("error getting conversation media")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		for _, m := range media {
+			paths[m.ID] = exportMediaDir + m.ID + exportExtensions[m.MimeType]
+		}
+	}
+
+	// From here on the response is streamed: errors can only be logged
+	name := "conversation-" + strconv.FormatInt(conversationId, 10)
+	dw := newDeadlineWriter(w)
+	var out io.Writer = dw
+	var zw *zip.Writer
+	if bundle {
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+name+`.zip"`)
+		zw = zip.NewWriter(dw)
+		out, err = zw.CreateHeader(&zip.FileHeader{
+			Name:     name + "." + format,
+			Method:   zip.Deflate,
+			Modified: time.Now(),
+		})
+		if err != nil {
+			rt.baseLogger.WithError(err).Error("error exporting conversation")
+			return
+		}
+	} else {
+		w.Header().Set("Content-Type", transcriptTypes[format])
+		w.Header().Set("Content-Disposition", `attachment; filename="`+name+"."+format+`"`)
+	}
+
+	t := newTranscript(format, out)
+	err = t.begin(title, time.Now())
+	if err == nil {
+		err = rt.db.ExportMessages(conversationId, userId, func(m database.Message) error {
+			if m.IsDeleted {
+				m.Content = ""
+			} else if mediaId, ok := mediaIdFromURL(m.Content); ok && m.ContentType == "photo" {
+				// Photos sent after the zip was prepared are linked like outside zips
+				if path, ok := paths[mediaId]; ok {
+					m.Content = path
+				} else {
+					m.Content = rt.signMediaURL(m.Content)
+				}
+			}
+			return t.message(m)
+		})
+	}
+	if err == nil {
+		err = t.end()
+	}
+	if err != nil {
+		rt.baseLogger.WithError(err).Error("error exporting conversation")
+		return
+	}
+	if !bundle {
+		return
+	}
+
+	for _, m := range media {
+		err = rt.exportMedia(zw, paths[m.ID], m)
+		if err != nil {
+			rt.baseLogger.WithError(err).WithField("mediaId", m.ID).Warn("error exporting photo")
+		}
+	}
+	err = zw.Close()
+	if err != nil {
+		rt.baseLogger.WithError(err).Error("error exporting conversation")
+	}
+}
+
+// exportMedia adds the content of the media to the export zip.
+func (rt *_router) exportMedia(zw *zip.Writer, path string, m database.Media) error {
+	f, err := rt.media.Open(m.BlobHash)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// Photos are already compressed
+	dst, err := zw.CreateHeader(&zip.FileHeader{
+		Name:     path,
+		Method:   zip.Store,
+		Modified: m.CreatedAt,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, f)
+	return err
+}
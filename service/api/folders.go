@@ -0,0 +1,175 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"git.phoebe2z/WASAText/service/database"
+	"github.com/julienschmidt/httprouter"
+)
+
+// Folders organize the conversation list of a user. They are stored on the server, so they are the same on all the
+// devices of the user; the conversations of a folder are selected with GET /conversations?folder=.
+
+// maxFolderName is the longest folder name, in bytes
+const maxFolderName = 20
+
+// decodeFolder reads a folder from the request body and validates it for userId. If it is not valid, it writes the
+// error response and returns false.
+func (rt *_router) decodeFolder(w http.ResponseWriter, r *http.Request, userId int64) (database.Folder, bool) {
+	var f database.Folder
+	if err := json.NewDecoder(r.Body).Decode(&f); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return f, false
+	}
+	f.UserId = userId
+	f.Name = strings.TrimSpace(f.Name)
+	if f.Name == "" || len(f.Name) > maxFolderName {
+		w.WriteHeader(http.StatusBadRequest)
+		return f, false
+	}
+
+	// Only the conversations of the user can be added
+	for _, id := range f.ConversationIds {
+		in, err := rt.db.IsUserInConversation(id, userId)
+		if err != nil {
+			rt.baseLogger.WithError(err).Error("error checking membership")
+			w.WriteHeader(http.StatusInternalServerError)
+			return f, false
+		}
+		if !in {
+			w.WriteHeader(http.StatusBadRequest)
+			return f, false
+		}
+	}
+	if f.ConversationIds == nil {
+		f.ConversationIds = []int64{}
+	}
+	return f, true
+}
+
+// getFolders returns the folders of the user, each with the number of unread messages in its conversations.
+func (rt *_router) getFolders(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	userId, err := extractBearer(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	folders, err := rt.db.GetFolders(userId)
+	if err != nil {
+		rt.baseLogger.WithError(err).Error("error getting folders")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if len(folders) > 0 {
+		conversations, err := rt.db.GetConversations(userId, database.ConversationFilter{AnyState: true})
+		if err != nil {
+			rt.baseLogger.WithError(err).Error("error getting conversations")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		for i := range folders {
+			for _, c := range conversations {
+				if folders[i].Matches(c) {
+					folders[i].UnreadCount += c.UnreadCount
+				}
+			}
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	if folders == nil {
+		_, _ = w.Write([]byte("[]"))
+		return
+	}
+	_ = json.NewEncoder(w).Encode(folders)
+}
+
+func (rt *_router) createFolder(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	userId, err := extractBearer(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	f, ok := rt.decodeFolder(w, r, userId)
+	if !ok {
+		return
+	}
+
+	f, err = rt.db.CreateFolder(f)
+	if err != nil {
+		rt.baseLogger.WithError(err).Error("error creating folder")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(f)
+}
+
+// updateFolder replaces the name, the rules and the conversations of the folder.
+func (rt *_router) updateFolder(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	userId, err := extractBearer(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	folderId, err := strconv.ParseInt(ps.ByName("folderId"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	f, ok := rt.decodeFolder(w, r, userId)
+	if !ok {
+		return
+	}
+	f.ID = folderId
+
+	err = rt.db.UpdateFolder(f)
+	if errors.Is(err, sql.ErrNoRows) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		rt.baseLogger.WithError(err).Error("error updating folder")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(f)
+}
+
+func (rt *_router) deleteFolder(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	userId, err := extractBearer(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	folderId, err := strconv.ParseInt(ps.ByName("folderId"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	err = rt.db.DeleteFolder(folderId, userId)
+	if errors.Is(err, sql.ErrNoRows) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		rt.baseLogger.WithError(err).Error("error deleting folder")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,158 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"git.phoebe2z/WASAText/service/database"
+	"github.com/julienschmidt/httprouter"
+)
+
+// maxGroupDescription is the maximum length of a group description, in bytes
+const maxGroupDescription = 500
+
+// validGroupName checks the length of a group name, the same way for creating and renaming groups.
+func validGroupName(name string) bool {
+	return len(name) >= 3 && len(name) <= 20
+}
+
+// writeGroupProfile writes the profile of the group, with the photo URL signed for the requester.
+func (rt *_router) writeGroupProfile(w http.ResponseWriter, groupId int64) {
+	g, err := rt.db.GetGroupProfile(groupId)
+	if errors.Is(err, sql.ErrNoRows) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		rt.baseLogger.WithError(err).Error("error getting group profile")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	g.PhotoURL = rt.groupPhotoURL(g.ID, g.PhotoURL)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(g)
+}
+
+func (rt *_router) getGroup(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	userId, err := extractBearer(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	groupId, err := strconv.ParseInt(ps.ByName("groupId"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	in, err := rt.db.IsUserInConversation(groupId, userId)
+	if err != nil || !in {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	rt.writeGroupProfile(w, groupId)
+}
+
+// updateGroup changes the fields of the group profile present in the request. Editing the name and description
+// follows the "only admins can edit info" setting, while the settings can only be changed by admins.
+func (rt *_router) updateGroup(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	userId, err := extractBearer(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	groupId, err := strconv.ParseInt(ps.ByName("groupId"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		Name        *string `json:"name"`
+		Description *string `json:"description"`
+		Settings    *struct {
+			OnlyAdminsEditInfo   *bool `json:"onlyAdminsEditInfo"`
+			OnlyAdminsAddMembers *bool `json:"onlyAdminsAddMembers"`
+			OnlyAdminsSend       *bool `json:"onlyAdminsSend"`
+			SlowModeSeconds      *int  `json:"slowModeSeconds"`
+		} `json:"settings"`
+	}
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	u := database.GroupUpdate{Name: req.Name, Description: req.Description}
+	if req.Settings != nil {
+		u.OnlyAdminsEditInfo = req.Settings.OnlyAdminsEditInfo
+		u.OnlyAdminsAddMembers = req.Settings.OnlyAdminsAddMembers
+		u.OnlyAdminsSend = req.Settings.OnlyAdminsSend
+		u.SlowModeSeconds = req.Settings.SlowModeSeconds
+	}
+	editsInfo := u.Name != nil || u.Description != nil
+	editsSettings := u.OnlyAdminsEditInfo != nil || u.OnlyAdminsAddMembers != nil || u.OnlyAdminsSend != nil ||
+		u.SlowModeSeconds != nil
+
+	// Validation
+	if !editsInfo && !editsSettings {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if (u.Name != nil && !validGroupName(*u.Name)) || (u.Description != nil && len(*u.Description) > maxGroupDescription) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if u.SlowModeSeconds != nil && (*u.SlowModeSeconds < 0 || *u.SlowModeSeconds > int(maxSlowMode.Seconds())) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if editsInfo && !rt.checkGroupPermission(w, groupId, userId, actionEditInfo) {
+		return
+	}
+	if editsSettings && !rt.checkGroupPermission(w, groupId, userId, actionEditSettings) {
+		return
+	}
+
+	old, err := rt.db.GetGroupProfile(groupId)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	// Channels are read-only for subscribers
+	if old.IsChannel && u.OnlyAdminsSend != nil && !*u.OnlyAdminsSend {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	err = rt.db.UpdateGroup(groupId, u, userId)
+	if err != nil {
+		rt.baseLogger.WithError(err).Error("error updating group")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if u.Name != nil && *u.Name != old.Name {
+		rt.postSystemMessage(groupId, systemEvent{Actor: userId, Action: systemGroupRenamed, OldValue: old.Name, NewValue: *u.Name})
+	}
+	if u.Description != nil && *u.Description != old.Description {
+		rt.postSystemMessage(groupId, systemEvent{Actor: userId, Action: systemDescriptionChanged, OldValue: old.Description, NewValue: *u.Description})
+	}
+	if (u.OnlyAdminsEditInfo != nil && *u.OnlyAdminsEditInfo != old.Settings.OnlyAdminsEditInfo) ||
+		(u.OnlyAdminsAddMembers != nil && *u.OnlyAdminsAddMembers != old.Settings.OnlyAdminsAddMembers) ||
+		(u.OnlyAdminsSend != nil && *u.OnlyAdminsSend != old.Settings.OnlyAdminsSend) ||
+		(u.SlowModeSeconds != nil && *u.SlowModeSeconds != old.Settings.SlowModeSeconds) {
+		rt.postSystemMessage(groupId, systemEvent{Actor: userId, Action: systemSettingsChanged})
+	}
+
+	rt.writeGroupProfile(w, groupId)
+}
@@ -1,16 +1,15 @@
 package api
 
 import (
+	"database/sql"
 	"encoding/json"
-	"fmt"
+	"errors"
 	"io"
 	"net/http"
-	"os"
-	"path/filepath"
 	"strconv"
 	"strings"
-	"time"
 
+	"git.phoebe2z/WASAText/service/database"
 	"github.com/julienschmidt/httprouter"
 )
 
@@ -34,12 +33,33 @@ func (rt *_router) getGroupMembers(w http.ResponseWriter, r *http.Request, ps ht
 		return
 	}
 
-	members, err := rt.db.GetConversationMembersDetailed(groupId)
+	// Channels only show their admins, subscribers are counted in the group profile
+	conversation, err := rt.db.GetConversation(groupId)
+	if err != nil {
+		rt.baseLogger.WithError(err).Error("error getting group")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	var members []database.User
+	if conversation.IsChannel {
+		members, err = rt.db.GetGroupAdmins(groupId)
+	} else {
+		members, err = rt.db.GetConversationMembersDetailed(groupId)
+	}
 	if err != nil {
 		rt.baseLogger.WithError(err).Error("error getting group members")
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	blockers, err := rt.blockers(userId)
+	if err != nil {
+		rt.baseLogger.WithError(err).Error("error getting blockers")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	for i := range members {
+		members[i].PhotoURL = userPhotoURLFor(members[i], blockers)
+	}
 
 	w.WriteHeader(http.StatusOK)
 	if members == nil {
@@ -66,7 +86,7 @@ func (rt *_router) createGroup(w http.ResponseWriter, r *http.Request, ps httpro
 	}
 
 	// Validation
-	if len(req.Name) < 3 || len(req.Name) > 20 {
+	if !validGroupName(req.Name) {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
@@ -75,13 +95,32 @@ func (rt *_router) createGroup(w http.ResponseWriter, r *http.Request, ps httpro
 		return
 	}
 
-	// Create group
-	// Add creator to initial members list for DB creation logic if needed,
-	// or handled by CreateConversation logic.
-	// My CreateConversation implementation takes a list of IDs. I should include creator.
-	members := append(req.InitialMembers, userId)
+	// Create group, the creator is its owner. Users who blocked the creator are left out.
+	var members []int64
+	for _, memberId := range req.InitialMembers {
+		active, err := rt.isActiveUser(memberId)
+		if err != nil {
+			rt.baseLogger.WithError(err).Error("error checking user")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if !active {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		blocked, err := rt.db.IsBlocked(memberId, userId)
+		if err != nil {
+			rt.baseLogger.WithError(err).Error("error checking blocks")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if !blocked {
+			members = append(members, memberId)
+		}
+	}
+	members = append(members, userId)
 
-	group, err := rt.db.CreateConversation(req.Name, true, members)
+	group, err := rt.db.CreateConversation(req.Name, true, userId, members)
 	if err != nil {
 		rt.baseLogger.WithError(err).Error("error creating group")
 		w.WriteHeader(http.StatusInternalServerError)
@@ -105,10 +144,7 @@ func (rt *_router) addToGroup(w http.ResponseWriter, r *http.Request, ps httprou
 		return
 	}
 
-	// Check permission (must be member to add others? Spec says "Group members can add other users")
-	in, err := rt.db.IsUserInConversation(groupId, userId)
-	if err != nil || !in {
-		w.WriteHeader(http.StatusForbidden)
+	if !rt.checkGroupPermission(w, groupId, userId, actionAddMembers) {
 		return
 	}
 
@@ -120,16 +156,54 @@ func (rt *_router) addToGroup(w http.ResponseWriter, r *http.Request, ps httprou
 		return
 	}
 
+	// Unknown, deactivated and deleted users are rejected before anyone is added
 	for _, newMemberId := range req.UserIds {
-		// Verify user exists? DB FK will handle logic but maybe good to check.
-		// For now assume valid IDs or DB error.
-		err = rt.db.AddMember(groupId, newMemberId)
+		active, err := rt.isActiveUser(newMemberId)
 		if err != nil {
-			// Skip or error?
-			// ignoring error for now (e.g. already member)
+			rt.baseLogger.WithError(err).Error("error checking user")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if !active {
+			w.WriteHeader(http.StatusNotFound)
+			return
 		}
 	}
 
+	var added []int64
+	for _, newMemberId := range req.UserIds {
+		// Banned users cannot be added until the ban is lifted
+		banned, err := rt.db.IsBanned(groupId, newMemberId)
+		if err != nil {
+			rt.baseLogger.WithError(err).Error("error checking group ban")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if banned {
+			continue
+		}
+		// Users cannot be added by someone they blocked
+		blocked, err := rt.db.IsBlocked(newMemberId, userId)
+		if err != nil {
+			rt.baseLogger.WithError(err).Error("error checking blocks")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if blocked {
+			continue
+		}
+		err = rt.db.AddMember(groupId, newMemberId, userId)
+		if err != nil {
+			// Already a member
+			continue
+		}
+		added = append(added, newMemberId)
+	}
+
+	if len(added) > 0 {
+		rt.postSystemMessage(groupId, systemEvent{Actor: userId, Action: systemMemberAdded, Targets: added})
+	}
+
 	w.WriteHeader(http.StatusOK)
 }
 
@@ -146,16 +220,21 @@ func (rt *_router) leaveGroup(w http.ResponseWriter, r *http.Request, ps httprou
 		return
 	}
 
-	err = rt.db.RemoveMember(groupId, userId)
+	// If the user is the owner, RemoveMember passes the ownership to another member
+	err = rt.db.RemoveMember(groupId, userId, userId)
 	if err != nil {
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
+	rt.postSystemMessage(groupId, systemEvent{Actor: userId, Action: systemMemberLeft})
 
 	w.WriteHeader(http.StatusOK)
 }
 
-func (rt *_router) setGroupName(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+// removeFromGroup removes another member from the group, optionally banning them. Admins can remove members, only the
+// owner can remove admins. Access is checked on every request, so the removed user loses access to the conversation
+// immediately.
+func (rt *_router) removeFromGroup(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	userId, err := extractBearer(r)
 	if err != nil {
 		w.WriteHeader(http.StatusUnauthorized)
@@ -167,27 +246,171 @@ func (rt *_router) setGroupName(w http.ResponseWriter, r *http.Request, ps httpr
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
+	memberId, err := strconv.ParseInt(ps.ByName("userId"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	// Users leave a group with leaveGroup
+	if memberId == userId {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if !rt.checkGroupPermission(w, groupId, userId, actionRemoveMembers) {
+		return
+	}
 
-	// Check auth
-	in, _ := rt.db.IsUserInConversation(groupId, userId)
-	if !in {
+	role, err := rt.effectiveRole(groupId, userId)
+	if err != nil {
+		rt.baseLogger.WithError(err).Error("error getting member role")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	memberRole, err := rt.db.GetMemberRole(groupId, memberId)
+	if errors.Is(err, sql.ErrNoRows) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		rt.baseLogger.WithError(err).Error("error getting member role")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if roleRank(memberRole) >= roleRank(role) {
 		w.WriteHeader(http.StatusForbidden)
 		return
 	}
 
+	// Ban before removing, so that the user cannot be added back in between
+	if r.URL.Query().Get("ban") == "true" {
+		err = rt.db.BanMember(groupId, memberId, userId)
+		if err != nil {
+			rt.baseLogger.WithError(err).Error("error banning member")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	err = rt.db.RemoveMember(groupId, memberId, userId)
+	if errors.Is(err, sql.ErrNoRows) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		rt.baseLogger.WithError(err).Error("error removing member")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	rt.postSystemMessage(groupId, systemEvent{Actor: userId, Action: systemMemberRemoved, Targets: []int64{memberId}})
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (rt *_router) getGroupBans(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	userId, err := extractBearer(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	groupId, err := strconv.ParseInt(ps.ByName("groupId"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if !rt.checkGroupPermission(w, groupId, userId, actionManageBans) {
+		return
+	}
+
+	bans, err := rt.db.GetBans(groupId)
+	if err != nil {
+		rt.baseLogger.WithError(err).Error("error getting group bans")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	if bans == nil {
+		_, _ = w.Write([]byte("[]"))
+		return
+	}
+	_ = json.NewEncoder(w).Encode(bans)
+}
+
+func (rt *_router) unbanMember(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	userId, err := extractBearer(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	groupId, err := strconv.ParseInt(ps.ByName("groupId"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	bannedId, err := strconv.ParseInt(ps.ByName("userId"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if !rt.checkGroupPermission(w, groupId, userId, actionManageBans) {
+		return
+	}
+
+	err = rt.db.UnbanMember(groupId, bannedId, userId)
+	if errors.Is(err, sql.ErrNoRows) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		rt.baseLogger.WithError(err).Error("error lifting ban")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (rt *_router) setGroupName(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	userId, err := extractBearer(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	groupId, err := strconv.ParseInt(ps.ByName("groupId"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if !rt.checkGroupPermission(w, groupId, userId, actionEditInfo) {
+		return
+	}
+
 	var req struct {
 		NewName string `json:"newName"`
 	}
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || !validGroupName(req.NewName) {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	err = rt.db.SetGroupName(groupId, req.NewName)
+	group, err := rt.db.GetConversation(groupId)
+	if err != nil || !group.IsGroup {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	err = rt.db.SetGroupName(groupId, req.NewName, userId)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	if req.NewName != group.Name {
+		rt.postSystemMessage(groupId, systemEvent{Actor: userId, Action: systemGroupRenamed, OldValue: group.Name, NewValue: req.NewName})
+	}
 	w.WriteHeader(http.StatusOK)
 }
 
@@ -204,10 +427,13 @@ func (rt *_router) setGroupPhoto(w http.ResponseWriter, r *http.Request, ps http
 		return
 	}
 
-	// Check auth
-	in, _ := rt.db.IsUserInConversation(groupId, userId)
-	if !in {
-		w.WriteHeader(http.StatusForbidden)
+	if !rt.checkGroupPermission(w, groupId, userId, actionEditInfo) {
+		return
+	}
+
+	group, err := rt.db.GetConversation(groupId)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
 		return
 	}
 
@@ -215,16 +441,31 @@ func (rt *_router) setGroupPhoto(w http.ResponseWriter, r *http.Request, ps http
 	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
 		var req struct {
 			PhotoURL string `json:"photoUrl"`
+			UploadId string `json:"uploadId"`
 		}
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
-		err = rt.db.SetGroupPhoto(groupId, req.PhotoURL)
+		// A completed resumable upload can be used in place of the photo URL
+		if req.UploadId != "" {
+			rt.setGroupPhotoFromUpload(w, userId, groupId, req.UploadId, group.PhotoURL)
+			return
+		}
+		// Media references are owned by the group photo, so they can only be created by uploading
+		if _, ok := mediaIdFromURL(req.PhotoURL); ok {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		err = rt.db.SetGroupPhoto(groupId, req.PhotoURL, userId)
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
+		rt.releaseMediaURL(group.PhotoURL)
+		if req.PhotoURL != group.PhotoURL {
+			rt.postSystemMessage(groupId, systemEvent{Actor: userId, Action: systemPhotoChanged})
+		}
 		w.WriteHeader(http.StatusOK)
 		return
 	}
@@ -236,7 +477,7 @@ func (rt *_router) setGroupPhoto(w http.ResponseWriter, r *http.Request, ps http
 		return
 	}
 
-	file, handler, err := r.FormFile("photo")
+	file, _, err := r.FormFile("photo")
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		return
@@ -250,21 +491,54 @@ func (rt *_router) setGroupPhoto(w http.ResponseWriter, r *http.Request, ps http
 		return
 	}
 
-	filename := fmt.Sprintf("group-%d-%d%s", groupId, time.Now().Unix(), filepath.Ext(handler.Filename))
-	err = os.WriteFile(filepath.Join("static", filename), data, 0644)
-	if err != nil {
+	// Group photos are only visible to the members of the group
+	m, err := rt.saveMedia(data, userId, &groupId, 1)
+	if errors.Is(err, errNotImage) {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		return
+	} else if err != nil {
 		rt.baseLogger.WithError(err).Error("error saving file")
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	photoURL := "/static/" + filename
+	photoURL := mediaURLPrefix + m.ID
+
+	err = rt.db.SetGroupPhoto(groupId, photoURL, userId)
+	if err != nil {
+		rt.releaseMediaURL(photoURL)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	rt.releaseMediaURL(group.PhotoURL)
+	rt.postSystemMessage(groupId, systemEvent{Actor: userId, Action: systemPhotoChanged})
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// setGroupPhotoFromUpload sets a completed resumable upload of userId as the photo of the group, replacing oldPhotoURL.
+func (rt *_router) setGroupPhotoFromUpload(w http.ResponseWriter, userId int64, groupId int64, uploadId string, oldPhotoURL string) {
+	// Group photos are only visible to the members of the group
+	m, err := rt.mediaFromUpload(uploadId, userId, &groupId, 1)
+	if errors.Is(err, errUploadNotReady) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	} else if err != nil {
+		rt.baseLogger.WithError(err).Error("error attaching upload")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	photoURL := mediaURLPrefix + m.ID
 
-	err = rt.db.SetGroupPhoto(groupId, photoURL)
+	err = rt.db.SetGroupPhoto(groupId, photoURL, userId)
 	if err != nil {
+		rt.releaseMediaURL(photoURL)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	rt.releaseMediaURL(oldPhotoURL)
+	rt.postSystemMessage(groupId, systemEvent{Actor: userId, Action: systemPhotoChanged})
 
 	w.WriteHeader(http.StatusOK)
 }
@@ -0,0 +1,242 @@
+package api
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"git.phoebe2z/WASAText/service/database"
+	"github.com/julienschmidt/httprouter"
+)
+
+// newInviteToken returns a random, URL-safe invite token.
+func newInviteToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func (rt *_router) createInvite(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	userId, err := extractBearer(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	groupId, err := strconv.ParseInt(ps.ByName("groupId"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// All the fields are optional: by default links never expire and have no usage limit
+	var req struct {
+		ExpiresAt        *time.Time `json:"expiresAt"`
+		MaxUses          int        `json:"maxUses"`
+		RequiresApproval bool       `json:"requiresApproval"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if req.MaxUses < 0 || (req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now())) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if !rt.checkGroupPermission(w, groupId, userId, actionManageInvites) {
+		return
+	}
+
+	group, err := rt.db.GetConversation(groupId)
+	if err != nil || !group.IsGroup {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	token, err := newInviteToken()
+	if err != nil {
+		rt.baseLogger.WithError(err).Error("error generating invite token")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	inv := database.Invite{
+		Token:            token,
+		GroupId:          groupId,
+		CreatedBy:        userId,
+		CreatedAt:        time.Now(),
+		ExpiresAt:        req.ExpiresAt,
+		MaxUses:          req.MaxUses,
+		RequiresApproval: req.RequiresApproval,
+	}
+	err = rt.db.CreateInvite(inv)
+	if err != nil {
+		rt.baseLogger.WithError(err).Error("error creating invite")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(inv)
+}
+
+func (rt *_router) getInvites(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	userId, err := extractBearer(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	groupId, err := strconv.ParseInt(ps.ByName("groupId"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if !rt.checkGroupPermission(w, groupId, userId, actionManageInvites) {
+		return
+	}
+
+	invites, err := rt.db.GetInvites(groupId)
+	if err != nil {
+		rt.baseLogger.WithError(err).Error("error getting invites")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	if invites == nil {
+		_, _ = w.Write([]byte("[]"))
+		return
+	}
+	_ = json.NewEncoder(w).Encode(invites)
+}
+
+func (rt *_router) revokeInvite(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	userId, err := extractBearer(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	groupId, err := strconv.ParseInt(ps.ByName("groupId"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if !rt.checkGroupPermission(w, groupId, userId, actionManageInvites) {
+		return
+	}
+
+	err = rt.db.RevokeInvite(groupId, ps.ByName("token"), userId)
+	if errors.Is(err, sql.ErrNoRows) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		rt.baseLogger.WithError(err).Error("error revoking invite")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// previewInvite shows the group an invite link leads to, so that users can decide whether to join. Links that can no
+// longer be used are not found.
+func (rt *_router) previewInvite(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	_, err := extractBearer(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	inv, err := rt.db.GetInvite(ps.ByName("token"))
+	if err != nil || !inv.Usable(time.Now()) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	group, err := rt.db.GetConversation(inv.GroupId)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	members, err := rt.db.CountMembers(inv.GroupId)
+	if err != nil {
+		rt.baseLogger.WithError(err).Error("error counting group members")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"groupId":          group.ID,
+		"name":             group.Name,
+		"photoUrl":         rt.groupPhotoURL(group.ID, group.PhotoURL),
+		"memberCount":      members,
+		"requiresApproval": inv.RequiresApproval,
+	})
+}
+
+func (rt *_router) joinByInvite(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	userId, err := extractBearer(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	// The message is optional, it's shown to the admins if the link requires approval
+	var req struct {
+		Message string `json:"message"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	token := ps.ByName("token")
+	groupId, err := rt.db.JoinByInvite(token, userId)
+	switch {
+	case errors.Is(err, sql.ErrNoRows), errors.Is(err, database.ErrInviteNotUsable):
+		w.WriteHeader(http.StatusNotFound)
+		return
+	case errors.Is(err, database.ErrApprovalRequired):
+		rt.requestToJoin(w, groupId, userId, token, req.Message)
+		return
+	case errors.Is(err, database.ErrBanned):
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusForbidden)
+		_ = json.NewEncoder(w).Encode(map[string]string{"message": err.Error()})
+		return
+	case errors.Is(err, database.ErrAlreadyMember):
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"message":        err.Error(),
+			"conversationId": groupId,
+		})
+		return
+	case err != nil:
+		rt.baseLogger.WithError(err).Error("error joining group")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	rt.postSystemMessage(groupId, systemEvent{Actor: userId, Action: systemMemberJoined})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(map[string]int64{"groupId": groupId})
+}
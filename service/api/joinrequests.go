@@ -0,0 +1,218 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+
+	"git.phoebe2z/WASAText/service/database"
+	"github.com/julienschmidt/httprouter"
+)
+
+// requestToJoin records the request of the user to join the group, which the admins will approve or reject. It's
+// used by joinByInvite for links that require approval, and by requestToJoinGroup for the groups found without a link.
+func (rt *_router) requestToJoin(w http.ResponseWriter, groupId int64, userId int64, inviteToken string, message string) {
+	if len(message) > 500 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	jr, err := rt.db.CreateJoinRequest(groupId, userId, inviteToken, message)
+	if err != nil {
+		rt.baseLogger.WithError(err).Error("error creating join request")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	_ = json.NewEncoder(w).Encode(jr)
+}
+
+// requestToJoinGroup lets the user ask to join a group found without an invite link, i.e. a listed group of one of the
+// communities of the user.
+func (rt *_router) requestToJoinGroup(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	userId, err := extractBearer(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	groupId, err := strconv.ParseInt(ps.ByName("groupId"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// The message is optional, it's shown to the admins
+	var req struct {
+		Message string `json:"message"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// Groups the user cannot find are not found, so that requests don't disclose which groups exist
+	group, err := rt.db.GetConversation(groupId)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && (!group.IsGroup || group.CommunityId == nil)) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		rt.baseLogger.WithError(err).Error("error getting group")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	_, err = rt.db.GetCommunityRole(*group.CommunityId, userId)
+	if errors.Is(err, sql.ErrNoRows) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		rt.baseLogger.WithError(err).Error("error getting community role")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	groups, err := rt.db.GetCommunityGroups(*group.CommunityId, userId)
+	if err != nil {
+		rt.baseLogger.WithError(err).Error("error getting community groups")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	var listed *database.CommunityGroup
+	for i := range groups {
+		if groups[i].ID == groupId && groups[i].Listed {
+			listed = &groups[i]
+		}
+	}
+	if listed == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if listed.Joined {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"message":        database.ErrAlreadyMember.Error(),
+			"conversationId": groupId,
+		})
+		return
+	}
+	banned, err := rt.db.IsBanned(groupId, userId)
+	if err != nil {
+		rt.baseLogger.WithError(err).Error("error checking group ban")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if banned {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusForbidden)
+		_ = json.NewEncoder(w).Encode(map[string]string{"message": database.ErrBanned.Error()})
+		return
+	}
+
+	rt.requestToJoin(w, groupId, userId, "", req.Message)
+}
+
+func (rt *_router) getJoinRequests(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	userId, err := extractBearer(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	groupId, err := strconv.ParseInt(ps.ByName("groupId"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// Approving a request adds a member, so the same permission is needed to see them
+	if !rt.checkGroupPermission(w, groupId, userId, actionAddMembers) {
+		return
+	}
+
+	requests, err := rt.db.GetPendingJoinRequests(groupId)
+	if err != nil {
+		rt.baseLogger.WithError(err).Error("error getting join requests")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	if requests == nil {
+		_, _ = w.Write([]byte("[]"))
+		return
+	}
+	_ = json.NewEncoder(w).Encode(requests)
+}
+
+func (rt *_router) approveJoinRequest(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	rt.decideJoinRequest(w, r, ps, true)
+}
+
+func (rt *_router) rejectJoinRequest(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	rt.decideJoinRequest(w, r, ps, false)
+}
+
+// decideJoinRequest approves or rejects a pending join request. The requester gets a notification with the outcome.
+func (rt *_router) decideJoinRequest(w http.ResponseWriter, r *http.Request, ps httprouter.Params, approve bool) {
+	userId, err := extractBearer(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	groupId, err := strconv.ParseInt(ps.ByName("groupId"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	requestId, err := strconv.ParseInt(ps.ByName("requestId"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if !rt.checkGroupPermission(w, groupId, userId, actionAddMembers) {
+		return
+	}
+
+	jr, err := rt.db.GetJoinRequest(requestId)
+	if err != nil || jr.GroupId != groupId {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	jr, err = rt.db.DecideJoinRequest(requestId, userId, approve)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		w.WriteHeader(http.StatusNotFound)
+		return
+	case errors.Is(err, database.ErrBanned):
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusForbidden)
+		_ = json.NewEncoder(w).Encode(map[string]string{"message": err.Error()})
+		return
+	case errors.Is(err, database.ErrRequestDecided), errors.Is(err, database.ErrInviteNotUsable):
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		_ = json.NewEncoder(w).Encode(map[string]string{"message": err.Error()})
+		return
+	case err != nil:
+		rt.baseLogger.WithError(err).Error("error deciding join request")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if approve {
+		rt.postSystemMessage(groupId, systemEvent{Actor: userId, Action: systemMemberAdded, Targets: []int64{jr.UserId}})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(jr)
+}
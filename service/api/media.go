@@ -0,0 +1,416 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"git.phoebe2z/WASAText/service/database"
+	"github.com/gofrs/uuid"
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	// staticDir is the directory where uploaded files are stored
+	staticDir = "static"
+
+	// mediaSubdir is the sub-directory of staticDir holding access-controlled media. It is never served by getStatic.
+	mediaSubdir = "media"
+
+	// mediaURLPrefix is the prefix of the URLs of access-controlled media
+	mediaURLPrefix = "/media/"
+
+	// mediaURLLifetime is how long a signed URL stays valid
+	mediaURLLifetime = 15 * time.Minute
+
+	// mediaKeySize is the size of the key signing URLs
+	mediaKeySize = 32
+)
+
+// errNotImage is returned when uploaded content is not an image. Media are served from the origin of the API, so other
+// types (like HTML) could run scripts with the credentials of the users opening them.
+var errNotImage = errors.New("media is not an image")
+
+// isImage reports whether content of the given MIME type can be saved as media.
+func isImage(mimeType string) bool {
+	return strings.HasPrefix(mimeType, "image/")
+}
+
+// saveMedia stores data as a new media object, or returns errNotImage. If conversationId is not nil, only the
+// participants of that conversation will be able to read it. Content already present in the store is not saved again.
+// refCount is 1 for photos of users and groups, and 0 for media sent in messages, which add their own reference.
+func (rt *_router) saveMedia(data []byte, uploaderId int64, conversationId *int64, refCount int64) (database.Media, error) {
+	id, err := uuid.NewV4()
+	if err != nil {
+		return database.Media{}, err
+	}
+
+	m := database.Media{
+		ID:             strings.ReplaceAll(id.String(), "-", ""),
+		ConversationId: conversationId,
+		UploaderId:     uploaderId,
+		Size:           int64(len(data)),
+		MimeType:       http.DetectContentType(data),
+		RefCount:       refCount,
+	}
+	if !isImage(m.MimeType) {
+		return m, errNotImage
+	}
+
+	rt.media.Lock()
+	defer rt.media.Unlock()
+
+	m.BlobHash, err = rt.media.Put(data)
+	if err != nil {
+		return m, err
+	}
+	return m, rt.db.CreateMedia(m)
+}
+
+// copyMedia makes the media available to another conversation by creating a new reference to the same blob. The copy
+// is referenced by the message it's sent in.
+func (rt *_router) copyMedia(m database.Media, uploaderId int64, conversationId int64) (database.Media, error) {
+	id, err := uuid.NewV4()
+	if err != nil {
+		return database.Media{}, err
+	}
+
+	c := database.Media{
+		ID:             strings.ReplaceAll(id.String(), "-", ""),
+		ConversationId: &conversationId,
+		UploaderId:     uploaderId,
+		BlobHash:       m.BlobHash,
+		Size:           m.Size,
+		MimeType:       m.MimeType,
+	}
+
+	rt.media.Lock()
+	defer rt.media.Unlock()
+	return c, rt.db.CreateMedia(c)
+}
+
+// releaseMedia removes a reference to the media object. The last one drops the media object, removing its content from
+// the store if nothing else references it.
+func (rt *_router) releaseMedia(mediaId string) error {
+	rt.media.Lock()
+	defer rt.media.Unlock()
+
+	hash, err := rt.db.ReleaseMedia(mediaId)
+	if err != nil || hash == "" {
+		return err
+	}
+	return rt.media.Remove(hash)
+}
+
+// releaseMediaURL releases the media referenced by u, if u is a media URL. Errors are only logged: a leftover blob is
+// not a problem for the caller.
+func (rt *_router) releaseMediaURL(u string) {
+	id, ok := mediaIdFromURL(u)
+	if !ok {
+		return
+	}
+	err := rt.releaseMedia(id)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		rt.baseLogger.WithError(err).Warn("error releasing media")
+	}
+}
+
+// mediaIdFromURL returns the media ID referenced by the given URL, if it's a media URL.
+func mediaIdFromURL(u string) (string, bool) {
+	if !strings.HasPrefix(u, mediaURLPrefix) {
+		return "", false
+	}
+	id := strings.TrimPrefix(u, mediaURLPrefix)
+	if i := strings.IndexByte(id, '?'); i >= 0 {
+		id = id[:i]
+	}
+	return id, id != ""
+}
+
+// loadMediaKey returns the key signing URLs saved in path, hex-encoded. If the file doesn't exist, it's created with a
+// random key. If path is empty, the random key is not saved.
+func loadMediaKey(path string) ([]byte, error) {
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err == nil {
+			key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+			if err != nil || len(key) < mediaKeySize {
+				return nil, fmt.Errorf("%s is not a key of %d hex-encoded bytes", path, mediaKeySize)
+			}
+			return key, nil
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+	}
+
+	key := make([]byte, mediaKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	if path == "" {
+		return key, nil
+	}
+	// The file is only created if it still doesn't exist, so that the key of another process is not replaced
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	_, err = f.WriteString(hex.EncodeToString(key) + "\n")
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return key, err
+}
+
+// urlSignature returns the signature of a URL path expiring at the given unix timestamp.
+func (rt *_router) urlSignature(path string, expires int64) string {
+	mac := hmac.New(sha256.New, rt.mediaKey)
+	_, _ = fmt.Fprintf(mac, "%s:%d", path, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// signURL returns a short-lived signed URL for path, so that it can be used where the Authorization header cannot be
+// sent (e.g., in an <img> tag).
+func (rt *_router) signURL(path string) string {
+	expires := time.Now().Add(mediaURLLifetime).Unix()
+	q := url.Values{}
+	q.Set("expires", strconv.FormatInt(expires, 10))
+	q.Set("sig", rt.urlSignature(path, expires))
+	return path + "?" + q.Encode()
+}
+
+// validURLSignature checks whether the request URL has been signed with signURL and is not expired.
+func (rt *_router) validURLSignature(r *http.Request) bool {
+	expires, err := strconv.ParseInt(r.URL.Query().Get("expires"), 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return false
+	}
+	expected := rt.urlSignature(r.URL.Path, expires)
+	return hmac.Equal([]byte(expected), []byte(r.URL.Query().Get("sig")))
+}
+
+// signMediaURL returns a signed URL for u if u is a media URL. Other URLs are returned unchanged.
+func (rt *_router) signMediaURL(u string) string {
+	id, ok := mediaIdFromURL(u)
+	if !ok {
+		return u
+	}
+	return rt.signURL(mediaURLPrefix + id)
+}
+
+// canReadMedia checks whether the request is allowed to read m, either via a valid signature or because the
+// authenticated user is a participant of the conversation the media belongs to.
+func (rt *_router) canReadMedia(r *http.Request, m database.Media) bool {
+	if m.ConversationId == nil || rt.validURLSignature(r) {
+		return true
+	}
+
+	userId, err := extractBearer(r)
+	if err != nil {
+		return false
+	}
+	in, err := rt.db.IsUserInConversation(*m.ConversationId, userId)
+	return err == nil && in
+}
+
+func (rt *_router) getMedia(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	m, err := rt.db.GetMedia(ps.ByName("mediaId"))
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	// Answer with 404 instead of 403 to avoid disclosing which media exists
+	if !rt.canReadMedia(r, m) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	f, err := rt.media.Open(m.BlobHash)
+	if err != nil {
+		rt.baseLogger.WithError(err).Error("error reading media blob")
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+
+	// Blobs are content-addressed, so the hash is a strong ETag. Only images are shown inline, as other types (saved
+	// before uploads were limited to images) could run scripts.
+	w.Header().Set("Content-Type", m.MimeType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if !isImage(m.MimeType) {
+		w.Header().Set("Content-Disposition", "attachment")
+	}
+	w.Header().Set("ETag", `"`+m.BlobHash+`"`)
+	if m.ConversationId == nil {
+		w.Header().Set("Cache-Control", "public, max-age=86400")
+	} else {
+		w.Header().Set("Cache-Control", "private, max-age="+strconv.Itoa(int(mediaURLLifetime.Seconds())))
+	}
+	http.ServeContent(w, r, "", m.CreatedAt, f)
+}
+
+// getStatic serves public assets (like user avatars) from the static directory, with ETag and Cache-Control headers.
+// Access-controlled media and legacy group photos are not served here.
+func (rt *_router) getStatic(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	name := path.Clean("/" + ps.ByName("filepath"))[1:]
+	if name == "" || strings.Contains(name, "/") || strings.HasPrefix(name, "group-") {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	f, err := os.Open(filepath.Join(staticDir, name))
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("ETag", fmt.Sprintf(`"%x-%x"`, info.Size(), info.ModTime().UnixNano()))
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	http.ServeContent(w, r, name, info.ModTime(), f)
+}
+
+func (rt *_router) uploadMedia(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	userId, err := extractBearer(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	conversationId, err := strconv.ParseInt(ps.ByName("conversationId"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	in, err := rt.db.IsUserInConversation(conversationId, userId)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if !in {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	err = r.ParseMultipartForm(10 << 20)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	m, err := rt.saveMedia(data, userId, &conversationId, 0)
+	if errors.Is(err, errNotImage) {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		return
+	} else if err != nil {
+		rt.baseLogger.WithError(err).Error("error saving media")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(map[string]string{
+		"mediaId":   m.ID,
+		"mediaUrl":  mediaURLPrefix + m.ID,
+		"signedUrl": rt.signMediaURL(mediaURLPrefix + m.ID),
+	})
+}
+
+// protectLegacyGroupPhotos moves group photos uploaded before media access control existed (stored as public
+// /static/group-* files) to access-controlled media.
+func (rt *_router) protectLegacyGroupPhotos() error {
+	groups, err := rt.db.GetGroupsWithPhotoPrefix("/static/group-")
+	if err != nil {
+		return err
+	}
+
+	for _, g := range groups {
+		oldPath := filepath.Join(staticDir, filepath.Base(g.PhotoURL))
+		data, err := os.ReadFile(oldPath)
+		if err != nil {
+			rt.baseLogger.WithError(err).WithField("group", g.ID).Warn("legacy group photo not readable")
+			continue
+		}
+
+		// The uploader of legacy photos is unknown
+		groupId := g.ID
+		m, err := rt.saveMedia(data, 0, &groupId, 1)
+		if errors.Is(err, errNotImage) {
+			rt.baseLogger.WithField("group", g.ID).Warn("legacy group photo is not an image")
+			continue
+		} else if err != nil {
+			return err
+		}
+		err = rt.db.SetGroupPhoto(g.ID, mediaURLPrefix+m.ID, 0)
+		if err != nil {
+			return err
+		}
+		_ = os.Remove(oldPath)
+	}
+	return nil
+}
+
+// migrateLegacyMedia moves media uploaded before content-addressed storage (one file per media object) to the blob
+// store.
+func (rt *_router) migrateLegacyMedia() error {
+	legacy, err := rt.db.GetLegacyMedia()
+	if err != nil {
+		return err
+	}
+
+	for _, m := range legacy {
+		oldPath := filepath.Join(staticDir, mediaSubdir, filepath.Base(m.Filename))
+		data, err := os.ReadFile(oldPath)
+		if err != nil {
+			rt.baseLogger.WithError(err).WithField("media", m.ID).Warn("legacy media not readable")
+			continue
+		}
+
+		hash, err := rt.media.Put(data)
+		if err != nil {
+			return err
+		}
+		err = rt.db.SetMediaBlob(m.ID, hash, int64(len(data)))
+		if err != nil {
+			return err
+		}
+		_ = os.Remove(oldPath)
+	}
+	return nil
+}
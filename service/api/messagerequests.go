@@ -0,0 +1,67 @@
+package api
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Conversations started by users the recipient doesn't know, and groups they are added to by them, are message
+// requests: they are listed apart until the recipient accepts them, and the sender doesn't see read receipts until
+// then. Replying to a request accepts it.
+
+func (rt *_router) acceptMessageRequest(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	rt.setConversationState(w, r, ps, rt.db.AcceptMessageRequest)
+}
+
+// declineMessageRequest hides the request from the user and, with ?block=true, blocks the user who sent it.
+func (rt *_router) declineMessageRequest(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	userId, err := extractBearer(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	conversationId, err := strconv.ParseInt(ps.ByName("conversationId"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	conversation, err := rt.db.GetConversation(conversationId)
+	if errors.Is(err, sql.ErrNoRows) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		rt.baseLogger.WithError(err).Error("error getting conversation")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	requestFrom, err := rt.db.DeclineMessageRequest(conversationId, userId)
+	if errors.Is(err, sql.ErrNoRows) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		rt.baseLogger.WithError(err).Error("error declining message request")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if conversation.IsGroup {
+		rt.postSystemMessage(conversationId, systemEvent{Actor: userId, Action: systemMemberLeft})
+	}
+
+	if r.URL.Query().Get("block") == "true" {
+		err = rt.db.BlockUser(userId, requestFrom)
+		if err != nil {
+			rt.baseLogger.WithError(err).Error("error blocking user")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
@@ -1,9 +1,12 @@
 package api
 
 import (
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
 )
@@ -20,14 +23,21 @@ func (rt *_router) sendMessage(w http.ResponseWriter, r *http.Request, ps httpro
 		Content        string `json:"content"`
 		ContentType    string `json:"contentType"`
 		ReplyToId      *int64 `json:"replyToId"` // Casing fixed to match api.yaml
+		UploadId       string `json:"uploadId"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
+	// A completed resumable upload can be sent as photo in place of the content
+	if req.UploadId != "" && (req.ContentType != "photo" || req.Content != "") {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
 	// Validate
-	if len(req.Content) < 1 || (req.ContentType == "text" && len(req.Content) > 200) || (req.ContentType == "photo" && len(req.Content) > 5000000) {
+	if (len(req.Content) < 1 && req.UploadId == "") || (req.ContentType == "text" && len(req.Content) > 200) || (req.ContentType == "photo" && len(req.Content) > 5000000) {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
@@ -47,22 +57,90 @@ func (rt *_router) sendMessage(w http.ResponseWriter, r *http.Request, ps httpro
 		return
 	}
 
+	// Groups in announcement mode only accept messages from admins
+	conversation, err := rt.db.GetConversation(req.ConversationId)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if !conversation.IsGroup {
+		// Blocks stop the messages in both directions
+		blocked, err := rt.blockedInDirect(req.ConversationId, userId)
+		if err != nil {
+			rt.baseLogger.WithError(err).Error("error checking blocks")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if blocked {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+	} else {
+		if !rt.checkGroupPermission(w, req.ConversationId, userId, actionSendMessages) {
+			return
+		}
+		wait, err := rt.slowModeWait(req.ConversationId, userId)
+		if err != nil {
+			rt.baseLogger.WithError(err).Error("error checking slow mode")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if wait > 0 {
+			writeSlowModeWait(w, wait)
+			return
+		}
+	}
+
+	// Photos uploaded as media must belong to the conversation they are sent to
+	if mediaId, ok := mediaIdFromURL(req.Content); ok && req.ContentType == "photo" {
+		m, err := rt.db.GetMedia(mediaId)
+		if err != nil || m.ConversationId == nil || *m.ConversationId != req.ConversationId {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		req.Content = mediaURLPrefix + mediaId
+	}
+
 	if req.ReplyToId != nil {
 		replyMsg, err := rt.db.GetMessage(*req.ReplyToId)
-		if err == nil && replyMsg.IsDeleted {
-			// Cannot reply to deleted message
+		if err == nil && (replyMsg.IsDeleted || replyMsg.ContentType == systemContentType) {
+			// Cannot reply to deleted or system messages
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	if req.UploadId != "" {
+		m, err := rt.mediaFromUpload(req.UploadId, userId, &req.ConversationId, 0)
+		if errors.Is(err, errUploadNotReady) {
 			w.WriteHeader(http.StatusBadRequest)
 			return
+		} else if err != nil {
+			rt.baseLogger.WithError(err).Error("error attaching upload")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
 		}
+		req.Content = mediaURLPrefix + m.ID
 	}
 
 	msg, err := rt.db.SendMessage(req.ConversationId, userId, req.Content, req.ContentType, req.ReplyToId)
-	if err != nil {
+	if errors.Is(err, sql.ErrNoRows) && req.UploadId == "" {
+		// The photo has been released since it was checked
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	} else if err != nil {
+		if req.UploadId != "" {
+			rt.releaseMediaURL(req.Content)
+		}
 		rt.baseLogger.WithError(err).Error("error sending message")
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
+	if msg.ContentType == "photo" {
+		msg.Content = rt.signMediaURL(msg.Content)
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
 	_ = json.NewEncoder(w).Encode(msg)
@@ -92,6 +170,11 @@ func (rt *_router) deleteMessage(w http.ResponseWriter, r *http.Request, ps http
 		w.WriteHeader(http.StatusForbidden)
 		return
 	}
+	// System messages are part of the history of the group
+	if msg.ContentType == systemContentType {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
 
 	err = rt.db.DeleteMessage(messageId)
 	if err != nil {
@@ -99,6 +182,11 @@ func (rt *_router) deleteMessage(w http.ResponseWriter, r *http.Request, ps http
 		return
 	}
 
+	// Deleted messages are shown as placeholders, so their attachments are not needed anymore
+	if msg.ContentType == "photo" {
+		rt.releaseMediaURL(msg.Content)
+	}
+
 	w.WriteHeader(http.StatusOK)
 }
 
@@ -127,7 +215,7 @@ func (rt *_router) forwardMessage(w http.ResponseWriter, r *http.Request, ps htt
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
-	if msg.IsDeleted {
+	if msg.IsDeleted || msg.ContentType == systemContentType {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
@@ -146,16 +234,72 @@ func (rt *_router) forwardMessage(w http.ResponseWriter, r *http.Request, ps htt
 		return
 	}
 
+	// Slow mode applies to forwarded messages too. The targets are checked before forwarding anything, so that the
+	// message is either forwarded everywhere or the client is told how long to wait.
+	var wait time.Duration
+	for _, targetId := range req.TargetConversationIds {
+		target, err := rt.db.GetConversation(targetId)
+		if err != nil || !target.IsGroup {
+			continue
+		}
+		if in, _ := rt.db.IsUserInConversation(targetId, userId); !in {
+			continue
+		}
+		targetWait, err := rt.slowModeWait(targetId, userId)
+		if err != nil {
+			rt.baseLogger.WithError(err).Error("error checking slow mode")
+			continue
+		}
+		wait = max(wait, targetWait)
+	}
+	if wait > 0 {
+		writeSlowModeWait(w, wait)
+		return
+	}
+
 	for _, targetId := range req.TargetConversationIds {
 		// Check access to target
 		inTarget, _ := rt.db.IsUserInConversation(targetId, userId)
 		if inTarget {
+			target, err := rt.db.GetConversation(targetId)
+			if err != nil {
+				rt.baseLogger.WithError(err).Error("error getting forward target")
+				continue
+			}
+			if target.IsGroup {
+				if ok, err := rt.hasGroupPermission(targetId, userId, actionSendMessages); err != nil || !ok {
+					continue
+				}
+			} else if blocked, err := rt.blockedInDirect(targetId, userId); err != nil || blocked {
+				continue
+			}
+
+			content := msg.Content
+
+			// Media is scoped to a conversation, so the target gets its own reference to the same file
+			if mediaId, ok := mediaIdFromURL(content); ok && msg.ContentType == "photo" {
+				m, err := rt.db.GetMedia(mediaId)
+				if err != nil {
+					rt.baseLogger.WithError(err).Error("error getting forwarded media")
+					continue
+				}
+				copied, err := rt.copyMedia(m, userId, targetId)
+				if err != nil {
+					rt.baseLogger.WithError(err).Error("error copying forwarded media")
+					continue
+				}
+				content = mediaURLPrefix + copied.ID
+			}
+
 			// Send message as a new message from this user
 			// Content is same, Type is same. ReplyTo is nil for forwarded? usually.
-			_, err = rt.db.SendMessage(targetId, userId, msg.Content, msg.ContentType, nil)
+			_, err = rt.db.SendMessage(targetId, userId, content, msg.ContentType, nil)
 			if err != nil {
 				// Log error but continue?
 				rt.baseLogger.WithError(err).Error("error forwarding to conversation")
+				if content != msg.Content {
+					rt.releaseMediaURL(content)
+				}
 			}
 		}
 	}
@@ -231,7 +375,7 @@ func (rt *_router) commentMessage(w http.ResponseWriter, r *http.Request, ps htt
 	}
 	// I will verify the import in next step.
 
-	if msg.IsDeleted {
+	if msg.IsDeleted || msg.ContentType == systemContentType {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
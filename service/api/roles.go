@@ -0,0 +1,241 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"git.phoebe2z/WASAText/service/database"
+	"github.com/julienschmidt/httprouter"
+)
+
+// groupAction is an action on a group that requires a minimum role.
+type groupAction int
+
+const (
+	actionEditInfo groupAction = iota
+	actionAddMembers
+	actionSendMessages
+	actionRemoveMembers
+	actionManageBans
+	actionManageInvites
+	actionEditSettings
+	actionViewAudit
+	actionManageAdmins
+	actionTransferOwnership
+)
+
+// actionRoles is the minimum role needed for each group action. Editing the info, adding members and sending
+// messages are open to all the members unless the group settings restrict them to admins.
+var actionRoles = map[groupAction]string{
+	actionEditInfo:          database.RoleAdmin,
+	actionAddMembers:        database.RoleAdmin,
+	actionSendMessages:      database.RoleAdmin,
+	actionRemoveMembers:     database.RoleAdmin,
+	actionManageBans:        database.RoleAdmin,
+	actionManageInvites:     database.RoleAdmin,
+	actionEditSettings:      database.RoleAdmin,
+	actionViewAudit:         database.RoleAdmin,
+	actionManageAdmins:      database.RoleOwner,
+	actionTransferOwnership: database.RoleOwner,
+}
+
+// roleRank orders the roles: a role can do everything a lower-ranked role can.
+func roleRank(role string) int {
+	switch role {
+	case database.RoleOwner:
+		return 2
+	case database.RoleAdmin:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// requiredRole returns the minimum role needed for the action in the group, taking the group settings into account.
+// It returns sql.ErrNoRows if the conversation is not a group.
+func (rt *_router) requiredRole(groupId int64, action groupAction) (string, error) {
+	g, err := rt.db.GetGroupProfile(groupId)
+	if err != nil {
+		return "", err
+	}
+
+	restricted := true
+	switch action {
+	case actionEditInfo:
+		restricted = g.Settings.OnlyAdminsEditInfo
+	case actionAddMembers:
+		restricted = g.Settings.OnlyAdminsAddMembers
+	case actionSendMessages:
+		restricted = g.Settings.OnlyAdminsSend
+	}
+	if !restricted {
+		return database.RoleMember, nil
+	}
+	return actionRoles[action], nil
+}
+
+// effectiveRole returns the role of userId in the group. The admins of the community the group belongs to are admins
+// of the group too, even when they are not members. It returns sql.ErrNoRows if the user has no role in the group, or
+// the conversation is not a group.
+func (rt *_router) effectiveRole(groupId int64, userId int64) (string, error) {
+	role, err := rt.db.GetMemberRole(groupId, userId)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return "", err
+	}
+	member := err == nil
+	if member && roleRank(role) >= roleRank(database.RoleAdmin) {
+		return role, nil
+	}
+
+	c, err := rt.db.GetConversation(groupId)
+	if err != nil {
+		return "", err
+	}
+	if c.IsGroup && c.CommunityId != nil {
+		communityRole, err := rt.db.GetCommunityRole(*c.CommunityId, userId)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return "", err
+		}
+		if err == nil && roleRank(communityRole) >= roleRank(database.RoleAdmin) {
+			return database.RoleAdmin, nil
+		}
+	}
+
+	if !member {
+		return "", sql.ErrNoRows
+	}
+	return role, nil
+}
+
+// hasGroupPermission reports whether userId can perform the action on the group. It returns sql.ErrNoRows if the
+// user has no role in the group, or the conversation is not a group.
+func (rt *_router) hasGroupPermission(groupId int64, userId int64, action groupAction) (bool, error) {
+	role, err := rt.effectiveRole(groupId, userId)
+	if err != nil {
+		return false, err
+	}
+	required, err := rt.requiredRole(groupId, action)
+	if err != nil {
+		return false, err
+	}
+	return roleRank(role) >= roleRank(required), nil
+}
+
+// checkGroupPermission checks whether userId can perform the action on the group. If not, it writes the error
+// response and returns false.
+func (rt *_router) checkGroupPermission(w http.ResponseWriter, groupId int64, userId int64, action groupAction) bool {
+	ok, err := rt.hasGroupPermission(groupId, userId, action)
+	if errors.Is(err, sql.ErrNoRows) {
+		w.WriteHeader(http.StatusForbidden)
+		return false
+	} else if err != nil {
+		rt.baseLogger.WithError(err).Error("error checking group permission")
+		w.WriteHeader(http.StatusInternalServerError)
+		return false
+	}
+
+	if !ok {
+		w.WriteHeader(http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// setMemberRole promotes a member to admin or demotes an admin to member. Only the owner can do it.
+func (rt *_router) setMemberRole(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	userId, err := extractBearer(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	groupId, err := strconv.ParseInt(ps.ByName("groupId"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	memberId, err := strconv.ParseInt(ps.ByName("userId"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		Role string `json:"role"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	// The owner role can only be given with transferOwnership
+	if req.Role != database.RoleAdmin && req.Role != database.RoleMember {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if !rt.checkGroupPermission(w, groupId, userId, actionManageAdmins) {
+		return
+	}
+	if memberId == userId {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	err = rt.db.SetMemberRole(groupId, memberId, req.Role, userId)
+	if errors.Is(err, sql.ErrNoRows) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		rt.baseLogger.WithError(err).Error("error setting member role")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// transferOwnership makes another member the owner of the group. The previous owner becomes an admin.
+func (rt *_router) transferOwnership(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	userId, err := extractBearer(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	groupId, err := strconv.ParseInt(ps.ByName("groupId"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		UserId int64 `json:"userId"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if !rt.checkGroupPermission(w, groupId, userId, actionTransferOwnership) {
+		return
+	}
+	if req.UserId == userId {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	err = rt.db.TransferOwnership(groupId, userId, req.UserId)
+	if errors.Is(err, sql.ErrNoRows) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		rt.baseLogger.WithError(err).Error("error transferring group ownership")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,53 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"git.phoebe2z/WASAText/service/database"
+	"github.com/julienschmidt/httprouter"
+)
+
+// Saved Messages is a personal conversation where the user is the only participant, to keep notes and forwarded
+// messages. It is created on first use, and works like any other conversation.
+
+const (
+	savedMessagesName    = "Saved Messages"
+	savedMessagesIconURL = "/avatars/saved"
+)
+
+// savedMessagesIcon is the icon of Saved Messages: a bookmark on the background of the avatars
+var savedMessagesIcon = []byte(`<svg xmlns="http://www.w3.org/2000/svg" width="128" height="128" viewBox="0 0 128 128">` +
+	`<circle cx="64" cy="64" r="64" fill="#64b5f6"/>` +
+	`<path d="M44 34h40v62l-20-14-20 14z" fill="#ffffff"/>` +
+	`</svg>`)
+
+// setSavedMessagesInfo gives Saved Messages its own name and icon, in place of the name and photo of the user.
+func setSavedMessagesInfo(c *database.Conversation) {
+	c.Name = savedMessagesName
+	c.PhotoURL = savedMessagesIconURL
+}
+
+// getSavedMessages returns the Saved Messages conversation of the user, creating it on first use.
+func (rt *_router) getSavedMessages(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	userId, err := extractBearer(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	conversation, _, err := rt.db.GetSavedMessages(userId)
+	if err != nil {
+		rt.baseLogger.WithError(err).Error("error getting saved messages")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	setSavedMessagesInfo(&conversation)
+
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(conversation)
+}
+
+func (rt *_router) getSavedMessagesIcon(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	serveAvatar(w, r, savedMessagesIcon, "public, max-age=86400")
+}
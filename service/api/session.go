@@ -4,13 +4,17 @@ import (
 	"encoding/json"
 	"net/http"
 
+	"git.phoebe2z/WASAText/service/database"
 	"github.com/julienschmidt/httprouter"
 )
 
+// doLogin logs in the user with the given name, creating it if it doesn't exist. Deactivated users can only log in with
+// reactivate, which reactivates their account.
 func (rt *_router) doLogin(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	// Parse request body
 	var req struct {
-		Name string `json:"name"`
+		Name       string `json:"name"`
+		Reactivate bool   `json:"reactivate"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		w.WriteHeader(http.StatusBadRequest)
@@ -18,7 +22,7 @@ func (rt *_router) doLogin(w http.ResponseWriter, r *http.Request, ps httprouter
 	}
 
 	// Validate Name
-	if len(req.Name) < 3 || len(req.Name) > 16 {
+	if len(req.Name) < 3 || len(req.Name) > 16 || req.Name == database.DeletedAccountName {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
@@ -28,7 +32,25 @@ func (rt *_router) doLogin(w http.ResponseWriter, r *http.Request, ps httprouter
 	// Check if user exists
 	user, err := rt.db.GetUserByName(req.Name)
 	if err == nil {
+		if user.Deactivated {
+			if !req.Reactivate {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusForbidden)
+				_ = json.NewEncoder(w).Encode(map[string]string{"message": "account deactivated"})
+				return
+			}
+			err = rt.db.SetUserDeactivated(user.ID, false)
+			if err != nil {
+				rt.baseLogger.WithError(err).Error("error reactivating user")
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+		}
+
 		// User exists, return ID
+		if !rt.recordSession(w, r, user.ID, false) {
+			return
+		}
 		w.WriteHeader(http.StatusCreated)
 		_ = json.NewEncoder(w).Encode(map[string]int64{"identifier": user.ID})
 		return
@@ -41,7 +63,22 @@ func (rt *_router) doLogin(w http.ResponseWriter, r *http.Request, ps httprouter
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	if !rt.recordSession(w, r, newUser.ID, true) {
+		return
+	}
 
 	w.WriteHeader(http.StatusCreated)
 	_ = json.NewEncoder(w).Encode(map[string]int64{"identifier": newUser.ID})
 }
+
+// recordSession adds the login to the session history of the user, which is part of the account takeout. It answers
+// 500 and returns false on errors.
+func (rt *_router) recordSession(w http.ResponseWriter, r *http.Request, userId int64, newUser bool) bool {
+	err := rt.db.RecordSession(userId, r.UserAgent(), newUser)
+	if err != nil {
+		rt.baseLogger.WithError(err).Error("error recording session")
+		w.WriteHeader(http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
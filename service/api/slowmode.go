@@ -0,0 +1,55 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"git.phoebe2z/WASAText/service/database"
+)
+
+// maxSlowMode is the longest slow mode interval admins can set
+const maxSlowMode = 24 * time.Hour
+
+// slowModeWait returns how long the user has to wait before sending another message to the group. Admins and the
+// owner are not subject to slow mode.
+func (rt *_router) slowModeWait(groupId int64, userId int64) (time.Duration, error) {
+	g, err := rt.db.GetGroupProfile(groupId)
+	if err != nil || g.Settings.SlowModeSeconds == 0 {
+		return 0, err
+	}
+
+	role, err := rt.effectiveRole(groupId, userId)
+	if err != nil || roleRank(role) >= roleRank(database.RoleAdmin) {
+		return 0, err
+	}
+
+	last, err := rt.db.GetLastMessageTime(groupId, userId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	wait := time.Duration(g.Settings.SlowModeSeconds)*time.Second - time.Since(last)
+	if wait < 0 {
+		wait = 0
+	}
+	return wait, nil
+}
+
+// writeSlowModeWait answers a message sent too early in slow mode, telling the client how many seconds to wait.
+func writeSlowModeWait(w http.ResponseWriter, wait time.Duration) {
+	seconds := int(math.Ceil(wait.Seconds()))
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	w.WriteHeader(http.StatusTooManyRequests)
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":    "slow mode",
+		"retryAfter": seconds,
+	})
+}
@@ -0,0 +1,55 @@
+package api
+
+import (
+	"encoding/json"
+)
+
+// System messages record group lifecycle events in the conversation history. They are sent by the user who caused the
+// event, with contentType "system" and a JSON systemEvent as content. Users cannot send, react to, reply to, delete
+// or forward them.
+
+const systemContentType = "system"
+
+// Actions of system messages
+const (
+	systemMemberAdded        = "member_added"
+	systemMemberRemoved      = "member_removed"
+	systemMemberJoined       = "member_joined"
+	systemMemberLeft         = "member_left"
+	systemGroupRenamed       = "group_renamed"
+	systemPhotoChanged       = "photo_changed"
+	systemDescriptionChanged = "description_changed"
+	systemSettingsChanged    = "settings_changed"
+)
+
+// systemEvent is the content of a system message.
+type systemEvent struct {
+	Actor    int64   `json:"actor"`
+	Action   string  `json:"action"`
+	Targets  []int64 `json:"targets,omitempty"`
+	OldValue string  `json:"oldValue,omitempty"`
+	NewValue string  `json:"newValue,omitempty"`
+}
+
+// postSystemMessage adds a system message for the event to the conversation. The event has already happened, so
+// errors are only logged. Membership changes are not posted in channels, where subscribers come and go.
+func (rt *_router) postSystemMessage(conversationId int64, event systemEvent) {
+	switch event.Action {
+	case systemMemberAdded, systemMemberRemoved, systemMemberJoined, systemMemberLeft:
+		conversation, err := rt.db.GetConversation(conversationId)
+		if err != nil || conversation.IsChannel {
+			return
+		}
+	}
+
+	content, err := json.Marshal(event)
+	if err != nil {
+		rt.baseLogger.WithError(err).Error("error encoding system message")
+		return
+	}
+
+	_, err = rt.db.SendMessage(conversationId, event.Actor, string(content), systemContentType, nil)
+	if err != nil {
+		rt.baseLogger.WithError(err).WithField("action", event.Action).Error("error sending system message")
+	}
+}
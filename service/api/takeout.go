@@ -0,0 +1,361 @@
+package api
+
+import (
+	"archive/zip"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"git.phoebe2z/WASAText/service/database"
+	"github.com/gofrs/uuid"
+	"github.com/julienschmidt/httprouter"
+)
+
+// A takeout is a zip with everything known about a user, built in the background:
+//
+//	profile.json        the profile
+//	sessions.json       the logins, since they are recorded
+//	conversations.json  the conversations the user is in, with the settings of the user
+//	messages.json       the messages sent by the user, including the deleted ones
+//	reactions.json      the reactions left by the user
+//	blocked.json        the users blocked by the user
+//	folders.json        the folders of the user
+//	notifications.json  the notifications received by the user
+//	media.json          the files uploaded by the user, whose content is in media/
+//
+// The archive can be downloaded until it expires, then it's removed by the media garbage collector.
+
+const (
+	// takeoutsSubdir is the sub-directory of staticDir holding the takeout archives. It is never served by getStatic.
+	takeoutsSubdir = "takeouts"
+
+	// takeoutURLPrefix is the prefix of the download URLs of takeouts
+	takeoutURLPrefix = "/takeouts/"
+
+	// takeoutLifetime is how long a takeout can be downloaded once ready
+	takeoutLifetime = 7 * 24 * time.Hour
+)
+
+// takeoutStatus is a takeout as shown to its user. The download URL is signed, and expires before the takeout.
+type takeoutStatus struct {
+	database.Takeout
+	DownloadURL string `json:"downloadUrl,omitempty"`
+}
+
+// takeoutPath returns the path of the archive of the takeout.
+func takeoutPath(id string) string {
+	return filepath.Join(staticDir, takeoutsSubdir, id+".zip")
+}
+
+// requestTakeout starts building the takeout of the user, unless one is already being built or ready: users can
+// request a new takeout once the previous one expires. The takeout is ready when getTakeout reports it.
+func (rt *_router) requestTakeout(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	userId, err := extractBearer(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	t, err := rt.db.GetCurrentTakeout(userId)
+	if err == nil && takeoutExpired(t) {
+		err = sql.ErrNoRows
+	}
+	if err == nil && t.Status == database.TakeoutReady {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Location", "/user/me/export/"+t.ID)
+		_ = json.NewEncoder(w).Encode(takeoutStatus{Takeout: t, DownloadURL: rt.signURL(takeoutURLPrefix + t.ID)})
+		return
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		var id uuid.UUID
+		id, err = uuid.NewV4()
+		if err == nil {
+			t = database.Takeout{
+				ID:        strings.ReplaceAll(id.String(), "-", ""),
+				UserId:    userId,
+				Status:    database.TakeoutPending,
+				CreatedAt: time.Now(),
+			}
+			err = rt.db.CreateTakeout(t)
+		}
+		if err == nil {
+			rt.background.Add(1)
+			go rt.buildTakeout(t)
+		}
+	}
+	if err != nil {
+		rt.baseLogger.WithError(err).Error("error requesting takeout")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/user/me/export/"+t.ID)
+	w.WriteHeader(http.StatusAccepted)
+	_ = json.NewEncoder(w).Encode(takeoutStatus{Takeout: t})
+}
+
+// getTakeout returns the status of a takeout of the user, with a download URL once it's ready.
+func (rt *_router) getTakeout(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	userId, err := extractBearer(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	t, err := rt.db.GetTakeout(ps.ByName("exportId"))
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && (t.UserId != userId || takeoutExpired(t))) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		rt.baseLogger.WithError(err).Error("error getting takeout")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	status := takeoutStatus{Takeout: t}
+	if t.Status == database.TakeoutReady {
+		status.DownloadURL = rt.signURL(takeoutURLPrefix + t.ID)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(status)
+}
+
+// downloadTakeout serves the archive of a ready takeout, to its user or to requests carrying a valid signature.
+func (rt *_router) downloadTakeout(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	t, err := rt.db.GetTakeout(ps.ByName("exportId"))
+	if err != nil || t.Status != database.TakeoutReady || takeoutExpired(t) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	// Answer with 404 instead of 403 to avoid disclosing which takeouts exist
+	if !rt.validURLSignature(r) {
+		userId, err := extractBearer(r)
+		if err != nil || userId != t.UserId {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+	}
+
+	f, err := os.Open(takeoutPath(t.ID))
+	if err != nil {
+		rt.baseLogger.WithError(err).Error("error reading takeout")
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="takeout-`+t.CreatedAt.Format("2006-01-02")+`.zip"`)
+	w.Header().Set("Cache-Control", "private, no-store")
+	// Large takeouts take longer than the server WriteTimeout to download
+	http.ServeContent(newDeadlineWriter(w), r, "", *t.CompletedAt, f)
+}
+
+// takeoutExpired reports whether the takeout can't be downloaded anymore, even if the garbage collector has not removed
+// it yet.
+func takeoutExpired(t database.Takeout) bool {
+	return t.ExpiresAt != nil && time.Now().After(*t.ExpiresAt)
+}
+
+// buildTakeout writes the archive of the takeout, and marks the takeout as ready or failed.
+func (rt *_router) buildTakeout(t database.Takeout) {
+	defer rt.background.Done()
+	logger := rt.baseLogger.WithField("takeout", t.ID)
+
+	size, err := rt.writeTakeout(t)
+	if err != nil {
+		logger.WithError(err).Error("error building takeout")
+		_ = os.Remove(takeoutPath(t.ID))
+		if err := rt.db.FailTakeout(t.ID); err != nil {
+			logger.WithError(err).Error("error marking takeout as failed")
+		}
+		return
+	}
+
+	err = rt.db.CompleteTakeout(t.ID, size, time.Now().Add(takeoutLifetime))
+	if err != nil {
+		logger.WithError(err).Error("error completing takeout")
+		_ = os.Remove(takeoutPath(t.ID))
+		return
+	}
+	logger.WithField("size", size).Info("takeout ready")
+}
+
+// writeTakeout writes the archive of the takeout, and returns its size.
+func (rt *_router) writeTakeout(t database.Takeout) (int64, error) {
+	err := os.MkdirAll(filepath.Join(staticDir, takeoutsSubdir), 0o750)
+	if err != nil {
+		return 0, err
+	}
+	f, err := os.Create(takeoutPath(t.ID))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	zw := zip.NewWriter(f)
+
+	user, err := rt.db.GetUser(t.UserId)
+	if err != nil {
+		return 0, err
+	}
+	err = writeTakeoutJSON(zw, "profile.json", user)
+	if err != nil {
+		return 0, err
+	}
+
+	sessions, err := rt.db.GetSessions(t.UserId)
+	if err == nil {
+		err = writeTakeoutJSON(zw, "sessions.json", sessions)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	memberships, err := rt.db.GetMemberships(t.UserId)
+	if err == nil {
+		err = writeTakeoutJSON(zw, "conversations.json", memberships)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	reactions, err := rt.db.GetGivenReactions(t.UserId)
+	if err == nil {
+		err = writeTakeoutJSON(zw, "reactions.json", reactions)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	blocked, err := rt.db.GetBlockedUsers(t.UserId)
+	if err == nil {
+		err = writeTakeoutJSON(zw, "blocked.json", blocked)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	folders, err := rt.db.GetFolders(t.UserId)
+	if err == nil {
+		err = writeTakeoutJSON(zw, "folders.json", folders)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	notifications, err := rt.db.GetNotifications(t.UserId, false)
+	if err == nil {
+		err = writeTakeoutJSON(zw, "notifications.json", notifications)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	// The media are listed beforehand, so that the messages can link them to their path inside the zip
+	media, err := rt.db.GetUploadedMedia(t.UserId)
+	if err != nil {
+		return 0, err
+	}
+	type takeoutMedia struct {
+		database.Media
+		File string `json:"file,omitempty"`
+	}
+	files := make([]takeoutMedia, 0, len(media))
+	paths := make(map[string]string)
+	for _, m := range media {
+		tm := takeoutMedia{Media: m}
+		// Legacy media not yet moved to the media store are left out
+		if m.BlobHash != "" {
+			tm.File = exportMediaDir + m.ID + exportExtensions[m.MimeType]
+			paths[m.ID] = tm.File
+		}
+		files = append(files, tm)
+	}
+	err = writeTakeoutJSON(zw, "media.json", files)
+	if err != nil {
+		return 0, err
+	}
+
+	// Messages are written one page at a time, so that the history is never held in memory
+	out, err := createTakeoutFile(zw, "messages.json")
+	if err != nil {
+		return 0, err
+	}
+	_, err = io.WriteString(out, "[")
+	sep := "\n  "
+	if err == nil {
+		err = rt.db.ExportUserMessages(t.UserId, func(m database.Message) error {
+			if mediaId, ok := mediaIdFromURL(m.Content); ok && m.ContentType == "photo" {
+				if path, ok := paths[mediaId]; ok {
+					m.Content = path
+				}
+			}
+			data, err := json.Marshal(m)
+			if err != nil {
+				return err
+			}
+			_, err = io.WriteString(out, sep+string(data))
+			sep = ",\n  "
+			return err
+		})
+	}
+	if err == nil {
+		_, err = io.WriteString(out, "\n]\n")
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	for _, m := range media {
+		if path, ok := paths[m.ID]; ok {
+			err = rt.exportMedia(zw, path, m)
+			if err != nil {
+				rt.baseLogger.WithError(err).WithField("mediaId", m.ID).Warn("error adding media to takeout")
+			}
+		}
+	}
+
+	err = zw.Close()
+	if err != nil {
+		return 0, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), f.Close()
+}
+
+// writeTakeoutJSON adds v to the takeout zip as a JSON file. Nil slices are written as empty arrays.
+func writeTakeoutJSON(zw *zip.Writer, name string, v interface{}) error {
+	out, err := createTakeoutFile(zw, name)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	if string(data) == "null" {
+		data = []byte("[]")
+	}
+	_, err = out.Write(append(data, '\n'))
+	return err
+}
+
+// createTakeoutFile adds a compressed file to the takeout zip.
+func createTakeoutFile(zw *zip.Writer, name string) (io.Writer, error) {
+	return zw.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   zip.Deflate,
+		Modified: time.Now(),
+	})
+}
@@ -0,0 +1,402 @@
+package api
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"git.phoebe2z/WASAText/service/database"
+	"github.com/gofrs/uuid"
+	"github.com/julienschmidt/httprouter"
+)
+
+// Resumable uploads implement the core protocol of tus 1.0.0 (https://tus.io/protocols/resumable-upload), with the
+// creation, termination and expiration extensions. Completed uploads can be attached to messages (see sendMessage) or
+// set as user or group photos, until they expire.
+
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,termination,expiration"
+
+	// uploadsSubdir is the sub-directory of staticDir holding incomplete uploads
+	uploadsSubdir = "uploads"
+
+	// maxUploadSize is the maximum size of a resumable upload
+	maxUploadSize = 100 << 20
+
+	// uploadLifetime is how long an upload is kept after the last received chunk
+	uploadLifetime = 24 * time.Hour
+
+	// uploadChunkTimeout is how long a single PATCH request may take. It replaces the server ReadTimeout, which is
+	// too short for large chunks on slow connections.
+	uploadChunkTimeout = 10 * time.Minute
+)
+
+// errUploadNotReady is returned when an upload cannot be used: missing, not owned by the user, not completed or not an
+// image
+var errUploadNotReady = errors.New("upload not found or not completed")
+
+// uploadLocks holds a *sync.Mutex per upload ID, to reject concurrent PATCH requests on the same upload. Entries are
+// removed when the upload is completed or deleted, or when it expires (see ForgetUpload).
+var uploadLocks sync.Map
+
+func uploadPath(id string) string {
+	return filepath.Join(staticDir, uploadsSubdir, id)
+}
+
+// tusHeaders sets the headers common to all tus responses.
+func tusHeaders(w http.ResponseWriter) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Cache-Control", "no-store")
+}
+
+// checkTusVersion rejects requests for an unsupported protocol version.
+func checkTusVersion(w http.ResponseWriter, r *http.Request) bool {
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return false
+	}
+	return true
+}
+
+// getOwnUpload returns the upload with the ID in the path, if it belongs to userId.
+func (rt *_router) getOwnUpload(ps httprouter.Params, userId int64) (database.Upload, bool) {
+	u, err := rt.db.GetUpload(ps.ByName("uploadId"))
+	if err != nil || u.UserId != userId {
+		return u, false
+	}
+	return u, true
+}
+
+func (rt *_router) optionsUploads(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	tusHeaders(w)
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", tusExtensions)
+	w.Header().Set("Tus-Max-Size", strconv.Itoa(maxUploadSize))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (rt *_router) createUpload(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	tusHeaders(w)
+	userId, err := extractBearer(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if !checkTusVersion(w, r) {
+		return
+	}
+
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 1 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if length > maxUploadSize {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	id, err := uuid.NewV4()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	u := database.Upload{
+		ID:        strings.ReplaceAll(id.String(), "-", ""),
+		UserId:    userId,
+		Length:    length,
+		Metadata:  r.Header.Get("Upload-Metadata"),
+		ExpiresAt: time.Now().Add(uploadLifetime),
+	}
+
+	err = os.MkdirAll(filepath.Join(staticDir, uploadsSubdir), 0755)
+	if err == nil {
+		err = os.WriteFile(uploadPath(u.ID), nil, 0644)
+	}
+	if err != nil {
+		rt.baseLogger.WithError(err).Error("error creating upload file")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	err = rt.db.CreateUpload(u)
+	if err != nil {
+		_ = os.Remove(uploadPath(u.ID))
+		rt.baseLogger.WithError(err).Error("error creating upload")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Location", "/uploads/"+u.ID)
+	w.Header().Set("Upload-Expires", u.ExpiresAt.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (rt *_router) getUploadOffset(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	tusHeaders(w)
+	userId, err := extractBearer(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if !checkTusVersion(w, r) {
+		return
+	}
+
+	u, ok := rt.getOwnUpload(ps, userId)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if u.ExpiresAt.Before(time.Now()) {
+		w.WriteHeader(http.StatusGone)
+		return
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(u.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(u.Length, 10))
+	w.Header().Set("Upload-Expires", u.ExpiresAt.UTC().Format(http.TimeFormat))
+	if u.Metadata != "" {
+		w.Header().Set("Upload-Metadata", u.Metadata)
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (rt *_router) patchUpload(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	tusHeaders(w)
+	userId, err := extractBearer(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if !checkTusVersion(w, r) {
+		return
+	}
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		return
+	}
+
+	// Only the uploads that can receive chunks get a lock: the others would never release it
+	if u, ok := rt.getOwnUpload(ps, userId); !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if u.ExpiresAt.Before(time.Now()) {
+		w.WriteHeader(http.StatusGone)
+		return
+	}
+
+	lock, _ := uploadLocks.LoadOrStore(ps.ByName("uploadId"), &sync.Mutex{})
+	if !lock.(*sync.Mutex).TryLock() {
+		// Another chunk of the same upload is being received
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+	defer lock.(*sync.Mutex).Unlock()
+
+	// Read the upload again, now that no other chunk can change it
+	u, ok := rt.getOwnUpload(ps, userId)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if u.ExpiresAt.Before(time.Now()) {
+		w.WriteHeader(http.StatusGone)
+		return
+	}
+
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if offset != u.Offset || u.Completed() {
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+
+	// Allow more time than the server ReadTimeout to receive the chunk
+	_ = http.NewResponseController(w).SetReadDeadline(time.Now().Add(uploadChunkTimeout))
+
+	f, err := os.OpenFile(uploadPath(u.ID), os.O_WRONLY, 0644)
+	if err != nil {
+		rt.baseLogger.WithError(err).Error("error opening upload file")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// Drop any byte written after the last saved offset (e.g., by a chunk that failed while saving the offset)
+	err = f.Truncate(u.Offset)
+	if err == nil {
+		_, err = f.Seek(u.Offset, io.SeekStart)
+	}
+	if err != nil {
+		_ = f.Close()
+		rt.baseLogger.WithError(err).Error("error preparing upload file")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// Keep what has been received even if the connection drops: the client will resume from there
+	n, copyErr := io.Copy(f, io.LimitReader(r.Body, u.Length-u.Offset))
+	err = f.Close()
+	if err != nil {
+		rt.baseLogger.WithError(err).Error("error writing upload file")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	u.Offset += n
+	u.ExpiresAt = time.Now().Add(uploadLifetime)
+	err = rt.db.SetUploadOffset(u.ID, u.Offset, u.ExpiresAt)
+	if err != nil {
+		rt.baseLogger.WithError(err).Error("error saving upload offset")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if copyErr != nil {
+		rt.baseLogger.WithError(copyErr).Debug("upload chunk interrupted")
+	}
+
+	if u.Offset == u.Length {
+		err = rt.completeUpload(u)
+		if errors.Is(err, errNotImage) {
+			err = rt.releaseUpload(u.ID)
+			if err != nil {
+				rt.baseLogger.WithError(err).Error("error deleting upload")
+			}
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			return
+		} else if err != nil {
+			rt.baseLogger.WithError(err).Error("error completing upload")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		uploadLocks.Delete(u.ID)
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(u.Offset, 10))
+	w.Header().Set("Upload-Expires", u.ExpiresAt.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// completeUpload moves the content of a fully received upload to the media store, or returns errNotImage.
+func (rt *_router) completeUpload(u database.Upload) error {
+	f, err := os.Open(uploadPath(u.ID))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(f, head)
+	mimeType := http.DetectContentType(head[:n])
+	if !isImage(mimeType) {
+		return errNotImage
+	}
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	rt.media.Lock()
+	defer rt.media.Unlock()
+
+	hash, err := rt.media.PutReader(f)
+	if err != nil {
+		return err
+	}
+	err = rt.db.CompleteUpload(u.ID, hash, mimeType)
+	if err != nil {
+		return err
+	}
+	_ = os.Remove(uploadPath(u.ID))
+	return nil
+}
+
+func (rt *_router) deleteUpload(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	tusHeaders(w)
+	userId, err := extractBearer(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if !checkTusVersion(w, r) {
+		return
+	}
+
+	u, ok := rt.getOwnUpload(ps, userId)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	err = rt.releaseUpload(u.ID)
+	if err != nil {
+		rt.baseLogger.WithError(err).Error("error deleting upload")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// releaseUpload deletes the upload with its partial content, or its blob if nothing else references it.
+func (rt *_router) releaseUpload(id string) error {
+	rt.media.Lock()
+	defer rt.media.Unlock()
+
+	hash, err := rt.db.DeleteUpload(id)
+	if err != nil {
+		return err
+	}
+	uploadLocks.Delete(id)
+	_ = os.Remove(uploadPath(id))
+	if hash != "" {
+		return rt.media.Remove(hash)
+	}
+	return nil
+}
+
+// ForgetUpload drops the lock of an upload removed by the media garbage collector.
+func (rt *_router) ForgetUpload(id string) {
+	uploadLocks.Delete(id)
+}
+
+// mediaFromUpload creates a new media object with the content of a completed upload of userId. If conversationId is
+// not nil, only the participants of that conversation will be able to read it. refCount is as in saveMedia.
+func (rt *_router) mediaFromUpload(uploadId string, userId int64, conversationId *int64, refCount int64) (database.Media, error) {
+	id, err := uuid.NewV4()
+	if err != nil {
+		return database.Media{}, err
+	}
+
+	// Hold the lock before reading the upload, so that it's not released while the new reference is added
+	rt.media.Lock()
+	defer rt.media.Unlock()
+
+	u, err := rt.db.GetUpload(uploadId)
+	if err != nil || u.UserId != userId || !u.Completed() || u.ExpiresAt.Before(time.Now()) || !isImage(u.MimeType) {
+		return database.Media{}, errUploadNotReady
+	}
+
+	m := database.Media{
+		ID:             strings.ReplaceAll(id.String(), "-", ""),
+		ConversationId: conversationId,
+		UploaderId:     userId,
+		BlobHash:       u.BlobHash,
+		Size:           u.Length,
+		MimeType:       u.MimeType,
+		RefCount:       refCount,
+	}
+	return m, rt.db.CreateMedia(m)
+}
@@ -2,15 +2,13 @@ package api
 
 import (
 	"encoding/json"
-	"fmt"
+	"errors"
 	"io"
 	"net/http"
-	"os"
-	"path/filepath"
 	"strconv"
 	"strings"
-	"time"
 
+	"git.phoebe2z/WASAText/service/database"
 	"github.com/julienschmidt/httprouter"
 )
 
@@ -42,7 +40,7 @@ func (rt *_router) setMyUserName(w http.ResponseWriter, r *http.Request, ps http
 		return
 	}
 
-	if len(req.NewName) < 3 || len(req.NewName) > 16 {
+	if len(req.NewName) < 3 || len(req.NewName) > 16 || req.NewName == database.DeletedAccountName {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
@@ -71,20 +69,38 @@ func (rt *_router) setMyPhoto(w http.ResponseWriter, r *http.Request, ps httprou
 		return
 	}
 
+	user, err := rt.db.GetUser(userId)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
 	// Check if JSON
 	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
 		var req struct {
 			PhotoURL string `json:"photoUrl"`
+			UploadId string `json:"uploadId"`
 		}
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
+		// A completed resumable upload can be used in place of the photo URL
+		if req.UploadId != "" {
+			rt.setMyPhotoFromUpload(w, userId, req.UploadId, user.PhotoURL)
+			return
+		}
+		// Media references are owned by the avatar, so they can only be created by uploading
+		if _, ok := mediaIdFromURL(req.PhotoURL); ok {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
 		err = rt.db.SetUserPhoto(userId, req.PhotoURL)
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
+		rt.releaseMediaURL(user.PhotoURL)
 		w.WriteHeader(http.StatusOK)
 		return
 	}
@@ -96,7 +112,7 @@ func (rt *_router) setMyPhoto(w http.ResponseWriter, r *http.Request, ps httprou
 		return
 	}
 
-	file, handler, err := r.FormFile("newPhoto")
+	file, _, err := r.FormFile("newPhoto")
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		return
@@ -110,21 +126,26 @@ func (rt *_router) setMyPhoto(w http.ResponseWriter, r *http.Request, ps httprou
 		return
 	}
 
-	filename := fmt.Sprintf("user-%d-%d%s", userId, time.Now().Unix(), filepath.Ext(handler.Filename))
-	err = os.WriteFile(filepath.Join("static", filename), data, 0644)
-	if err != nil {
+	// Avatars are public media
+	m, err := rt.saveMedia(data, userId, nil, 1)
+	if errors.Is(err, errNotImage) {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		return
+	} else if err != nil {
 		rt.baseLogger.WithError(err).Error("error saving file")
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	photoURL := "/static/" + filename
+	photoURL := mediaURLPrefix + m.ID
 
 	err = rt.db.SetUserPhoto(userId, photoURL)
 	if err != nil {
+		rt.releaseMediaURL(photoURL)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	rt.releaseMediaURL(user.PhotoURL)
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
@@ -143,12 +164,13 @@ func (rt *_router) getMyProfile(w http.ResponseWriter, r *http.Request, ps httpr
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
+	user.PhotoURL = userPhotoURL(user)
 
 	w.Header().Set("Content-Type", "application/json")
 	_ = json.NewEncoder(w).Encode(user)
 }
 func (rt *_router) listUsers(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	_, err := extractBearer(r)
+	userId, err := extractBearer(r)
 	if err != nil {
 		w.WriteHeader(http.StatusUnauthorized)
 		return
@@ -161,7 +183,44 @@ func (rt *_router) listUsers(w http.ResponseWriter, r *http.Request, ps httprout
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	blockers, err := rt.blockers(userId)
+	if err != nil {
+		rt.baseLogger.WithError(err).Error("error getting blockers")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	for i := range users {
+		users[i].PhotoURL = userPhotoURLFor(users[i], blockers)
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	_ = json.NewEncoder(w).Encode(users)
 }
+
+// setMyPhotoFromUpload sets a completed resumable upload as the photo of the user, replacing oldPhotoURL.
+func (rt *_router) setMyPhotoFromUpload(w http.ResponseWriter, userId int64, uploadId string, oldPhotoURL string) {
+	// Avatars are public media
+	m, err := rt.mediaFromUpload(uploadId, userId, nil, 1)
+	if errors.Is(err, errUploadNotReady) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	} else if err != nil {
+		rt.baseLogger.WithError(err).Error("error attaching upload")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	photoURL := mediaURLPrefix + m.ID
+
+	err = rt.db.SetUserPhoto(userId, photoURL)
+	if err != nil {
+		rt.releaseMediaURL(photoURL)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	rt.releaseMediaURL(oldPhotoURL)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(map[string]string{"photoUrl": photoURL})
+}
@@ -0,0 +1,375 @@
+/*
+Package chatimport imports the chats exported by WhatsApp ("Export chat" on the phone) into conversations.
+
+An export is a zip with the chat as text and, unless the media were left out, the files attached to the messages.
+Chats are imported by one of their participants, the owner of the import. An export doesn't prove who wrote the
+messages, so only the messages of the owner are attributed to an account: the other senders become placeholder users,
+which are not accounts and are shown with the name found in the export. As the owner is the only account in the
+conversation, blocks, message requests and group bans don't apply to imports.
+
+Chats with two participants are imported into the 1-on-1 conversation of the owner with the placeholder of the other
+sender, the others into an existing group where the owner is an admin or into a group owned by the owner. The group
+is created by the first import of the chat, and found again by the following ones as long as the owner is in it: it's
+identified by the owner and the first message of the chat, which later exports of the chat also start with.
+
+Imports are idempotent: each message is identified by a key derived from the conversation and from the sender, the
+time as written in the export and the text of the message, so importing the same chat again, or a later export of it,
+into the same conversation only adds the messages that are new.
+*/
+package chatimport
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"git.phoebe2z/WASAText/service/database"
+	"git.phoebe2z/WASAText/service/mediastore"
+	"github.com/gofrs/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// defaultGroupName is the name of the groups imported without a name
+	defaultGroupName = "WhatsApp chat"
+
+	// maxSenders is the maximum number of senders besides the owner, like the initial members of the groups created
+	// by users
+	maxSenders = 100
+)
+
+// ErrInvalidNames is returned when senders can't become placeholder users because their name is too short or too
+// long: they must be mapped to other names with Options.Names.
+var ErrInvalidNames = errors.New("invalid user names")
+
+// ErrTooManySenders is returned when the chat has more than maxSenders senders besides the owner.
+var ErrTooManySenders = errors.New("too many participants in the chat")
+
+// ErrNoConversation is returned when Options.ConversationId is not a group of the owner.
+var ErrNoConversation = errors.New("conversation not found")
+
+// ErrNotAdmin is returned when the owner is not an admin of the group in Options.ConversationId.
+var ErrNotAdmin = errors.New("only admins can import chats into the group")
+
+// ErrInvalidGroupName is returned when the chat is imported into a new group with a name that is too short or too long.
+var ErrInvalidGroupName = errors.New("invalid group name")
+
+// ErrSingleParticipant is returned when the chat has no one to talk to, e.g. because only the owner wrote in it.
+var ErrSingleParticipant = errors.New("the chat has a single participant")
+
+// ErrNoChat is returned when the export has no chat file.
+var ErrNoChat = errors.New("no chat in the export")
+
+// Config is used to provide dependencies to the Import function.
+type Config struct {
+	// Database is where the conversation is imported
+	Database database.AppDatabase
+
+	// Store is where the attached photos are saved
+	Store *mediastore.Store
+
+	// Logger where log entries are sent
+	Logger logrus.FieldLogger
+}
+
+// Options describe how a chat is imported.
+type Options struct {
+	// Name is the name of the group, if the chat is imported into a new group. If empty, defaultGroupName is used.
+	Name string
+
+	// OwnerId is the user importing the chat, who becomes a member of the conversation and the owner of new groups.
+	// The messages of the sender with the name of the owner (after Names) are attributed to the owner.
+	OwnerId int64
+
+	// ConversationId is the group the chat is imported into. If 0, the chat is imported into the 1-on-1 conversation
+	// with the other sender, or into the group created by a previous import of the chat or a new one.
+	ConversationId int64
+
+	// Names maps the names of the senders to the names they are imported with
+	Names map[string]string
+
+	// Location is the time zone of the phone that exported the chat. If nil, UTC is used.
+	Location *time.Location
+
+	// Files holds the attachments of the chat. If nil, attachments are imported as text.
+	Files fs.FS
+}
+
+// Result reports what an import did.
+type Result struct {
+	ConversationId int64 `json:"conversationId"`
+
+	// Created is true when the conversation was created by the import
+	Created bool `json:"created"`
+
+	// Messages is the number of messages in the chat, and Imported the number of the ones added by the import
+	Messages int `json:"messages"`
+	Imported int `json:"imported"`
+
+	// Photos is the number of attached photos saved
+	Photos int `json:"photos"`
+
+	// Placeholders are the names of the placeholder users created for the senders
+	Placeholders []string `json:"placeholders"`
+}
+
+// Import imports the chat read from r.
+func Import(cfg Config, r io.Reader, opts Options) (Result, error) {
+	result := Result{Placeholders: []string{}}
+	if cfg.Database == nil || cfg.Store == nil || cfg.Logger == nil {
+		return result, errors.New("database, store and logger are required")
+	}
+	if opts.OwnerId == 0 {
+		return result, errors.New("the owner is required")
+	}
+	if opts.Location == nil {
+		opts.Location = time.UTC
+	}
+
+	messages, err := Parse(r, opts.Location)
+	if err != nil {
+		return result, err
+	}
+	result.Messages = len(messages)
+
+	// The group is checked before any placeholder is created
+	if opts.ConversationId != 0 {
+		role, err := cfg.Database.GetMemberRole(opts.ConversationId, opts.OwnerId)
+		if errors.Is(err, sql.ErrNoRows) {
+			return result, ErrNoConversation
+		} else if err != nil {
+			return result, fmt.Errorf("getting the role of the owner: %w", err)
+		}
+		if role != database.RoleOwner && role != database.RoleAdmin {
+			return result, ErrNotAdmin
+		}
+	}
+
+	senders, err := resolveSenders(cfg.Database, messages, opts.OwnerId, opts.Names, &result)
+	if err != nil {
+		return result, err
+	}
+
+	members := []int64{opts.OwnerId}
+	seen := map[int64]bool{opts.OwnerId: true}
+	for _, m := range messages {
+		if id := senders[m.Sender]; !seen[id] {
+			seen[id] = true
+			members = append(members, id)
+		}
+	}
+	if len(members) < 2 {
+		return result, ErrSingleParticipant
+	}
+	if len(members)-1 > maxSenders {
+		return result, ErrTooManySenders
+	}
+
+	c := database.ChatImport{
+		ConversationId: opts.ConversationId,
+		IsGroup:        opts.ConversationId != 0 || len(members) > 2,
+		OwnerId:        opts.OwnerId,
+		Members:        members,
+	}
+	if c.IsGroup && c.ConversationId == 0 {
+		// Importing the chat again finds the group created the first time, by its owner and its first message
+		first := messages[0]
+		c.Key = importKey(opts.OwnerId, first.Sender, first.Time.Format(time.DateTime), first.Text)
+		c.Name = opts.Name
+		if c.Name == "" {
+			c.Name = defaultGroupName
+		} else if !validGroupName(c.Name) {
+			return result, ErrInvalidGroupName
+		}
+	}
+	result.ConversationId, result.Created, err = cfg.Database.PrepareImport(c)
+	if errors.Is(err, sql.ErrNoRows) {
+		return result, ErrNoConversation
+	} else if err != nil {
+		return result, fmt.Errorf("preparing the conversation: %w", err)
+	}
+
+	// Identical messages sent in the same minute are told apart by their order. Times are taken as written, so that
+	// importing again with another time zone doesn't add the messages twice.
+	occurrences := make(map[string]int)
+	imported := make([]database.ImportedMessage, 0, len(messages))
+	for _, m := range messages {
+		key := importKey(result.ConversationId, m.Sender, m.Time.Format(time.DateTime), m.Text)
+		occurrences[key]++
+		im := database.ImportedMessage{
+			Key:         importKey(key, occurrences[key]),
+			SenderId:    senders[m.Sender],
+			Content:     m.Text,
+			ContentType: "text",
+			CreatedAt:   m.Time,
+		}
+		if m.Attachment != "" && opts.Files != nil {
+			saved, err := savePhoto(cfg, opts.Files, m.Attachment, &im, result.ConversationId)
+			if err != nil {
+				return result, err
+			}
+			if saved {
+				result.Photos++
+			}
+		}
+		imported = append(imported, im)
+	}
+
+	result.Imported, err = cfg.Database.ImportMessages(result.ConversationId, imported)
+	if err != nil {
+		return result, fmt.Errorf("importing messages: %w", err)
+	}
+	return result, nil
+}
+
+// resolveSenders returns the users of the senders of the messages: the owner for the sender with its name, and
+// placeholder users for the others, created if they don't exist. No placeholder is created if some of the names are
+// not valid.
+func resolveSenders(db database.AppDatabase, messages []Message, ownerId int64, names map[string]string, result *Result) (map[string]int64, error) {
+	owner, err := db.GetUser(ownerId)
+	if err != nil {
+		return nil, fmt.Errorf("getting the owner: %w", err)
+	}
+
+	senders := make(map[string]int64)
+	var others, invalid []string
+	for _, m := range messages {
+		if _, ok := senders[m.Sender]; ok {
+			continue
+		}
+		senders[m.Sender] = 0
+
+		name := userName(m.Sender, names)
+		if name == owner.Name {
+			senders[m.Sender] = ownerId
+			continue
+		}
+		others = append(others, m.Sender)
+		// Same rules as the users logging in
+		if len(name) < 3 || len(name) > 16 || name == database.DeletedAccountName {
+			invalid = append(invalid, m.Sender)
+		}
+	}
+	if len(invalid) > 0 {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidNames, strings.Join(invalid, ", "))
+	}
+
+	// Two senders may be mapped to the same placeholder
+	for _, sender := range others {
+		name := userName(sender, names)
+		u, created, err := db.GetPlaceholderUser(ownerId, name)
+		if err != nil {
+			return nil, fmt.Errorf("getting placeholder %q: %w", name, err)
+		}
+		if created {
+			result.Placeholders = append(result.Placeholders, name)
+		}
+		senders[sender] = u.ID
+	}
+	return senders, nil
+}
+
+// userName returns the name the sender is imported with.
+func userName(sender string, names map[string]string) string {
+	if name, ok := names[sender]; ok {
+		return name
+	}
+	return sender
+}
+
+// savePhoto makes im a photo message if the attachment is a photo found in files. Photos of messages imported before
+// are not saved again.
+func savePhoto(cfg Config, files fs.FS, attachment string, im *database.ImportedMessage, conversationId int64) (bool, error) {
+	imported, err := cfg.Database.IsMessageImported(im.Key)
+	if err != nil || imported {
+		return false, err
+	}
+
+	data, err := fs.ReadFile(files, attachment)
+	if err != nil {
+		cfg.Logger.WithError(err).WithField("attachment", attachment).Warn("attachment not found, imported as text")
+		return false, nil
+	}
+	mimeType := http.DetectContentType(data)
+	if !strings.HasPrefix(mimeType, "image/") {
+		return false, nil
+	}
+
+	id, err := uuid.NewV4()
+	if err != nil {
+		return false, err
+	}
+	m := database.Media{
+		ID:             strings.ReplaceAll(id.String(), "-", ""),
+		ConversationId: &conversationId,
+		UploaderId:     im.SenderId,
+		Size:           int64(len(data)),
+		MimeType:       mimeType,
+	}
+
+	cfg.Store.Lock()
+	defer cfg.Store.Unlock()
+
+	m.BlobHash, err = cfg.Store.Put(data)
+	if err != nil {
+		return false, fmt.Errorf("saving attachment %q: %w", attachment, err)
+	}
+	err = cfg.Database.CreateMedia(m)
+	if err != nil {
+		return false, fmt.Errorf("saving attachment %q: %w", attachment, err)
+	}
+
+	im.Content = "/media/" + m.ID
+	im.ContentType = "photo"
+	return true, nil
+}
+
+// importKey hashes the parts into a key.
+func importKey(parts ...interface{}) string {
+	h := sha256.New()
+	for _, p := range parts {
+		_, _ = fmt.Fprintf(h, "%v\x00", p)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// FindChat returns the name of the chat file of an export: `_chat.txt` on iOS, the only text file on Android.
+func FindChat(files fs.FS) (string, error) {
+	if _, err := fs.Stat(files, "_chat.txt"); err == nil {
+		return "_chat.txt", nil
+	}
+	matches, err := fs.Glob(files, "*.txt")
+	if err != nil {
+		return "", err
+	}
+	if len(matches) != 1 {
+		return "", ErrNoChat
+	}
+	return matches[0], nil
+}
+
+// ChatName returns the name of the chat from the name of the export (e.g., `WhatsApp Chat - Team.zip` or
+// `WhatsApp Chat with Team.txt`), or an empty string if it's not known or not valid for a group.
+func ChatName(filename string) string {
+	name := strings.TrimSuffix(path.Base(filename), path.Ext(filename))
+	for _, prefix := range []string{"WhatsApp Chat - ", "WhatsApp Chat with "} {
+		name = strings.TrimPrefix(name, prefix)
+	}
+	if name == "_chat" || !validGroupName(name) {
+		return ""
+	}
+	return name
+}
+
+// validGroupName follows the rules of the groups created by users.
+func validGroupName(name string) bool {
+	return len(name) >= 3 && len(name) <= 20
+}
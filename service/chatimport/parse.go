@@ -0,0 +1,165 @@
+package chatimport
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Message is a message of a WhatsApp chat export.
+type Message struct {
+	Time   time.Time
+	Sender string
+
+	// Text is the message as written in the export. For attachments, it's the attachment marker.
+	Text string
+
+	// Attachment is the name of the file attached to the message, if it was exported
+	Attachment string
+
+	// MediaOmitted is true when the message had an attachment that was left out of the export
+	MediaOmitted bool
+}
+
+// ErrNoMessages is returned when the chat has no messages, e.g. because it's not a WhatsApp export.
+var ErrNoMessages = errors.New("no messages in the chat")
+
+// header matches the first line of a message, in both the Android and the iOS formats:
+//
+//	31/12/2020, 21:41 - Alice: Hello
+//	[12/31/20, 9:41:05 PM] Alice: Hello
+//
+// The date format depends on the locale of the phone: the order of day and month is decided by Parse.
+var header = regexp.MustCompile(`^\[?(\d{1,4})[./-](\d{1,2})[./-](\d{1,4}),? (\d{1,2})[:.](\d{2})(?:[:.](\d{2}))?(?: ?([AaPp])\.? ?[Mm]\.?)?(?:\] | [-–] )(.*)$`)
+
+var (
+	// iosAttachment is an exported attachment on iOS
+	iosAttachment = regexp.MustCompile(`^<attached: (.+)>$`)
+	// androidAttachment is an exported attachment on Android
+	androidAttachment = regexp.MustCompile(`^(.+\.\w+) \(file attached\)$`)
+	// omitted is an attachment left out of the export
+	omitted = regexp.MustCompile(`^(<Media omitted>|(image|video|audio|sticker|GIF|document) omitted)$`)
+)
+
+// marks are the left-to-right and right-to-left marks that exports put around names, attachments and system messages
+const marks = "\u200e\u200f"
+
+// line is a message as found in the export, before its date is parsed.
+type line struct {
+	date      [3]int
+	yearFirst bool
+	shortYear bool
+	clock     [3]int
+	pm, am    bool
+	rest      string
+}
+
+// Parse reads a WhatsApp chat export (`_chat.txt` on iOS, `WhatsApp Chat with <name>.txt` on Android). Times are in
+// the time zone of the phone that exported the chat, which is not part of the export: loc gives it. Lines that are not
+// messages (like "Alice added Bob" or the end-to-end encryption notice) are skipped.
+func Parse(r io.Reader, loc *time.Location) ([]Message, error) {
+	var lines []line
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		// Times use non-breaking spaces before AM/PM, and the file may start with a byte order mark
+		text := strings.NewReplacer("\u202f", " ", "\u00a0", " ").Replace(scanner.Text())
+		if len(lines) == 0 {
+			text = strings.TrimPrefix(text, "\ufeff")
+		}
+		m := header.FindStringSubmatch(strings.TrimLeft(text, marks))
+		if m == nil {
+			// Continuation of a multi-line message
+			if len(lines) > 0 {
+				lines[len(lines)-1].rest += "\n" + text
+			}
+			continue
+		}
+
+		var l line
+		for i := 0; i < 3; i++ {
+			l.date[i], _ = strconv.Atoi(m[1+i])
+			l.clock[i], _ = strconv.Atoi(m[4+i])
+		}
+		l.yearFirst = len(m[1]) == 4
+		// With the year first, the last field is the day
+		l.shortYear = !l.yearFirst && len(m[3]) == 2
+		l.pm = m[7] == "P" || m[7] == "p"
+		l.am = m[7] == "A" || m[7] == "a"
+		l.rest = m[8]
+		lines = append(lines, l)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	dayFirst := dayFirst(lines)
+	var messages []Message
+	for _, l := range lines {
+		sender, text, ok := strings.Cut(l.rest, ": ")
+		// System messages have no sender, but may contain a colon in a quoted group name
+		if !ok || strings.ContainsAny(sender, "\"“”") {
+			continue
+		}
+
+		msg := Message{Time: l.time(dayFirst, loc), Sender: strings.Trim(sender, marks+" ")}
+		marker := strings.Trim(text, marks)
+		if m := iosAttachment.FindStringSubmatch(marker); m != nil {
+			msg.Attachment = m[1]
+		} else if m := androidAttachment.FindStringSubmatch(marker); m != nil {
+			msg.Attachment = m[1]
+		} else if omitted.MatchString(marker) {
+			msg.MediaOmitted = true
+		} else if strings.HasPrefix(text, "\u200e") {
+			// On iOS, system messages are sent by the chat itself and start with a left-to-right mark
+			continue
+		}
+		msg.Text = marker
+		messages = append(messages, msg)
+	}
+	if len(messages) == 0 {
+		return nil, ErrNoMessages
+	}
+	return messages, nil
+}
+
+// dayFirst reports whether the dates of the export have the day before the month. Dates can't tell when both are up
+// to 12: the day is assumed to come first, as in most locales.
+func dayFirst(lines []line) bool {
+	for _, l := range lines {
+		if l.yearFirst {
+			continue
+		}
+		if l.date[0] > 12 {
+			return true
+		}
+		if l.date[1] > 12 {
+			return false
+		}
+	}
+	return true
+}
+
+func (l line) time(dayFirst bool, loc *time.Location) time.Time {
+	year, month, day := l.date[2], l.date[1], l.date[0]
+	if l.yearFirst {
+		year, day = l.date[0], l.date[2]
+	} else if !dayFirst {
+		month, day = l.date[0], l.date[1]
+	}
+	if l.shortYear {
+		year += 2000
+	}
+
+	hour := l.clock[0]
+	if l.pm && hour < 12 {
+		hour += 12
+	} else if l.am && hour == 12 {
+		hour = 0
+	}
+	return time.Date(year, time.Month(month), day, hour, l.clock[1], l.clock[2], 0, loc)
+}
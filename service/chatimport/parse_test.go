@@ -0,0 +1,156 @@
+package chatimport
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	at := func(year int, month time.Month, day, hour, min, sec int) time.Time {
+		return time.Date(year, month, day, hour, min, sec, 0, time.UTC)
+	}
+
+	tests := []struct {
+		name   string
+		export string
+		want   []Message
+	}{
+		{
+			name: "android, day first, 24h",
+			export: "31/12/2020, 21:41 - Alice: Hello\n" +
+				"01/01/2021, 09:05 - Bob: Happy new year\n",
+			want: []Message{
+				{Time: at(2020, 12, 31, 21, 41, 0), Sender: "Alice", Text: "Hello"},
+				{Time: at(2021, 1, 1, 9, 5, 0), Sender: "Bob", Text: "Happy new year"},
+			},
+		},
+		{
+			name: "ios, month first, 12h",
+			export: "[12/31/20, 9:41:05 PM] Alice: Hello\n" +
+				"[1/1/21, 12:05:00 AM] Bob: Happy new year\n" +
+				"[1/1/21, 12:30:00 PM] Alice: Lunch?\n",
+			want: []Message{
+				{Time: at(2020, 12, 31, 21, 41, 5), Sender: "Alice", Text: "Hello"},
+				{Time: at(2021, 1, 1, 0, 5, 0), Sender: "Bob", Text: "Happy new year"},
+				{Time: at(2021, 1, 1, 12, 30, 0), Sender: "Alice", Text: "Lunch?"},
+			},
+		},
+		{
+			name: "android, month first, 12h with narrow spaces",
+			export: "1/13/21, 9:41\u202fp.\u00a0m. - Alice: Hello\n" +
+				"1/14/21, 7:02\u202fa.\u00a0m. - Bob: Morning\n",
+			want: []Message{
+				{Time: at(2021, 1, 13, 21, 41, 0), Sender: "Alice", Text: "Hello"},
+				{Time: at(2021, 1, 14, 7, 2, 0), Sender: "Bob", Text: "Morning"},
+			},
+		},
+		{
+			name:   "year first",
+			export: "2021-03-04, 18:00 - Alice: Hello\n",
+			want: []Message{
+				{Time: at(2021, 3, 4, 18, 0, 0), Sender: "Alice", Text: "Hello"},
+			},
+		},
+		{
+			name: "multi-line messages",
+			export: "\ufeff04/03/2021, 18:00 - Alice: First line\n" +
+				"second line\n" +
+				"\n" +
+				"fourth line\n" +
+				"04/03/2021, 18:01 - Bob: Ok\n",
+			want: []Message{
+				{Time: at(2021, 3, 4, 18, 0, 0), Sender: "Alice", Text: "First line\nsecond line\n\nfourth line"},
+				{Time: at(2021, 3, 4, 18, 1, 0), Sender: "Bob", Text: "Ok"},
+			},
+		},
+		{
+			name: "system lines",
+			export: "04/03/2021, 17:58 - Messages and calls are end-to-end encrypted.\n" +
+				"04/03/2021, 17:59 - Alice created group \"Team: 2021\"\n" +
+				"04/03/2021, 18:00 - Alice: Hello\n" +
+				"[04/03/2021, 18:01:00] Team: \u200eBob joined using this group's invite link\n" +
+				"04/03/2021, 18:02 - Bob: Hi\n",
+			want: []Message{
+				{Time: at(2021, 3, 4, 18, 0, 0), Sender: "Alice", Text: "Hello"},
+				{Time: at(2021, 3, 4, 18, 2, 0), Sender: "Bob", Text: "Hi"},
+			},
+		},
+		{
+			name: "attachments",
+			export: "[04/03/2021, 18:00:00] Alice: \u200e<attached: 00000012-PHOTO-2021-03-04-18-00-00.jpg>\n" +
+				"04/03/2021, 18:01 - Bob: IMG-20210304-WA0001.jpg (file attached)\n" +
+				"04/03/2021, 18:02 - Bob: <Media omitted>\n",
+			want: []Message{
+				{Time: at(2021, 3, 4, 18, 0, 0), Sender: "Alice", Text: "<attached: 00000012-PHOTO-2021-03-04-18-00-00.jpg>", Attachment: "00000012-PHOTO-2021-03-04-18-00-00.jpg"},
+				{Time: at(2021, 3, 4, 18, 1, 0), Sender: "Bob", Text: "IMG-20210304-WA0001.jpg (file attached)", Attachment: "IMG-20210304-WA0001.jpg"},
+				{Time: at(2021, 3, 4, 18, 2, 0), Sender: "Bob", Text: "<Media omitted>", MediaOmitted: true},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Parse(strings.NewReader(tt.export), time.UTC)
+			if err != nil {
+				t.Fatalf("Parse() error = %v", err)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("Parse() returned %d messages, want %d: %+v", len(got), len(tt.want), got)
+			}
+			for i := range got {
+				if !got[i].Time.Equal(tt.want[i].Time) || got[i].Sender != tt.want[i].Sender || got[i].Text != tt.want[i].Text ||
+					got[i].Attachment != tt.want[i].Attachment || got[i].MediaOmitted != tt.want[i].MediaOmitted {
+					t.Errorf("message %d = %+v, want %+v", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestParseLocation(t *testing.T) {
+	loc, err := time.LoadLocation("Europe/Rome")
+	if err != nil {
+		t.Skip("time zone database not available")
+	}
+	got, err := Parse(strings.NewReader("31/12/2020, 21:41 - Alice: Hello\n"), loc)
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	if want := time.Date(2020, 12, 31, 20, 41, 0, 0, time.UTC); !got[0].Time.Equal(want) {
+		t.Errorf("time = %v, want %v", got[0].Time, want)
+	}
+}
+
+func TestParseNoMessages(t *testing.T) {
+	_, err := Parse(strings.NewReader("not a chat\n04/03/2021, 17:58 - Messages are end-to-end encrypted.\n"), time.UTC)
+	if !errors.Is(err, ErrNoMessages) {
+		t.Errorf("Parse() error = %v, want %v", err, ErrNoMessages)
+	}
+}
+
+func TestDayFirst(t *testing.T) {
+	tests := []struct {
+		name  string
+		dates [][3]int
+		want  bool
+	}{
+		{name: "day over 12", dates: [][3]int{{1, 2, 2021}, {13, 2, 2021}}, want: true},
+		{name: "month over 12", dates: [][3]int{{1, 2, 2021}, {2, 13, 2021}}, want: false},
+		{name: "first telling date decides", dates: [][3]int{{3, 14, 2021}, {15, 3, 2021}}, want: false},
+		{name: "ambiguous", dates: [][3]int{{1, 2, 2021}, {12, 11, 2021}}, want: true},
+		{name: "year first is skipped", dates: [][3]int{{2021, 13, 1}, {1, 14, 2021}}, want: false},
+		{name: "no lines", want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var lines []line
+			for _, d := range tt.dates {
+				lines = append(lines, line{date: d, yearFirst: d[0] > 31})
+			}
+			if got := dayFirst(lines); got != tt.want {
+				t.Errorf("dayFirst() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
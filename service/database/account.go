@@ -0,0 +1,149 @@
+package database
+
+import (
+	"database/sql"
+	"time"
+)
+
+// SetUserDeactivated deactivates or reactivates the user. Deactivated users are not listed and cannot log in, but keep
+// their data.
+func (db *appdbimpl) SetUserDeactivated(id int64, deactivated bool) error {
+	var deactivatedAt sql.NullTime
+	if deactivated {
+		deactivatedAt = sql.NullTime{Time: time.Now(), Valid: true}
+	}
+	res, err := db.c.Exec("UPDATE users SET deactivated_at = ? WHERE id = ? AND deleted_at IS NULL", deactivatedAt, id)
+	if err != nil {
+		return err
+	}
+	affected, err := res.RowsAffected()
+	if err == nil && affected == 0 {
+		return sql.ErrNoRows
+	}
+	return err
+}
+
+// IsUserDisabled reports whether the user is deactivated, deleted or a placeholder. Unknown users are not disabled.
+func (db *appdbimpl) IsUserDisabled(id int64) (bool, error) {
+	var disabled bool
+	err := db.c.QueryRow("SELECT deactivated_at IS NOT NULL OR deleted_at IS NOT NULL OR placeholder_of IS NOT NULL FROM users WHERE id = ?", id).Scan(&disabled)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return disabled, err
+}
+
+// DeleteUser deletes the account of the user, and returns the groups the user left. The user row is kept, so that
+// messages, audit logs and 1-on-1 conversations still refer to it, but it's renamed DeletedAccountName and loses its
+// photo. The user leaves all groups, channels and communities, passing on their ownership, and everything else about
+// the user is removed: the message requests sent by the user become regular conversations, and the invites created by
+// the user are revoked. With redactMessages, the messages of the user are deleted and their reactions removed;
+// otherwise they are kept, attributed to the deleted account.
+//
+// Foreign keys are not enforced, so everything referring to the user is removed explicitly. Media, resumable uploads
+// and takeouts are left to the media garbage collector, which removes them once they are not referenced or expired.
+func (db *appdbimpl) DeleteUser(id int64, redactMessages bool) ([]int64, error) {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	var deleted bool
+	err = tx.QueryRow("SELECT deleted_at IS NOT NULL FROM users WHERE id = ?", id).Scan(&deleted)
+	if err == nil && deleted {
+		err = sql.ErrNoRows
+	}
+	if err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+
+	// Communities first, since leaving them also leaves their announcement channels
+	communityIds, err := queryIds(tx, "SELECT community_id FROM community_members WHERE user_id = ?", id)
+	if err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+	for _, communityId := range communityIds {
+		err = removeCommunityMember(tx, communityId, id, id)
+		if err != nil {
+			_ = tx.Rollback()
+			return nil, err
+		}
+	}
+
+	groupIds, err := queryIds(tx, `
+		SELECT p.conversation_id FROM participants p
+		JOIN conversations c ON c.id = p.conversation_id
+		WHERE p.user_id = ? AND c.is_group = 1
+	`, id)
+	if err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+	for _, groupId := range groupIds {
+		err = removeParticipant(tx, groupId, id, id)
+		if err != nil {
+			_ = tx.Rollback()
+			return nil, err
+		}
+	}
+
+	stmts := []string{
+		// Saved Messages
+		"DELETE FROM reactions WHERE message_id IN (SELECT m.id FROM messages m JOIN conversations c ON c.id = m.conversation_id WHERE c.saved_by = ?1)",
+		"DELETE FROM messages WHERE conversation_id IN (SELECT id FROM conversations WHERE saved_by = ?1)",
+		"DELETE FROM participants WHERE conversation_id IN (SELECT id FROM conversations WHERE saved_by = ?1)",
+		"DELETE FROM folder_conversations WHERE conversation_id IN (SELECT id FROM conversations WHERE saved_by = ?1)",
+		"DELETE FROM conversations WHERE saved_by = ?1",
+
+		"DELETE FROM blocks WHERE blocker_id = ?1 OR blocked_id = ?1",
+		"DELETE FROM folder_conversations WHERE folder_id IN (SELECT id FROM folders WHERE user_id = ?1)",
+		"DELETE FROM folders WHERE user_id = ?1",
+		"DELETE FROM notifications WHERE user_id = ?1",
+		"DELETE FROM join_requests WHERE user_id = ?1",
+		"DELETE FROM group_bans WHERE user_id = ?1",
+		"DELETE FROM sessions WHERE user_id = ?1",
+		"UPDATE participants SET request_from = NULL WHERE request_from = ?1",
+		"UPDATE group_invites SET revoked = 1 WHERE created_by = ?1",
+		"UPDATE uploads SET expires_at = ?2 WHERE user_id = ?1",
+		"UPDATE takeouts SET status = ?4, completed_at = ?2 WHERE user_id = ?1",
+		"UPDATE users SET name = ?3, photo_url = NULL, deactivated_at = NULL, deleted_at = ?2 WHERE id = ?1",
+	}
+	if redactMessages {
+		// System messages describe events of the conversations, which stay readable
+		stmts = append(stmts,
+			"UPDATE messages SET content = '', is_deleted = 1 WHERE sender_id = ?1 AND content_type != 'system'",
+			"DELETE FROM reactions WHERE user_id = ?1",
+		)
+	}
+	now := time.Now()
+	for _, stmt := range stmts {
+		_, err = tx.Exec(stmt, id, now, DeletedAccountName, TakeoutFailed)
+		if err != nil {
+			_ = tx.Rollback()
+			return nil, err
+		}
+	}
+
+	return groupIds, tx.Commit()
+}
+
+// queryIds returns the IDs selected by the query. All the rows are read, so that the transaction can be used again.
+func queryIds(tx *sql.Tx, query string, args ...interface{}) ([]int64, error) {
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
@@ -0,0 +1,52 @@
+package database
+
+import (
+	"database/sql"
+	"time"
+)
+
+// recordAudit adds an entry to the audit log of the group. targetId is 0 if the change doesn't affect a member, and
+// empty values are not recorded.
+func recordAudit(tx *sql.Tx, groupId int64, actorId int64, action string, targetId int64, oldValue string, newValue string) error {
+	_, err := tx.Exec(`
+		INSERT INTO group_audit (group_id, actor_id, action, target_id, old_value, new_value, created_at)
+		VALUES (?, ?, ?, NULLIF(?, 0), NULLIF(?, ''), NULLIF(?, ''), ?)
+	`, groupId, actorId, action, targetId, oldValue, newValue, time.Now())
+	return err
+}
+
+// GetAuditLog returns a page of the audit log of the group, newest first.
+func (db *appdbimpl) GetAuditLog(groupId int64, filter AuditFilter) ([]AuditEntry, error) {
+	rows, err := db.c.Query(`
+		SELECT a.id, a.actor_id, IFNULL(actor.name, ''), a.action, a.target_id, IFNULL(target.name, ''),
+			IFNULL(a.old_value, ''), IFNULL(a.new_value, ''), a.created_at
+		FROM group_audit a
+		LEFT JOIN users actor ON actor.id = a.actor_id
+		LEFT JOIN users target ON target.id = a.target_id
+		WHERE a.group_id = ?
+		AND (? = '' OR a.action = ?)
+		AND (? = 0 OR a.actor_id = ?)
+		AND (? = 0 OR a.id < ?)
+		ORDER BY a.id DESC
+		LIMIT ?
+	`, groupId, filter.Action, filter.Action, filter.ActorId, filter.ActorId, filter.Before, filter.Before, filter.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []AuditEntry
+	for rows.Next() {
+		var e AuditEntry
+		var targetId sql.NullInt64
+		if err := rows.Scan(&e.ID, &e.ActorId, &e.ActorName, &e.Action, &targetId, &e.TargetName, &e.OldValue,
+			&e.NewValue, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		if targetId.Valid {
+			e.TargetId = &targetId.Int64
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
@@ -0,0 +1,81 @@
+package database
+
+import (
+	"database/sql"
+	"time"
+)
+
+// BlockUser blocks blockedId on behalf of blockerId. Blocking twice is not an error.
+func (db *appdbimpl) BlockUser(blockerId int64, blockedId int64) error {
+	_, err := db.c.Exec(`
+		INSERT INTO blocks (blocker_id, blocked_id, created_at) VALUES (?, ?, ?)
+		ON CONFLICT (blocker_id, blocked_id) DO NOTHING
+	`, blockerId, blockedId, time.Now())
+	return err
+}
+
+// UnblockUser lifts the block. It returns sql.ErrNoRows if blockedId is not blocked by blockerId.
+func (db *appdbimpl) UnblockUser(blockerId int64, blockedId int64) error {
+	res, err := db.c.Exec("DELETE FROM blocks WHERE blocker_id = ? AND blocked_id = ?", blockerId, blockedId)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func (db *appdbimpl) IsBlocked(blockerId int64, blockedId int64) (bool, error) {
+	var count int
+	err := db.c.QueryRow("SELECT COUNT(*) FROM blocks WHERE blocker_id = ? AND blocked_id = ?", blockerId, blockedId).Scan(&count)
+	return count > 0, err
+}
+
+// GetBlockedUsers returns the users blocked by blockerId, the most recently blocked first.
+func (db *appdbimpl) GetBlockedUsers(blockerId int64) ([]User, error) {
+	rows, err := db.c.Query(`
+		SELECT u.id, u.name, IFNULL(u.photo_url, '')
+		FROM users u
+		JOIN blocks b ON b.blocked_id = u.id
+		WHERE b.blocker_id = ?
+		ORDER BY b.created_at DESC
+	`, blockerId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []User
+	for rows.Next() {
+		var u User
+		if err := rows.Scan(&u.ID, &u.Name, &u.PhotoURL); err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+// GetBlockers returns the IDs of the users who blocked blockedId.
+func (db *appdbimpl) GetBlockers(blockedId int64) ([]int64, error) {
+	rows, err := db.c.Query("SELECT blocker_id FROM blocks WHERE blocked_id = ?", blockedId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
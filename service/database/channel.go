@@ -0,0 +1,89 @@
+package database
+
+import (
+	"database/sql"
+	"time"
+)
+
+// CreateChannel creates a broadcast channel owned by ownerId. Channels are groups where only the admins can send
+// messages, and users subscribe by themselves.
+func (db *appdbimpl) CreateChannel(name string, description string, ownerId int64) (Conversation, error) {
+	var conversation Conversation
+	tx, err := db.c.Begin()
+	if err != nil {
+		return conversation, err
+	}
+
+	id, err := insertChannel(tx, name, description, ownerId, nil)
+	if err != nil {
+		_ = tx.Rollback()
+		return conversation, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return conversation, err
+	}
+
+	conversation.ID = id
+	conversation.Name = name
+	conversation.IsGroup = true
+	conversation.IsChannel = true
+	conversation.LastMessageAt = time.Now()
+	return conversation, nil
+}
+
+// insertChannel creates a channel owned by ownerId within a transaction, and returns its ID. communityId is the
+// community the channel belongs to, if any.
+func insertChannel(tx *sql.Tx, name string, description string, ownerId int64, communityId *int64) (int64, error) {
+	now := time.Now()
+	res, err := tx.Exec(`
+		INSERT INTO conversations (name, is_group, is_channel, description, only_admins_send, community_id, last_message_at)
+		VALUES (?, 1, 1, ?, 1, ?, ?)
+	`, name, description, communityId, now)
+	if err != nil {
+		return 0, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = tx.Exec("INSERT INTO participants (conversation_id, user_id, role, joined_at) VALUES (?, ?, ?, ?)",
+		id, ownerId, RoleOwner, now)
+	if err != nil {
+		return 0, err
+	}
+
+	return id, recordMembership(tx, id, ownerId, ownerId, MembershipCreated, "")
+}
+
+// SearchChannels returns the channels whose name contains query, the most subscribed first. The announcement channels
+// of communities are not listed.
+func (db *appdbimpl) SearchChannels(query string) ([]GroupProfile, error) {
+	rows, err := db.c.Query(`
+		SELECT c.id, IFNULL(c.name, ''), c.description, IFNULL(c.photo_url, ''),
+			(SELECT COUNT(*) FROM participants WHERE conversation_id = c.id) AS subscribers,
+			c.only_admins_edit_info, c.only_admins_add_members, c.only_admins_send, c.slow_mode_seconds
+		FROM conversations c
+		WHERE c.is_channel = 1 AND c.community_id IS NULL AND c.name LIKE ?
+		ORDER BY subscribers DESC, c.id
+		LIMIT 50
+	`, "%"+query+"%")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var channels []GroupProfile
+	for rows.Next() {
+		var g GroupProfile
+		if err := rows.Scan(&g.ID, &g.Name, &g.Description, &g.PhotoURL, &g.MemberCount, &g.Settings.OnlyAdminsEditInfo,
+			&g.Settings.OnlyAdminsAddMembers, &g.Settings.OnlyAdminsSend, &g.Settings.SlowModeSeconds); err != nil {
+			return nil, err
+		}
+		g.IsChannel = true
+		channels = append(channels, g)
+	}
+	return channels, rows.Err()
+}
@@ -0,0 +1,177 @@
+package database
+
+import (
+	"database/sql"
+	"time"
+)
+
+// PrepareImport returns the conversation the chat is imported into, creating it if needed: created reports whether it
+// was created by this call. Members are only added to new conversations, so that importing a chat again doesn't bring
+// back the members who left. Groups created by a previous import are found by c.Key while the owner is in them;
+// otherwise the key moves to the new group. It returns sql.ErrNoRows if c.ConversationId is not a group the owner is a
+// member of.
+func (db *appdbimpl) PrepareImport(c ChatImport) (int64, bool, error) {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return 0, false, err
+	}
+
+	var id int64
+	switch {
+	case c.ConversationId != 0:
+		err = tx.QueryRow(`
+			SELECT c.id
+			FROM conversations c
+			JOIN participants p ON c.id = p.conversation_id
+			WHERE c.id = ? AND c.is_group = 1 AND c.is_channel = 0 AND p.user_id = ?
+		`, c.ConversationId, c.OwnerId).Scan(&id)
+		_ = tx.Rollback()
+		return id, false, err
+	case c.IsGroup:
+		err = tx.QueryRow(`
+			SELECT c.id
+			FROM conversations c
+			JOIN participants p ON c.id = p.conversation_id
+			WHERE c.import_key = ? AND p.user_id = ?
+		`, c.Key, c.OwnerId).Scan(&id)
+	default:
+		err = tx.QueryRow(`
+			SELECT c.id
+			FROM conversations c
+			JOIN participants p1 ON c.id = p1.conversation_id
+			JOIN participants p2 ON c.id = p2.conversation_id
+			WHERE c.is_group = 0 AND c.saved_by IS NULL
+			AND p1.user_id = ? AND p2.user_id = ?
+		`, c.Members[0], c.Members[1]).Scan(&id)
+	}
+	if err == nil {
+		_ = tx.Rollback()
+		return id, false, nil
+	} else if err != sql.ErrNoRows {
+		_ = tx.Rollback()
+		return 0, false, err
+	}
+
+	// The owner left the group created by a previous import: the key moves to the new one
+	var importKey sql.NullString
+	if c.IsGroup {
+		importKey = sql.NullString{String: c.Key, Valid: true}
+		_, err = tx.Exec("UPDATE conversations SET import_key = NULL WHERE import_key = ?", c.Key)
+		if err != nil {
+			_ = tx.Rollback()
+			return 0, false, err
+		}
+	}
+
+	// The time of the last message is set by ImportMessages
+	res, err := tx.Exec("INSERT INTO conversations (name, is_group, import_key) VALUES (?, ?, ?)", c.Name, c.IsGroup, importKey)
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, false, err
+	}
+	id, err = res.LastInsertId()
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, false, err
+	}
+
+	for _, memberId := range c.Members {
+		role := RoleMember
+		action := MembershipAdded
+		if c.IsGroup && memberId == c.OwnerId {
+			role = RoleOwner
+			action = MembershipCreated
+		}
+		_, err = tx.Exec("INSERT INTO participants (conversation_id, user_id, role, joined_at) VALUES (?, ?, ?, ?)",
+			id, memberId, role, time.Now())
+		if err != nil {
+			_ = tx.Rollback()
+			return 0, false, err
+		}
+		if c.IsGroup {
+			err = recordMembership(tx, id, memberId, c.OwnerId, action, "")
+			if err != nil {
+				_ = tx.Rollback()
+				return 0, false, err
+			}
+		}
+	}
+
+	return id, true, tx.Commit()
+}
+
+// ImportMessages adds the messages to the conversation with their original time, skipping the ones imported before,
+// and returns how many were added. The imported history counts as read by the members.
+func (db *appdbimpl) ImportMessages(conversationId int64, messages []ImportedMessage) (int, error) {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	stmt, err := tx.Prepare(`
+		INSERT INTO messages (conversation_id, sender_id, content, content_type, created_at, status, import_key)
+		VALUES (?, ?, ?, ?, ?, 1, ?)
+		ON CONFLICT (import_key) WHERE import_key IS NOT NULL DO NOTHING
+	`)
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+	defer stmt.Close()
+
+	var imported int
+	var latest time.Time
+	for _, m := range messages {
+		// Times are stored in the local time zone, like the other times, so that they compare correctly
+		createdAt := m.CreatedAt.Local()
+		res, err := stmt.Exec(conversationId, m.SenderId, m.Content, m.ContentType, createdAt, m.Key)
+		if err != nil {
+			_ = tx.Rollback()
+			return 0, err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			_ = tx.Rollback()
+			return 0, err
+		}
+		if n > 0 {
+			err = retainMediaURL(tx, m.Content, m.ContentType)
+			if err != nil {
+				_ = tx.Rollback()
+				return 0, err
+			}
+		}
+		imported += int(n)
+		if createdAt.After(latest) {
+			latest = createdAt
+		}
+	}
+
+	if imported > 0 {
+		_, err = tx.Exec(`
+			UPDATE conversations SET last_message_at = ?
+			WHERE id = ? AND (last_message_at IS NULL OR last_message_at < ?)
+		`, latest, conversationId, latest)
+		if err != nil {
+			_ = tx.Rollback()
+			return 0, err
+		}
+		_, err = tx.Exec(`
+			UPDATE participants SET last_read_at = ?
+			WHERE conversation_id = ? AND (last_read_at IS NULL OR last_read_at < ?)
+		`, latest, conversationId, latest)
+		if err != nil {
+			_ = tx.Rollback()
+			return 0, err
+		}
+	}
+
+	return imported, tx.Commit()
+}
+
+// IsMessageImported reports whether the message with the given key was imported before.
+func (db *appdbimpl) IsMessageImported(importKey string) (bool, error) {
+	var count int
+	err := db.c.QueryRow("SELECT COUNT(*) FROM messages WHERE import_key = ?", importKey).Scan(&count)
+	return count > 0, err
+}
@@ -0,0 +1,265 @@
+package database
+
+import (
+	"database/sql"
+	"time"
+)
+
+// CreateCommunity creates a community owned by ownerId, together with its announcement channel.
+func (db *appdbimpl) CreateCommunity(name string, description string, ownerId int64) (Community, error) {
+	c := Community{Name: name, Description: description, MemberCount: 1, GroupCount: 1, CreatedAt: time.Now()}
+	tx, err := db.c.Begin()
+	if err != nil {
+		return c, err
+	}
+
+	res, err := tx.Exec("INSERT INTO communities (name, description, created_by, created_at) VALUES (?, ?, ?, ?)",
+		name, description, ownerId, c.CreatedAt)
+	if err != nil {
+		_ = tx.Rollback()
+		return c, err
+	}
+	c.ID, err = res.LastInsertId()
+	if err != nil {
+		_ = tx.Rollback()
+		return c, err
+	}
+
+	_, err = tx.Exec("INSERT INTO community_members (community_id, user_id, role, joined_at) VALUES (?, ?, ?, ?)",
+		c.ID, ownerId, RoleOwner, c.CreatedAt)
+	if err != nil {
+		_ = tx.Rollback()
+		return c, err
+	}
+
+	c.AnnouncementChannelId, err = insertChannel(tx, name, description, ownerId, &c.ID)
+	if err != nil {
+		_ = tx.Rollback()
+		return c, err
+	}
+
+	_, err = tx.Exec("UPDATE communities SET announcement_channel_id = ? WHERE id = ?", c.AnnouncementChannelId, c.ID)
+	if err != nil {
+		_ = tx.Rollback()
+		return c, err
+	}
+
+	return c, tx.Commit()
+}
+
+func (db *appdbimpl) GetCommunity(id int64) (Community, error) {
+	var c Community
+	err := db.c.QueryRow(`
+		SELECT c.id, c.name, c.description, IFNULL(c.announcement_channel_id, 0), c.created_at,
+			(SELECT COUNT(*) FROM community_members WHERE community_id = c.id),
+			(SELECT COUNT(*) FROM conversations WHERE community_id = c.id)
+		FROM communities c
+		WHERE c.id = ?
+	`, id).Scan(&c.ID, &c.Name, &c.Description, &c.AnnouncementChannelId, &c.CreatedAt, &c.MemberCount, &c.GroupCount)
+	return c, err
+}
+
+// GetCommunityRole returns the role of the user in the community, or sql.ErrNoRows if the user is not a member.
+func (db *appdbimpl) GetCommunityRole(communityId int64, userId int64) (string, error) {
+	var role string
+	err := db.c.QueryRow("SELECT role FROM community_members WHERE community_id = ? AND user_id = ?", communityId, userId).Scan(&role)
+	return role, err
+}
+
+// SetCommunityRole changes the role of a member of the community. It returns sql.ErrNoRows if the user is not a
+// member.
+func (db *appdbimpl) SetCommunityRole(communityId int64, userId int64, role string) error {
+	res, err := db.c.Exec("UPDATE community_members SET role = ? WHERE community_id = ? AND user_id = ?", role, communityId, userId)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// AddCommunityMember adds the user to the community on behalf of actorId, and subscribes them to the announcement
+// channel. As with groups, the channel is a message request for users who don't know actorId.
+func (db *appdbimpl) AddCommunityMember(communityId int64, userId int64, actorId int64) error {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return err
+	}
+
+	known, err := knows(tx, userId, actorId)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	var requestFrom sql.NullInt64
+	if !known {
+		requestFrom = sql.NullInt64{Int64: actorId, Valid: true}
+	}
+
+	now := time.Now()
+	_, err = tx.Exec("INSERT INTO community_members (community_id, user_id, role, joined_at) VALUES (?, ?, ?, ?)",
+		communityId, userId, RoleMember, now)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	var channelId int64
+	err = tx.QueryRow("SELECT announcement_channel_id FROM communities WHERE id = ?", communityId).Scan(&channelId)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	res, err := tx.Exec(`
+		INSERT INTO participants (conversation_id, user_id, role, joined_at, request_from) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (conversation_id, user_id) DO NOTHING
+	`, channelId, userId, RoleMember, now, requestFrom)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		_ = tx.Rollback()
+		return err
+	} else if n > 0 {
+		err = recordMembership(tx, channelId, userId, actorId, MembershipAdded, "")
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// RemoveCommunityMember removes the user from the community and its announcement channel on behalf of actorId. The
+// user stays in the other groups of the community. If the user is the owner, the ownership passes to the
+// longest-standing admin or, if there are no admins, to the longest-standing member. It returns sql.ErrNoRows if the
+// user is not a member.
+func (db *appdbimpl) RemoveCommunityMember(communityId int64, userId int64, actorId int64) error {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return err
+	}
+
+	err = removeCommunityMember(tx, communityId, userId, actorId)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// removeCommunityMember is RemoveCommunityMember within a transaction.
+func removeCommunityMember(tx *sql.Tx, communityId int64, userId int64, actorId int64) error {
+	var role string
+	err := tx.QueryRow("SELECT role FROM community_members WHERE community_id = ? AND user_id = ?", communityId, userId).Scan(&role)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM community_members WHERE community_id = ? AND user_id = ?", communityId, userId)
+	if err != nil {
+		return err
+	}
+
+	if role == RoleOwner {
+		_, err = tx.Exec(`
+			UPDATE community_members SET role = ?
+			WHERE rowid = (
+				SELECT rowid FROM community_members
+				WHERE community_id = ?
+				ORDER BY role = ? DESC, joined_at, rowid
+				LIMIT 1
+			)
+		`, RoleOwner, communityId, RoleAdmin)
+		if err != nil {
+			return err
+		}
+	}
+
+	var channelId int64
+	err = tx.QueryRow("SELECT announcement_channel_id FROM communities WHERE id = ?", communityId).Scan(&channelId)
+	if err != nil {
+		return err
+	}
+	err = removeParticipant(tx, channelId, userId, actorId)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	return nil
+}
+
+// GetCommunityMembers returns the member directory of the community.
+func (db *appdbimpl) GetCommunityMembers(communityId int64) ([]User, error) {
+	rows, err := db.c.Query(`
+		SELECT u.id, u.name, IFNULL(u.photo_url, ''), m.role
+		FROM users u
+		JOIN community_members m ON u.id = m.user_id
+		WHERE m.community_id = ?
+		ORDER BY u.name
+	`, communityId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var members []User
+	for rows.Next() {
+		var u User
+		if err := rows.Scan(&u.ID, &u.Name, &u.PhotoURL, &u.Role); err != nil {
+			return nil, err
+		}
+		members = append(members, u)
+	}
+	return members, rows.Err()
+}
+
+// SetGroupCommunity moves the group to the community, or out of any community if communityId is nil. Listed groups
+// can be joined by all the community members.
+func (db *appdbimpl) SetGroupCommunity(groupId int64, communityId *int64, listed bool) error {
+	_, err := db.c.Exec("UPDATE conversations SET community_id = ?, community_listed = ? WHERE id = ? AND is_group = 1",
+		communityId, listed && communityId != nil, groupId)
+	return err
+}
+
+// GetCommunityGroups returns the groups of the community that the user can see: the listed ones, and the ones the
+// user is a member of. The admins of the community see all of them, so that they can manage the unlisted ones.
+func (db *appdbimpl) GetCommunityGroups(communityId int64, userId int64) ([]CommunityGroup, error) {
+	rows, err := db.c.Query(`
+		SELECT c.id, c.is_channel, IFNULL(c.name, ''), c.description, IFNULL(c.photo_url, ''),
+			(SELECT COUNT(*) FROM participants WHERE conversation_id = c.id),
+			c.only_admins_edit_info, c.only_admins_add_members, c.only_admins_send, c.slow_mode_seconds,
+			c.community_listed,
+			EXISTS (SELECT 1 FROM participants WHERE conversation_id = c.id AND user_id = ?1) AS joined
+		FROM conversations c
+		WHERE c.community_id = ?2 AND (c.community_listed = 1 OR joined OR EXISTS (
+			SELECT 1 FROM community_members
+			WHERE community_id = ?2 AND user_id = ?1 AND role IN (?3, ?4)
+		))
+		ORDER BY c.is_channel DESC, c.name
+	`, userId, communityId, RoleOwner, RoleAdmin)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var groups []CommunityGroup
+	for rows.Next() {
+		var g CommunityGroup
+		if err := rows.Scan(&g.ID, &g.IsChannel, &g.Name, &g.Description, &g.PhotoURL, &g.MemberCount,
+			&g.Settings.OnlyAdminsEditInfo, &g.Settings.OnlyAdminsAddMembers, &g.Settings.OnlyAdminsSend,
+			&g.Settings.SlowModeSeconds, &g.Listed, &g.Joined); err != nil {
+			return nil, err
+		}
+		groups = append(groups, g)
+	}
+	return groups, rows.Err()
+}
@@ -5,7 +5,9 @@ import (
 	"time"
 )
 
-func (db *appdbimpl) CreateConversation(name string, isGroup bool, initialMembers []int64) (Conversation, error) {
+// CreateConversation creates a conversation with the given members on behalf of ownerId, who must be one of them. In
+// groups, ownerId becomes the owner. Members who don't know ownerId receive the conversation as a message request.
+func (db *appdbimpl) CreateConversation(name string, isGroup bool, ownerId int64, initialMembers []int64) (Conversation, error) {
 	var conversation Conversation
 	// Transaction to ensure atomicity
 	tx, err := db.c.Begin()
@@ -13,6 +15,20 @@ func (db *appdbimpl) CreateConversation(name string, isGroup bool, initialMember
 		return conversation, err
 	}
 
+	// Decided before the conversation exists, since it would make its members known to each other
+	requests := make(map[int64]bool)
+	for _, memberId := range initialMembers {
+		if memberId == ownerId {
+			continue
+		}
+		known, err := knows(tx, memberId, ownerId)
+		if err != nil {
+			_ = tx.Rollback()
+			return conversation, err
+		}
+		requests[memberId] = !known
+	}
+
 	// Create Conversation
 	res, err := tx.Exec("INSERT INTO conversations (name, is_group, last_message_at) VALUES (?, ?, ?)", name, isGroup, time.Now())
 	if err != nil {
@@ -26,7 +42,7 @@ func (db *appdbimpl) CreateConversation(name string, isGroup bool, initialMember
 	}
 
 	// Add Participants (Unique)
-	stmt, err := tx.Prepare("INSERT INTO participants (conversation_id, user_id) VALUES (?, ?)")
+	stmt, err := tx.Prepare("INSERT INTO participants (conversation_id, user_id, role, joined_at, request_from) VALUES (?, ?, ?, ?, ?)")
 	if err != nil {
 		_ = tx.Rollback()
 		return conversation, err
@@ -39,11 +55,31 @@ func (db *appdbimpl) CreateConversation(name string, isGroup bool, initialMember
 			continue
 		}
 		seen[memberId] = true
-		_, err = stmt.Exec(id, memberId)
+		role := RoleMember
+		if isGroup && memberId == ownerId {
+			role = RoleOwner
+		}
+		var requestFrom sql.NullInt64
+		if requests[memberId] {
+			requestFrom = sql.NullInt64{Int64: ownerId, Valid: true}
+		}
+		_, err = stmt.Exec(id, memberId, role, time.Now(), requestFrom)
 		if err != nil {
 			_ = tx.Rollback()
 			return conversation, err
 		}
+
+		if isGroup {
+			action := MembershipAdded
+			if memberId == ownerId {
+				action = MembershipCreated
+			}
+			err = recordMembership(tx, id, memberId, ownerId, action, "")
+			if err != nil {
+				_ = tx.Rollback()
+				return conversation, err
+			}
+		}
 	}
 
 	err = tx.Commit()
@@ -58,7 +94,7 @@ func (db *appdbimpl) CreateConversation(name string, isGroup bool, initialMember
 	return conversation, nil
 }
 
-func (db *appdbimpl) GetConversations(userId int64) ([]Conversation, error) {
+func (db *appdbimpl) GetConversations(userId int64, filter ConversationFilter) ([]Conversation, error) {
 	rows, err := db.c.Query(`
 		SELECT 
 			c.id, 
@@ -72,6 +108,9 @@ func (db *appdbimpl) GetConversations(userId int64) ([]Conversation, error) {
 				)
 			END, 
 			c.is_group, 
+			c.is_channel,
+			c.saved_by IS NOT NULL,
+			c.community_id,
 			CASE 
 				WHEN c.is_group = 1 THEN IFNULL(c.photo_url, '') 
 				ELSE (
@@ -81,31 +120,51 @@ func (db *appdbimpl) GetConversations(userId int64) ([]Conversation, error) {
 					)
 				)
 			END, 
+			CASE 
+				WHEN c.is_group = 1 THEN 0 
+				ELSE COALESCE(
+					(SELECT user_id FROM participants WHERE conversation_id = c.id AND user_id != ? LIMIT 1),
+					?
+				)
+			END, 
 			c.last_message_at,
-			(SELECT content FROM messages WHERE conversation_id = c.id ORDER BY created_at DESC LIMIT 1) as latest_preview,
-			(SELECT sender_id FROM messages WHERE conversation_id = c.id ORDER BY created_at DESC LIMIT 1) as latest_sender,
+			(SELECT content FROM messages WHERE conversation_id = c.id AND (p_me.cleared_at IS NULL OR created_at > p_me.cleared_at) ORDER BY created_at DESC LIMIT 1) as latest_preview,
+			(SELECT sender_id FROM messages WHERE conversation_id = c.id AND (p_me.cleared_at IS NULL OR created_at > p_me.cleared_at) ORDER BY created_at DESC LIMIT 1) as latest_sender,
+			(SELECT content_type FROM messages WHERE conversation_id = c.id AND (p_me.cleared_at IS NULL OR created_at > p_me.cleared_at) ORDER BY created_at DESC LIMIT 1) as latest_type,
 			(SELECT 
 				CASE 
+					WHEN c.is_channel = 1 THEN m_inner.status
 					WHEN m_inner.status >= 2 THEN 2
 					WHEN NOT EXISTS (
 						SELECT 1 FROM participants p 
 						WHERE p.conversation_id = m_inner.conversation_id 
 						AND p.user_id != m_inner.sender_id 
-						AND (p.last_read_at IS NULL OR p.last_read_at < m_inner.created_at)
+						AND (p.last_read_at IS NULL OR p.last_read_at < m_inner.created_at OR p.request_from IS NOT NULL)
 					) THEN 2
 					ELSE m_inner.status
 				END
-			FROM messages m_inner WHERE m_inner.conversation_id = c.id ORDER BY m_inner.created_at DESC LIMIT 1) as latest_status,
-			(SELECT is_deleted FROM messages WHERE conversation_id = c.id ORDER BY created_at DESC LIMIT 1) as latest_deleted,
+			FROM messages m_inner WHERE m_inner.conversation_id = c.id
+				AND (p_me.cleared_at IS NULL OR m_inner.created_at > p_me.cleared_at)
+			ORDER BY m_inner.created_at DESC LIMIT 1) as latest_status,
+			(SELECT is_deleted FROM messages WHERE conversation_id = c.id AND (p_me.cleared_at IS NULL OR created_at > p_me.cleared_at) ORDER BY created_at DESC LIMIT 1) as latest_deleted,
 			(SELECT COUNT(*) FROM messages m 
 			WHERE m.conversation_id = c.id 
 			AND m.sender_id != p_me.user_id
-			AND (p_me.last_read_at IS NULL OR m.created_at > p_me.last_read_at)) as unread_count
+			AND (p_me.last_read_at IS NULL OR m.created_at > p_me.last_read_at)
+			AND (p_me.cleared_at IS NULL OR m.created_at > p_me.cleared_at)) as unread_count,
+			p_me.archived,
+			p_me.muted,
+			p_me.muted_until,
+			p_me.pinned_at,
+			p_me.request_from
 		FROM conversations c
 		JOIN participants p_me ON c.id = p_me.conversation_id
 		WHERE p_me.user_id = ?
-		ORDER BY c.last_message_at DESC
-	`, userId, userId, userId, userId, userId)
+		AND (? IS NULL OR c.community_id = ?)
+		AND p_me.hidden = 0
+		AND (? OR (p_me.archived = ? AND (p_me.request_from IS NOT NULL) = ?))
+		ORDER BY p_me.pinned_at IS NULL, p_me.pinned_at DESC, c.last_message_at DESC
+	`, userId, userId, userId, userId, userId, userId, userId, filter.CommunityId, filter.CommunityId, filter.AnyState, filter.Archived, filter.Requests)
 	if err != nil {
 		return nil, err
 	}
@@ -116,21 +175,51 @@ func (db *appdbimpl) GetConversations(userId int64) ([]Conversation, error) {
 		var c Conversation
 		var preview sql.NullString
 		var senderId sql.NullInt64
+		var contentType sql.NullString
 		var status sql.NullInt64
 		var deleted sql.NullBool
 		var lastAt sql.NullTime
-		if err := rows.Scan(&c.ID, &c.Name, &c.IsGroup, &c.PhotoURL, &lastAt, &preview, &senderId, &status, &deleted, &c.UnreadCount); err != nil {
+		var communityId sql.NullInt64
+		var mutedUntil, pinnedAt sql.NullTime
+		var requestFrom sql.NullInt64
+		if err := rows.Scan(&c.ID, &c.Name, &c.IsGroup, &c.IsChannel, &c.IsSaved, &communityId, &c.PhotoURL, &c.PeerId, &lastAt, &preview, &senderId, &contentType, &status, &deleted, &c.UnreadCount, &c.Archived, &c.Muted, &mutedUntil, &pinnedAt, &requestFrom); err != nil {
 			return nil, err
 		}
+		// Mutes with an end time expire by themselves
+		if c.Muted && mutedUntil.Valid {
+			if mutedUntil.Time.After(time.Now()) {
+				c.MutedUntil = &mutedUntil.Time
+			} else {
+				c.Muted = false
+			}
+		}
+		c.Pinned = pinnedAt.Valid
+		if requestFrom.Valid {
+			c.RequestFrom = &requestFrom.Int64
+		}
+		// Saved Messages has no peer: the name fallback above gives the user itself
+		if c.IsSaved {
+			c.PeerId = 0
+		}
+		// Folder rules depend on the computed state, so they are applied here
+		if filter.Folder != nil && !filter.Folder.Matches(c) {
+			continue
+		}
 		if lastAt.Valid {
 			c.LastMessageAt = lastAt.Time
 		}
+		if communityId.Valid {
+			c.CommunityId = &communityId.Int64
+		}
 		if preview.Valid {
 			c.LatestMessagePreview = preview.String
 		}
 		if senderId.Valid {
 			c.LatestMessageSenderId = senderId.Int64
 		}
+		if contentType.Valid {
+			c.LatestMessageType = contentType.String
+		}
 		if status.Valid {
 			c.LatestMessageStatus = int(status.Int64)
 		}
@@ -145,13 +234,18 @@ func (db *appdbimpl) GetConversations(userId int64) ([]Conversation, error) {
 func (db *appdbimpl) GetConversation(id int64) (Conversation, error) {
 	var c Conversation
 	var lastAt sql.NullTime
+	var communityId sql.NullInt64
 	err := db.c.QueryRow(`
-		SELECT id, IFNULL(name, ''), is_group, IFNULL(photo_url, ''), last_message_at
+		SELECT id, IFNULL(name, ''), is_group, is_channel, saved_by IS NOT NULL, community_id, IFNULL(photo_url, ''),
+			last_message_at
 		FROM conversations WHERE id = ?
-	`, id).Scan(&c.ID, &c.Name, &c.IsGroup, &c.PhotoURL, &lastAt)
+	`, id).Scan(&c.ID, &c.Name, &c.IsGroup, &c.IsChannel, &c.IsSaved, &communityId, &c.PhotoURL, &lastAt)
 	if lastAt.Valid {
 		c.LastMessageAt = lastAt.Time
 	}
+	if communityId.Valid {
+		c.CommunityId = &communityId.Int64
+	}
 	return c, err
 }
 
@@ -169,6 +263,7 @@ func (db *appdbimpl) FindOneOnOneConversation(userId1, userId2 int64) (int64, er
 		JOIN participants p1 ON c.id = p1.conversation_id
 		JOIN participants p2 ON c.id = p2.conversation_id
 		WHERE c.is_group = 0 
+		AND c.saved_by IS NULL
 		AND p1.user_id = ? 
 		AND p2.user_id = ?
 	`, userId1, userId2).Scan(&id)
@@ -178,6 +273,111 @@ func (db *appdbimpl) FindOneOnOneConversation(userId1, userId2 int64) (int64, er
 	return id, err
 }
 
+// updateParticipant changes the choices of the user about the conversation. It returns sql.ErrNoRows if the user is not
+// in the conversation.
+func (db *appdbimpl) updateParticipant(conversationId int64, userId int64, set string, args ...interface{}) error {
+	args = append(args, conversationId, userId)
+	res, err := db.c.Exec("UPDATE participants SET "+set+" WHERE conversation_id = ? AND user_id = ?", args...)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// SetArchived hides the conversation from the conversation list of the user, or brings it back.
+func (db *appdbimpl) SetArchived(conversationId int64, userId int64, archived bool) error {
+	return db.updateParticipant(conversationId, userId, "archived = ?", archived)
+}
+
+// SetMuted mutes the conversation for the user until the given time, or forever if until is nil.
+func (db *appdbimpl) SetMuted(conversationId int64, userId int64, muted bool, until *time.Time) error {
+	var mutedUntil sql.NullTime
+	if muted && until != nil {
+		mutedUntil = sql.NullTime{Time: *until, Valid: true}
+	}
+	return db.updateParticipant(conversationId, userId, "muted = ?, muted_until = ?", muted, mutedUntil)
+}
+
+// SetPinned pins the conversation at the top of the conversation list of the user, above the ones pinned before.
+// Pinning a pinned conversation keeps its position.
+func (db *appdbimpl) SetPinned(conversationId int64, userId int64, pinned bool) error {
+	var pinnedAt sql.NullTime
+	if pinned {
+		pinnedAt = sql.NullTime{Time: time.Now(), Valid: true}
+	}
+	return db.updateParticipant(conversationId, userId, "pinned_at = CASE WHEN ? THEN IFNULL(pinned_at, ?) END", pinned, pinnedAt)
+}
+
+// ClearHistory hides the messages sent so far in the conversation from the user.
+func (db *appdbimpl) ClearHistory(conversationId int64, userId int64) error {
+	return db.updateParticipant(conversationId, userId, "cleared_at = ?", time.Now())
+}
+
+// HideConversation clears the history of the conversation and removes it from the conversation list of the user, until
+// a new message arrives.
+func (db *appdbimpl) HideConversation(conversationId int64, userId int64) error {
+	return db.updateParticipant(conversationId, userId, "cleared_at = ?, hidden = 1, archived = 0, pinned_at = NULL", time.Now())
+}
+
+// GetSavedMessages returns the Saved Messages conversation of the user, where the user is the only participant. It is
+// created on first use: created reports whether it was created by this call.
+func (db *appdbimpl) GetSavedMessages(userId int64) (Conversation, bool, error) {
+	var c Conversation
+	tx, err := db.c.Begin()
+	if err != nil {
+		return c, false, err
+	}
+
+	var lastAt sql.NullTime
+	err = tx.QueryRow("SELECT id, last_message_at FROM conversations WHERE saved_by = ?", userId).Scan(&c.ID, &lastAt)
+	if err == nil {
+		_ = tx.Rollback()
+		c.IsSaved = true
+		if lastAt.Valid {
+			c.LastMessageAt = lastAt.Time
+		}
+		return c, false, nil
+	} else if err != sql.ErrNoRows {
+		_ = tx.Rollback()
+		return c, false, err
+	}
+
+	now := time.Now()
+	res, err := tx.Exec("INSERT INTO conversations (name, is_group, saved_by, last_message_at) VALUES ('', 0, ?, ?)", userId, now)
+	if err != nil {
+		_ = tx.Rollback()
+		return c, false, err
+	}
+	c.ID, err = res.LastInsertId()
+	if err != nil {
+		_ = tx.Rollback()
+		return c, false, err
+	}
+
+	_, err = tx.Exec("INSERT INTO participants (conversation_id, user_id, role, joined_at) VALUES (?, ?, ?, ?)",
+		c.ID, userId, RoleMember, now)
+	if err != nil {
+		_ = tx.Rollback()
+		return c, false, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return c, false, err
+	}
+
+	c.IsSaved = true
+	c.LastMessageAt = now
+	return c, true, nil
+}
+
 func (db *appdbimpl) GetConversationMembers(conversationId int64) ([]int64, error) {
 	rows, err := db.c.Query("SELECT user_id FROM participants WHERE conversation_id = ?", conversationId)
 	if err != nil {
@@ -198,7 +398,7 @@ func (db *appdbimpl) GetConversationMembers(conversationId int64) ([]int64, erro
 
 func (db *appdbimpl) GetConversationMembersDetailed(conversationId int64) ([]User, error) {
 	rows, err := db.c.Query(`
-		SELECT u.id, u.name, IFNULL(u.photo_url, '')
+		SELECT u.id, u.name, IFNULL(u.photo_url, ''), p.role
 		FROM users u
 		JOIN participants p ON u.id = p.user_id
 		WHERE p.conversation_id = ?
@@ -211,7 +411,7 @@ func (db *appdbimpl) GetConversationMembersDetailed(conversationId int64) ([]Use
 	var members []User
 	for rows.Next() {
 		var u User
-		if err := rows.Scan(&u.ID, &u.Name, &u.PhotoURL); err != nil {
+		if err := rows.Scan(&u.ID, &u.Name, &u.PhotoURL, &u.Role); err != nil {
 			return nil, err
 		}
 		members = append(members, u)
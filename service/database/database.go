@@ -6,8 +6,10 @@ package database
 
 import (
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"strings"
 	"time"
 )
 
@@ -17,38 +19,154 @@ type AppDatabase interface {
 	CreateUser(name string) (User, error)
 	GetUser(id int64) (User, error)
 	GetUserByName(name string) (User, error)
+	GetPlaceholderUser(ownerId int64, name string) (User, bool, error)
 	SetUserName(id int64, name string) error
 	SetUserPhoto(id int64, photoURL string) error
 	ListUsers(query string) ([]User, error)
+	RecordSession(userId int64, userAgent string, newUser bool) error
+	GetSessions(userId int64) ([]Session, error)
+	SetUserDeactivated(id int64, deactivated bool) error
+	IsUserDisabled(id int64) (bool, error)
+	DeleteUser(id int64, redactMessages bool) ([]int64, error)
+
+	// Blocking
+	BlockUser(blockerId int64, blockedId int64) error
+	UnblockUser(blockerId int64, blockedId int64) error
+	IsBlocked(blockerId int64, blockedId int64) (bool, error)
+	GetBlockedUsers(blockerId int64) ([]User, error)
+	GetBlockers(blockedId int64) ([]int64, error)
 
 	// Conversation
-	CreateConversation(name string, isGroup bool, initialMembers []int64) (Conversation, error)
-	GetConversations(userId int64) ([]Conversation, error)
+	CreateConversation(name string, isGroup bool, ownerId int64, initialMembers []int64) (Conversation, error)
+	GetConversations(userId int64, filter ConversationFilter) ([]Conversation, error)
 	GetConversation(id int64) (Conversation, error)
 	IsUserInConversation(conversationId int64, userId int64) (bool, error)
 	FindOneOnOneConversation(userId1, userId2 int64) (int64, error)
+	GetSavedMessages(userId int64) (Conversation, bool, error)
+	SetArchived(conversationId int64, userId int64, archived bool) error
+	SetMuted(conversationId int64, userId int64, muted bool, until *time.Time) error
+	SetPinned(conversationId int64, userId int64, pinned bool) error
+	ClearHistory(conversationId int64, userId int64) error
+	HideConversation(conversationId int64, userId int64) error
+
+	// Message requests
+	AcceptMessageRequest(conversationId int64, userId int64) error
+	DeclineMessageRequest(conversationId int64, userId int64) (int64, error)
 
 	// Group Specific
-	SetGroupName(id int64, name string) error
-	SetGroupPhoto(id int64, photoURL string) error
-	AddMember(groupId int64, userId int64) error
-	RemoveMember(groupId int64, userId int64) error
+	SetGroupName(id int64, name string, actorId int64) error
+	SetGroupPhoto(id int64, photoURL string, actorId int64) error
+	GetGroupProfile(id int64) (GroupProfile, error)
+	GetGroupAdmins(groupId int64) ([]User, error)
+	UpdateGroup(id int64, u GroupUpdate, actorId int64) error
+	AddMember(groupId int64, userId int64, actorId int64) error
+	RemoveMember(groupId int64, userId int64, actorId int64) error
 	GetConversationMembers(conversationId int64) ([]int64, error)
 	GetConversationMembersDetailed(conversationId int64) ([]User, error)
 	UpdateParticipantLastRead(conversationId, userId int64) error
+	GetMemberRole(groupId int64, userId int64) (string, error)
+	SetMemberRole(groupId int64, userId int64, role string, actorId int64) error
+	TransferOwnership(groupId int64, fromId int64, toId int64) error
+	BanMember(groupId int64, userId int64, bannedBy int64) error
+	UnbanMember(groupId int64, userId int64, actorId int64) error
+	IsBanned(groupId int64, userId int64) (bool, error)
+	GetBans(groupId int64) ([]Ban, error)
+	GetAuditLog(groupId int64, filter AuditFilter) ([]AuditEntry, error)
+
+	// Communities
+	CreateCommunity(name string, description string, ownerId int64) (Community, error)
+	GetCommunity(id int64) (Community, error)
+	GetCommunityRole(communityId int64, userId int64) (string, error)
+	SetCommunityRole(communityId int64, userId int64, role string) error
+	AddCommunityMember(communityId int64, userId int64, actorId int64) error
+	RemoveCommunityMember(communityId int64, userId int64, actorId int64) error
+	GetCommunityMembers(communityId int64) ([]User, error)
+	SetGroupCommunity(groupId int64, communityId *int64, listed bool) error
+	GetCommunityGroups(communityId int64, userId int64) ([]CommunityGroup, error)
+
+	// Invite links
+	CreateInvite(inv Invite) error
+	GetInvite(token string) (Invite, error)
+	GetInvites(groupId int64) ([]Invite, error)
+	RevokeInvite(groupId int64, token string, actorId int64) error
+	JoinByInvite(token string, userId int64) (int64, error)
+	CountMembers(groupId int64) (int, error)
+
+	// Channels
+	CreateChannel(name string, description string, ownerId int64) (Conversation, error)
+	SearchChannels(query string) ([]GroupProfile, error)
+
+	// Join requests
+	CreateJoinRequest(groupId int64, userId int64, inviteToken string, message string) (JoinRequest, error)
+	GetJoinRequest(id int64) (JoinRequest, error)
+	GetPendingJoinRequests(groupId int64) ([]JoinRequest, error)
+	DecideJoinRequest(id int64, deciderId int64, approve bool) (JoinRequest, error)
+
+	// Notifications
+	GetNotifications(userId int64, unreadOnly bool) ([]Notification, error)
+	MarkNotificationRead(id int64, userId int64) error
+
+	// Folders
+	CreateFolder(f Folder) (Folder, error)
+	GetFolder(id int64, userId int64) (Folder, error)
+	GetFolders(userId int64) ([]Folder, error)
+	UpdateFolder(f Folder) error
+	DeleteFolder(id int64, userId int64) error
+
+	// Chat import
+	PrepareImport(c ChatImport) (int64, bool, error)
+	ImportMessages(conversationId int64, messages []ImportedMessage) (int, error)
+	IsMessageImported(importKey string) (bool, error)
+
+	// Account takeout
+	CreateTakeout(t Takeout) error
+	GetTakeout(id string) (Takeout, error)
+	GetCurrentTakeout(userId int64) (Takeout, error)
+	CompleteTakeout(id string, size int64, expiresAt time.Time) error
+	FailTakeout(id string) error
+	FailPendingTakeouts() error
+	GetExpiredTakeouts(now time.Time) ([]Takeout, error)
+	DeleteTakeout(id string) error
+	GetMemberships(userId int64) ([]Membership, error)
+	ExportUserMessages(userId int64, fn func(Message) error) error
+	GetGivenReactions(userId int64) ([]GivenReaction, error)
 
 	// Message
 	SendMessage(conversationId int64, senderId int64, content string, contentType string, replyToId *int64) (Message, error)
-	GetMessages(conversationId int64) ([]Message, error)
+	GetMessages(conversationId int64, userId int64) ([]Message, error)
+	ExportMessages(conversationId int64, userId int64, fn func(Message) error) error
 	GetMessage(id int64) (Message, error)
 	DeleteMessage(id int64) error
 	SetMessageStatus(id int64, status int) error
+	GetLastMessageTime(conversationId int64, senderId int64) (time.Time, error)
 
 	// Reaction
 	AddReaction(messageId int64, userId int64, emoticon string) error
 	RemoveReaction(messageId int64, userId int64) error
 	GetReactions(messageId int64) ([]Reaction, error)
 
+	// Media
+	CreateMedia(m Media) error
+	GetMedia(id string) (Media, error)
+	GetExportMedia(conversationId int64, userId int64) ([]Media, error)
+	GetUploadedMedia(userId int64) ([]Media, error)
+	ReleaseMedia(id string) (string, error)
+	GetLegacyMedia() ([]Media, error)
+	SetMediaBlob(id string, blobHash string, size int64) error
+	GetGroupsWithPhotoPrefix(prefix string) ([]Conversation, error)
+	GetUnreferencedMedia() ([]Media, error)
+	ReleaseUnreferencedMedia(id string, cutoff time.Time) (string, error)
+	GetBlobReferenceCounts() (map[string]int64, error)
+	IsURLReferenced(url string) (bool, error)
+
+	// Resumable uploads
+	CreateUpload(u Upload) error
+	GetUpload(id string) (Upload, error)
+	SetUploadOffset(id string, offset int64, expiresAt time.Time) error
+	CompleteUpload(id string, blobHash string, mimeType string) error
+	DeleteUpload(id string) (string, error)
+	GetExpiredUploads(now time.Time) ([]Upload, error)
+
 	Ping() error
 }
 
@@ -67,24 +185,153 @@ func New(db *sql.DB) (AppDatabase, error) {
 	tables := []string{
 		`CREATE TABLE IF NOT EXISTS users (
 			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			name TEXT NOT NULL UNIQUE,
-			photo_url TEXT
+			name TEXT NOT NULL,
+			photo_url TEXT,
+			deactivated_at DATETIME,
+			deleted_at DATETIME,
+			placeholder_of INTEGER REFERENCES users(id)
 		);`,
 		`CREATE TABLE IF NOT EXISTS conversations (
 			id INTEGER PRIMARY KEY AUTOINCREMENT,
 			name TEXT,
 			is_group BOOLEAN NOT NULL DEFAULT 0,
 			photo_url TEXT,
-			last_message_at DATETIME
+			last_message_at DATETIME,
+			description TEXT NOT NULL DEFAULT '',
+			only_admins_edit_info BOOLEAN NOT NULL DEFAULT 1,
+			only_admins_add_members BOOLEAN NOT NULL DEFAULT 1,
+			only_admins_send BOOLEAN NOT NULL DEFAULT 0,
+			slow_mode_seconds INTEGER NOT NULL DEFAULT 0,
+			is_channel BOOLEAN NOT NULL DEFAULT 0,
+			community_id INTEGER REFERENCES communities(id),
+			community_listed BOOLEAN NOT NULL DEFAULT 0,
+			saved_by INTEGER REFERENCES users(id),
+			import_key TEXT
 		);`,
 		`CREATE TABLE IF NOT EXISTS participants (
 			conversation_id INTEGER NOT NULL,
 			user_id INTEGER NOT NULL,
 			last_read_at DATETIME,
+			role TEXT NOT NULL DEFAULT 'member',
+			joined_at DATETIME,
+			archived BOOLEAN NOT NULL DEFAULT 0,
+			muted BOOLEAN NOT NULL DEFAULT 0,
+			muted_until DATETIME,
+			pinned_at DATETIME,
+			request_from INTEGER REFERENCES users(id),
+			cleared_at DATETIME,
+			hidden BOOLEAN NOT NULL DEFAULT 0,
 			PRIMARY KEY (conversation_id, user_id),
 			FOREIGN KEY (conversation_id) REFERENCES conversations(id) ON DELETE CASCADE,
 			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
 		);`,
+		`CREATE TABLE IF NOT EXISTS group_bans (
+			group_id INTEGER NOT NULL,
+			user_id INTEGER NOT NULL,
+			banned_by INTEGER NOT NULL,
+			created_at DATETIME NOT NULL,
+			PRIMARY KEY (group_id, user_id),
+			FOREIGN KEY (group_id) REFERENCES conversations(id) ON DELETE CASCADE,
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+		);`,
+		`CREATE TABLE IF NOT EXISTS group_invites (
+			token TEXT PRIMARY KEY,
+			group_id INTEGER NOT NULL,
+			created_by INTEGER NOT NULL,
+			created_at DATETIME NOT NULL,
+			expires_at DATETIME,
+			max_uses INTEGER NOT NULL DEFAULT 0,
+			uses INTEGER NOT NULL DEFAULT 0,
+			requires_approval BOOLEAN NOT NULL DEFAULT 0,
+			revoked BOOLEAN NOT NULL DEFAULT 0,
+			FOREIGN KEY (group_id) REFERENCES conversations(id) ON DELETE CASCADE
+		);`,
+		`CREATE TABLE IF NOT EXISTS membership_history (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			group_id INTEGER NOT NULL,
+			user_id INTEGER NOT NULL,
+			actor_id INTEGER NOT NULL,
+			action TEXT NOT NULL,
+			invite_token TEXT,
+			created_at DATETIME NOT NULL,
+			FOREIGN KEY (group_id) REFERENCES conversations(id) ON DELETE CASCADE
+		);`,
+		`CREATE TABLE IF NOT EXISTS group_audit (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			group_id INTEGER NOT NULL,
+			actor_id INTEGER NOT NULL,
+			action TEXT NOT NULL,
+			target_id INTEGER,
+			old_value TEXT,
+			new_value TEXT,
+			created_at DATETIME NOT NULL,
+			FOREIGN KEY (group_id) REFERENCES conversations(id) ON DELETE CASCADE
+		);`,
+		`CREATE INDEX IF NOT EXISTS group_audit_group ON group_audit (group_id, id);`,
+		`CREATE TABLE IF NOT EXISTS join_requests (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			group_id INTEGER NOT NULL,
+			user_id INTEGER NOT NULL,
+			invite_token TEXT,
+			message TEXT NOT NULL DEFAULT '',
+			status TEXT NOT NULL DEFAULT 'pending',
+			created_at DATETIME NOT NULL,
+			decided_by INTEGER,
+			decided_at DATETIME,
+			FOREIGN KEY (group_id) REFERENCES conversations(id) ON DELETE CASCADE,
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+		);`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS join_requests_pending ON join_requests (group_id, user_id) WHERE status = 'pending';`,
+		`CREATE TABLE IF NOT EXISTS notifications (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL,
+			type TEXT NOT NULL,
+			payload TEXT NOT NULL,
+			created_at DATETIME NOT NULL,
+			read_at DATETIME,
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+		);`,
+		`CREATE TABLE IF NOT EXISTS blocks (
+			blocker_id INTEGER NOT NULL,
+			blocked_id INTEGER NOT NULL,
+			created_at DATETIME NOT NULL,
+			PRIMARY KEY (blocker_id, blocked_id),
+			FOREIGN KEY (blocker_id) REFERENCES users(id) ON DELETE CASCADE,
+			FOREIGN KEY (blocked_id) REFERENCES users(id) ON DELETE CASCADE
+		);`,
+		`CREATE TABLE IF NOT EXISTS folders (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL,
+			name TEXT NOT NULL,
+			include_groups BOOLEAN NOT NULL DEFAULT 0,
+			exclude_muted BOOLEAN NOT NULL DEFAULT 0,
+			only_unread BOOLEAN NOT NULL DEFAULT 0,
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+		);`,
+		`CREATE TABLE IF NOT EXISTS folder_conversations (
+			folder_id INTEGER NOT NULL,
+			conversation_id INTEGER NOT NULL,
+			PRIMARY KEY (folder_id, conversation_id),
+			FOREIGN KEY (folder_id) REFERENCES folders(id) ON DELETE CASCADE,
+			FOREIGN KEY (conversation_id) REFERENCES conversations(id) ON DELETE CASCADE
+		);`,
+		`CREATE TABLE IF NOT EXISTS communities (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			name TEXT NOT NULL,
+			description TEXT NOT NULL DEFAULT '',
+			announcement_channel_id INTEGER,
+			created_by INTEGER NOT NULL,
+			created_at DATETIME NOT NULL
+		);`,
+		`CREATE TABLE IF NOT EXISTS community_members (
+			community_id INTEGER NOT NULL,
+			user_id INTEGER NOT NULL,
+			role TEXT NOT NULL DEFAULT 'member',
+			joined_at DATETIME NOT NULL,
+			PRIMARY KEY (community_id, user_id),
+			FOREIGN KEY (community_id) REFERENCES communities(id) ON DELETE CASCADE,
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+		);`,
 		`CREATE TABLE IF NOT EXISTS messages (
 			id INTEGER PRIMARY KEY AUTOINCREMENT,
 			conversation_id INTEGER NOT NULL,
@@ -95,9 +342,11 @@ func New(db *sql.DB) (AppDatabase, error) {
 			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
 			status INTEGER DEFAULT 0,
 			is_deleted BOOLEAN NOT NULL DEFAULT 0,
+			import_key TEXT,
 			FOREIGN KEY (conversation_id) REFERENCES conversations(id) ON DELETE CASCADE,
 			FOREIGN KEY (sender_id) REFERENCES users(id) ON DELETE CASCADE
 		);`,
+		`CREATE INDEX IF NOT EXISTS messages_conversation_created ON messages (conversation_id, created_at);`,
 		`CREATE TABLE IF NOT EXISTS reactions (
 			message_id INTEGER NOT NULL,
 			user_id INTEGER NOT NULL,
@@ -106,6 +355,57 @@ func New(db *sql.DB) (AppDatabase, error) {
 			FOREIGN KEY (message_id) REFERENCES messages(id) ON DELETE CASCADE,
 			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
 		);`,
+		`CREATE TABLE IF NOT EXISTS media_blobs (
+			hash TEXT PRIMARY KEY,
+			size INTEGER NOT NULL,
+			ref_count INTEGER NOT NULL DEFAULT 0,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		);`,
+		`CREATE TABLE IF NOT EXISTS media (
+			id TEXT PRIMARY KEY,
+			conversation_id INTEGER,
+			uploader_id INTEGER NOT NULL,
+			filename TEXT NOT NULL DEFAULT '',
+			blob_hash TEXT,
+			mime_type TEXT NOT NULL,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			ref_count INTEGER NOT NULL DEFAULT 0,
+			FOREIGN KEY (conversation_id) REFERENCES conversations(id) ON DELETE CASCADE,
+			FOREIGN KEY (uploader_id) REFERENCES users(id) ON DELETE CASCADE,
+			FOREIGN KEY (blob_hash) REFERENCES media_blobs(hash)
+		);`,
+		`CREATE TABLE IF NOT EXISTS uploads (
+			id TEXT PRIMARY KEY,
+			user_id INTEGER NOT NULL,
+			length INTEGER NOT NULL,
+			upload_offset INTEGER NOT NULL DEFAULT 0,
+			metadata TEXT NOT NULL DEFAULT '',
+			blob_hash TEXT,
+			mime_type TEXT NOT NULL DEFAULT '',
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			expires_at DATETIME NOT NULL,
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+			FOREIGN KEY (blob_hash) REFERENCES media_blobs(hash)
+		);`,
+		`CREATE TABLE IF NOT EXISTS sessions (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL,
+			created_at DATETIME NOT NULL,
+			user_agent TEXT NOT NULL DEFAULT '',
+			new_user BOOLEAN NOT NULL DEFAULT 0,
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+		);`,
+		`CREATE INDEX IF NOT EXISTS sessions_user ON sessions (user_id, created_at);`,
+		`CREATE TABLE IF NOT EXISTS takeouts (
+			id TEXT PRIMARY KEY,
+			user_id INTEGER NOT NULL,
+			status TEXT NOT NULL DEFAULT 'pending',
+			size INTEGER NOT NULL DEFAULT 0,
+			created_at DATETIME NOT NULL,
+			completed_at DATETIME,
+			expires_at DATETIME,
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+		);`,
 	}
 
 	for _, stmt := range tables {
@@ -116,11 +416,87 @@ func New(db *sql.DB) (AppDatabase, error) {
 	}
 
 	// Migrations
+	_, _ = db.Exec("ALTER TABLE users ADD COLUMN deactivated_at DATETIME")
+	_, _ = db.Exec("ALTER TABLE users ADD COLUMN deleted_at DATETIME")
+	if err := migrateUserNames(db); err != nil {
+		return nil, fmt.Errorf("error migrating user names: %w", err)
+	}
+	_, _ = db.Exec("ALTER TABLE users ADD COLUMN placeholder_of INTEGER REFERENCES users(id)")
+	// Placeholder and deleted users don't take names: the index is rebuilt on databases created before deleted users
+	var nameIndex string
+	_ = db.QueryRow("SELECT sql FROM sqlite_master WHERE type = 'index' AND name = 'users_name'").Scan(&nameIndex)
+	if nameIndex != "" && !strings.Contains(nameIndex, "deleted_at") {
+		if _, err := db.Exec("DROP INDEX users_name"); err != nil {
+			return nil, fmt.Errorf("error dropping user name index: %w", err)
+		}
+	}
+	if _, err := db.Exec("CREATE UNIQUE INDEX IF NOT EXISTS users_name ON users (name) WHERE deleted_at IS NULL AND placeholder_of IS NULL"); err != nil {
+		return nil, fmt.Errorf("error creating user name index: %w", err)
+	}
+	if _, err := db.Exec("CREATE UNIQUE INDEX IF NOT EXISTS users_placeholder ON users (placeholder_of, name) WHERE placeholder_of IS NOT NULL"); err != nil {
+		return nil, fmt.Errorf("error creating placeholder user index: %w", err)
+	}
 	_, _ = db.Exec("ALTER TABLE messages ADD COLUMN is_deleted BOOLEAN NOT NULL DEFAULT 0")
 	_, _ = db.Exec("ALTER TABLE conversations ADD COLUMN last_message_at DATETIME")
 	_, _ = db.Exec("ALTER TABLE participants ADD COLUMN last_read_at DATETIME")
+	_, _ = db.Exec("ALTER TABLE conversations ADD COLUMN description TEXT NOT NULL DEFAULT ''")
+	_, _ = db.Exec("ALTER TABLE conversations ADD COLUMN only_admins_edit_info BOOLEAN NOT NULL DEFAULT 1")
+	_, _ = db.Exec("ALTER TABLE conversations ADD COLUMN only_admins_add_members BOOLEAN NOT NULL DEFAULT 1")
+	_, _ = db.Exec("ALTER TABLE conversations ADD COLUMN only_admins_send BOOLEAN NOT NULL DEFAULT 0")
+	_, _ = db.Exec("ALTER TABLE conversations ADD COLUMN slow_mode_seconds INTEGER NOT NULL DEFAULT 0")
+	_, _ = db.Exec("ALTER TABLE conversations ADD COLUMN is_channel BOOLEAN NOT NULL DEFAULT 0")
+	_, _ = db.Exec("ALTER TABLE conversations ADD COLUMN community_id INTEGER REFERENCES communities(id)")
+	_, _ = db.Exec("ALTER TABLE conversations ADD COLUMN community_listed BOOLEAN NOT NULL DEFAULT 0")
+	_, _ = db.Exec("ALTER TABLE conversations ADD COLUMN saved_by INTEGER REFERENCES users(id)")
+	_, _ = db.Exec("CREATE UNIQUE INDEX IF NOT EXISTS conversations_saved_by ON conversations (saved_by) WHERE saved_by IS NOT NULL")
+	_, _ = db.Exec("ALTER TABLE conversations ADD COLUMN import_key TEXT")
+	_, _ = db.Exec("CREATE UNIQUE INDEX IF NOT EXISTS conversations_import_key ON conversations (import_key) WHERE import_key IS NOT NULL")
+	_, _ = db.Exec("ALTER TABLE messages ADD COLUMN import_key TEXT")
+	_, _ = db.Exec("CREATE UNIQUE INDEX IF NOT EXISTS messages_import_key ON messages (import_key) WHERE import_key IS NOT NULL")
+	_, _ = db.Exec("ALTER TABLE participants ADD COLUMN role TEXT NOT NULL DEFAULT 'member'")
+	_, _ = db.Exec("ALTER TABLE participants ADD COLUMN joined_at DATETIME")
+	_, _ = db.Exec("ALTER TABLE participants ADD COLUMN archived BOOLEAN NOT NULL DEFAULT 0")
+	_, _ = db.Exec("ALTER TABLE participants ADD COLUMN muted BOOLEAN NOT NULL DEFAULT 0")
+	_, _ = db.Exec("ALTER TABLE participants ADD COLUMN muted_until DATETIME")
+	_, _ = db.Exec("ALTER TABLE participants ADD COLUMN pinned_at DATETIME")
+	_, _ = db.Exec("ALTER TABLE participants ADD COLUMN request_from INTEGER REFERENCES users(id)")
+	_, _ = db.Exec("ALTER TABLE participants ADD COLUMN cleared_at DATETIME")
+	_, _ = db.Exec("ALTER TABLE participants ADD COLUMN hidden BOOLEAN NOT NULL DEFAULT 0")
+	_, _ = db.Exec("ALTER TABLE media ADD COLUMN blob_hash TEXT REFERENCES media_blobs(hash)")
+	if _, err := db.Exec("ALTER TABLE media ADD COLUMN ref_count INTEGER NOT NULL DEFAULT 0"); err == nil {
+		// Media created before reference counting are counted once, with what uses them now
+		_, _ = db.Exec(`
+			UPDATE media SET ref_count =
+				(SELECT COUNT(*) FROM messages WHERE content = '/media/' || media.id AND content_type = 'photo' AND is_deleted = 0)
+				+ (SELECT COUNT(*) FROM users WHERE photo_url = '/media/' || media.id)
+				+ (SELECT COUNT(*) FROM conversations WHERE photo_url = '/media/' || media.id)
+		`)
+	}
 	_, _ = db.Exec("UPDATE messages SET status = 1 WHERE status = 0")
 
+	// Groups created before roles have no owner: the creator is unknown, so the longest-standing member becomes the
+	// owner
+	_, _ = db.Exec(`
+		UPDATE participants SET role = 'owner'
+		WHERE rowid IN (
+			SELECT MIN(p.rowid)
+			FROM participants p
+			JOIN conversations c ON c.id = p.conversation_id
+			WHERE c.is_group = 1
+			GROUP BY p.conversation_id
+			HAVING SUM(p.role = 'owner') = 0
+		)
+	`)
+
+	// The audit log starts with the membership history recorded before it existed
+	_, _ = db.Exec(`
+		INSERT INTO group_audit (group_id, actor_id, action, target_id, new_value, created_at)
+		SELECT group_id, actor_id, action, user_id, invite_token, created_at
+		FROM membership_history
+		WHERE NOT EXISTS (SELECT 1 FROM group_audit)
+		ORDER BY id
+	`)
+
 	// Cleanup duplicate 1-on-1 conversations
 	_, _ = db.Exec(`
 		DELETE FROM conversations
@@ -145,29 +521,340 @@ func New(db *sql.DB) (AppDatabase, error) {
 	}, nil
 }
 
+// migrateUserNames rebuilds the users table of databases where names are unique among all the users: placeholder users
+// of different owners may have the same name, and deleted users are all named DeletedAccountName, so names are now only
+// unique among the others (see the users_name index). SQLite can't drop a constraint, so the table is copied.
+func migrateUserNames(db *sql.DB) error {
+	var schema string
+	err := db.QueryRow("SELECT sql FROM sqlite_master WHERE type = 'table' AND name = 'users'").Scan(&schema)
+	if err != nil || !strings.Contains(schema, "UNIQUE") {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	// Foreign keys are not enforced, so the references to users survive the drop
+	for _, stmt := range []string{
+		`CREATE TABLE users_new (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			name TEXT NOT NULL,
+			photo_url TEXT,
+			deactivated_at DATETIME,
+			deleted_at DATETIME
+		)`,
+		"INSERT INTO users_new (id, name, photo_url, deactivated_at, deleted_at) SELECT id, name, photo_url, deactivated_at, deleted_at FROM users",
+		"DROP TABLE users",
+		"ALTER TABLE users_new RENAME TO users",
+	} {
+		if _, err := tx.Exec(stmt); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
 func (db *appdbimpl) Ping() error {
 	return db.c.Ping()
 }
 
 // Models
 
+// Roles of the members of a group. The owner has all the rights of the admins.
+const (
+	RoleOwner  = "owner"
+	RoleAdmin  = "admin"
+	RoleMember = "member"
+)
+
 type User struct {
 	ID       int64  `json:"id"`
 	Name     string `json:"name"`
 	PhotoURL string `json:"photoUrl"`
+	Role     string `json:"role,omitempty"`
+
+	// Deactivated is only set by GetUser and GetUserByName
+	Deactivated bool `json:"-"`
+}
+
+// DeletedAccountName is the name of all the deleted users. No other user can have it.
+const DeletedAccountName = "Deleted account"
+
+// Session is a login of a user. Logins are recorded since the sessions table exists: older ones are unknown.
+type Session struct {
+	CreatedAt time.Time `json:"createdAt"`
+	UserAgent string    `json:"userAgent"`
+	// NewUser is true for the login that created the user
+	NewUser bool `json:"newUser"`
+}
+
+// Actions recorded in the membership history of a group
+const (
+	MembershipCreated = "created"
+	MembershipAdded   = "added"
+	MembershipJoined  = "joined"
+	MembershipLeft    = "left"
+	MembershipRemoved = "removed"
+)
+
+// Actions recorded in the audit log of a group, besides the membership actions
+const (
+	AuditNameChanged          = "name_changed"
+	AuditDescriptionChanged   = "description_changed"
+	AuditPhotoChanged         = "photo_changed"
+	AuditSettingsChanged      = "settings_changed"
+	AuditRoleChanged          = "role_changed"
+	AuditOwnershipTransferred = "ownership_transferred"
+	AuditBanned               = "banned"
+	AuditUnbanned             = "unbanned"
+	AuditInviteCreated        = "invite_created"
+	AuditInviteRevoked        = "invite_revoked"
+	AuditRequestRejected      = "request_rejected"
+)
+
+// ErrInviteNotUsable is returned when joining with an invite link that is revoked, expired or used up.
+var ErrInviteNotUsable = errors.New("invite link not usable")
+
+// ErrAlreadyMember is returned when joining a group the user is already a member of.
+var ErrAlreadyMember = errors.New("already a member")
+
+// ErrBanned is returned when a banned user tries to join a group.
+var ErrBanned = errors.New("banned from the group")
+
+// ErrApprovalRequired is returned when joining with an invite link that requires the approval of an admin.
+var ErrApprovalRequired = errors.New("approval required")
+
+// ErrRequestDecided is returned when approving or rejecting a join request that is no longer pending.
+var ErrRequestDecided = errors.New("join request already decided")
+
+// Statuses of a join request
+const (
+	RequestPending  = "pending"
+	RequestApproved = "approved"
+	RequestRejected = "rejected"
+)
+
+// JoinRequest is a request of a user to join a group, waiting for the decision of an admin.
+type JoinRequest struct {
+	ID          int64     `json:"requestId"`
+	GroupId     int64     `json:"groupId"`
+	UserId      int64     `json:"userId"`
+	UserName    string    `json:"userName"`
+	InviteToken string    `json:"inviteToken,omitempty"`
+	Message     string    `json:"message"`
+	Status      string    `json:"status"`
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
+// Types of notifications
+const (
+	NotificationJoinApproved = "join_request_approved"
+	NotificationJoinRejected = "join_request_rejected"
+)
+
+// Notification tells a user about something that happened outside their conversations. The payload depends on the
+// type.
+type Notification struct {
+	ID        int64           `json:"notificationId"`
+	Type      string          `json:"type"`
+	Payload   json.RawMessage `json:"payload"`
+	CreatedAt time.Time       `json:"createdAt"`
+	Read      bool            `json:"read"`
+}
+
+// Invite is a link that lets users join a group. Links without ExpiresAt never expire, and links with MaxUses 0 can be
+// used any number of times.
+type Invite struct {
+	Token            string     `json:"token"`
+	GroupId          int64      `json:"groupId"`
+	CreatedBy        int64      `json:"createdBy"`
+	CreatedAt        time.Time  `json:"createdAt"`
+	ExpiresAt        *time.Time `json:"expiresAt,omitempty"`
+	MaxUses          int        `json:"maxUses"`
+	Uses             int        `json:"uses"`
+	RequiresApproval bool       `json:"requiresApproval"`
+	Revoked          bool       `json:"revoked"`
+}
+
+// Usable reports whether the invite can still be used to join the group.
+func (i Invite) Usable(now time.Time) bool {
+	if i.Revoked || (i.MaxUses > 0 && i.Uses >= i.MaxUses) {
+		return false
+	}
+	return i.ExpiresAt == nil || now.Before(*i.ExpiresAt)
+}
+
+// Ban is a user who cannot be added back to a group.
+type Ban struct {
+	UserId    int64     `json:"userId"`
+	Name      string    `json:"name"`
+	BannedBy  int64     `json:"bannedBy"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// GroupSettings control what members who are not admins can do in a group.
+type GroupSettings struct {
+	OnlyAdminsEditInfo   bool `json:"onlyAdminsEditInfo"`
+	OnlyAdminsAddMembers bool `json:"onlyAdminsAddMembers"`
+	OnlyAdminsSend       bool `json:"onlyAdminsSend"`
+	SlowModeSeconds      int  `json:"slowModeSeconds"`
+}
+
+// GroupProfile is the information about a group shown to its members.
+type GroupProfile struct {
+	ID          int64         `json:"groupId"`
+	IsChannel   bool          `json:"isChannel"`
+	Name        string        `json:"name"`
+	Description string        `json:"description"`
+	PhotoURL    string        `json:"photoUrl"`
+	MemberCount int           `json:"memberCount"`
+	Settings    GroupSettings `json:"settings"`
+}
+
+// GroupUpdate is a partial update of a group profile: nil fields are left unchanged.
+type GroupUpdate struct {
+	Name                 *string
+	Description          *string
+	OnlyAdminsEditInfo   *bool
+	OnlyAdminsAddMembers *bool
+	OnlyAdminsSend       *bool
+	SlowModeSeconds      *int
+}
+
+// AuditEntry is a change to the members or the settings of a group. TargetId is the member affected by the change,
+// if any.
+type AuditEntry struct {
+	ID         int64     `json:"id"`
+	ActorId    int64     `json:"actorId"`
+	ActorName  string    `json:"actorName"`
+	Action     string    `json:"action"`
+	TargetId   *int64    `json:"targetId,omitempty"`
+	TargetName string    `json:"targetName,omitempty"`
+	OldValue   string    `json:"oldValue,omitempty"`
+	NewValue   string    `json:"newValue,omitempty"`
+	CreatedAt  time.Time `json:"createdAt"`
+}
+
+// AuditFilter selects a page of the audit log, newest first. Zero values don't filter.
+type AuditFilter struct {
+	Action  string
+	ActorId int64
+	// Before is the ID of the last entry of the previous page
+	Before int64
+	Limit  int
+}
+
+// ConversationFilter restricts the conversations returned by GetConversations. Nil fields don't filter.
+type ConversationFilter struct {
+	CommunityId *int64
+	Folder      *Folder
+	// Archived selects the archived conversations instead of the others
+	Archived bool
+	// Requests selects the message requests the user has not accepted yet instead of the other conversations
+	Requests bool
+	// AnyState selects the conversations whether they are archived or message requests, ignoring Archived and Requests
+	AnyState bool
+}
+
+// Folder is a user-defined selection of conversations. A conversation is in the folder if it is one of
+// ConversationIds or, with IncludeGroups, a group; ExcludeMuted and OnlyUnread then narrow the selection. Archived
+// conversations stay in their folders, while message requests are only in the folders listing them.
+type Folder struct {
+	ID              int64   `json:"folderId"`
+	UserId          int64   `json:"-"`
+	Name            string  `json:"name"`
+	ConversationIds []int64 `json:"conversationIds"`
+	IncludeGroups   bool    `json:"includeGroups"`
+	ExcludeMuted    bool    `json:"excludeMuted"`
+	OnlyUnread      bool    `json:"onlyUnread"`
+	// UnreadCount is the number of unread messages in the conversations of the folder
+	UnreadCount int `json:"unreadCount"`
+}
+
+// Matches reports whether the conversation is in the folder.
+func (f Folder) Matches(c Conversation) bool {
+	included := f.IncludeGroups && c.IsGroup && c.RequestFrom == nil
+	for _, id := range f.ConversationIds {
+		if id == c.ID {
+			included = true
+		}
+	}
+	if !included {
+		return false
+	}
+	if f.ExcludeMuted && c.Muted {
+		return false
+	}
+	return !f.OnlyUnread || c.UnreadCount > 0
+}
+
+// Community groups several related group conversations, with an announcement channel for all its members. Community
+// admins are admins of all its groups.
+type Community struct {
+	ID                    int64     `json:"communityId"`
+	Name                  string    `json:"name"`
+	Description           string    `json:"description"`
+	AnnouncementChannelId int64     `json:"announcementChannelId"`
+	MemberCount           int       `json:"memberCount"`
+	GroupCount            int       `json:"groupCount"`
+	CreatedAt             time.Time `json:"createdAt"`
+}
+
+// CommunityGroup is a group of a community, as shown to a community member. Listed groups can be joined by all the
+// community members.
+type CommunityGroup struct {
+	GroupProfile
+	Listed bool `json:"listed"`
+	Joined bool `json:"joined"`
 }
 
 type Conversation struct {
 	ID                    int64     `json:"conversationId"`
 	Name                  string    `json:"name"`
 	IsGroup               bool      `json:"isGroup"`
+	IsChannel             bool      `json:"isChannel"`
+	IsSaved               bool      `json:"isSaved"`
+	CommunityId           *int64    `json:"communityId,omitempty"`
 	PhotoURL              string    `json:"photoUrl"`
+	PeerId                int64     `json:"peerId,omitempty"`
 	LastMessageAt         time.Time `json:"latestMessageTime"`
 	LatestMessagePreview  string    `json:"latestMessagePreview"`
 	LatestMessageStatus   int       `json:"latestMessageStatus"`
 	LatestMessageSenderId int64     `json:"latestMessageSenderId"`
+	LatestMessageType     string    `json:"latestMessageType"`
 	LatestMessageDeleted  bool      `json:"latestMessageDeleted"`
 	UnreadCount           int       `json:"unreadCount"`
+	// Archived, Muted and Pinned are the choices of the user the conversation list belongs to
+	Archived   bool       `json:"archived"`
+	Muted      bool       `json:"muted"`
+	MutedUntil *time.Time `json:"mutedUntil,omitempty"`
+	Pinned     bool       `json:"pinned"`
+	// RequestFrom is the user who sent the message request, until the user accepts it
+	RequestFrom *int64 `json:"requestFrom,omitempty"`
+}
+
+// ChatImport is a conversation imported from another app. ConversationId is the group the chat is imported into, or 0
+// to find the 1-on-1 conversation of the members or the group created by a previous import with the same Key, or to
+// create a new conversation.
+type ChatImport struct {
+	ConversationId int64
+	Key            string
+	Name           string
+	IsGroup        bool
+	OwnerId        int64
+	Members        []int64
+}
+
+// ImportedMessage is a message imported from another app. Key identifies the message in its conversation, so that
+// importing it again doesn't add it twice.
+type ImportedMessage struct {
+	Key         string
+	SenderId    int64
+	Content     string
+	ContentType string
+	CreatedAt   time.Time
 }
 
 type Message struct {
@@ -190,3 +877,88 @@ type Reaction struct {
 	ReactorName string `json:"reactorName"`
 	Emoticon    string `json:"emoticon"`
 }
+
+// Media is a reference to an uploaded file. Media with a ConversationId can only be read by the participants of that
+// conversation, media without one (e.g., user avatars) is public.
+// The content is stored once per BlobHash: many media objects may reference the same blob.
+type Media struct {
+	ID             string    `json:"mediaId"`
+	ConversationId *int64    `json:"conversationId"`
+	UploaderId     int64     `json:"uploaderId"`
+	BlobHash       string    `json:"-"`
+	Size           int64     `json:"size"`
+	MimeType       string    `json:"mimeType"`
+	CreatedAt      time.Time `json:"createdAt"`
+
+	// Filename is set only for media uploaded before content-addressed storage, until it's migrated to a blob
+	Filename string `json:"-"`
+
+	// RefCount is the number of messages and photos using the media, set by CreateMedia. Messages add their reference
+	// when they are sent, so media created for a message starts with none.
+	RefCount int64 `json:"-"`
+}
+
+// Statuses of a takeout
+const (
+	TakeoutPending = "pending"
+	TakeoutReady   = "ready"
+	TakeoutFailed  = "failed"
+)
+
+// Takeout is an archive of all the data about a user, built in the background. Once ready, it can be downloaded until
+// ExpiresAt.
+type Takeout struct {
+	ID          string     `json:"exportId"`
+	UserId      int64      `json:"-"`
+	Status      string     `json:"status"`
+	Size        int64      `json:"size"`
+	CreatedAt   time.Time  `json:"createdAt"`
+	CompletedAt *time.Time `json:"completedAt,omitempty"`
+	ExpiresAt   *time.Time `json:"expiresAt,omitempty"`
+}
+
+// Membership is a conversation a user is in, with the settings of the user for it. The name of 1-on-1 conversations is
+// the name of the other participant.
+type Membership struct {
+	ConversationId int64      `json:"conversationId"`
+	Name           string     `json:"name"`
+	IsGroup        bool       `json:"isGroup"`
+	IsChannel      bool       `json:"isChannel"`
+	IsSaved        bool       `json:"isSaved"`
+	Role           string     `json:"role"`
+	JoinedAt       *time.Time `json:"joinedAt,omitempty"`
+	Archived       bool       `json:"archived"`
+	Muted          bool       `json:"muted"`
+	Pinned         bool       `json:"pinned"`
+	// Request is true for message requests the user has not accepted yet
+	Request bool `json:"request"`
+	// Hidden is true for conversations the user deleted, and ClearedAt is when the user last cleared the history
+	Hidden    bool       `json:"hidden"`
+	ClearedAt *time.Time `json:"clearedAt,omitempty"`
+}
+
+// GivenReaction is a reaction left by a user.
+type GivenReaction struct {
+	MessageId      int64  `json:"messageId"`
+	ConversationId int64  `json:"conversationId"`
+	Emoticon       string `json:"emoticon"`
+}
+
+// Upload is a resumable upload. Once all the Length bytes are received, the content is moved to the blob BlobHash,
+// and it can be attached to messages or used as a photo until the upload expires.
+type Upload struct {
+	ID        string    `json:"uploadId"`
+	UserId    int64     `json:"userId"`
+	Length    int64     `json:"length"`
+	Offset    int64     `json:"offset"`
+	Metadata  string    `json:"metadata"`
+	BlobHash  string    `json:"-"`
+	MimeType  string    `json:"mimeType"`
+	CreatedAt time.Time `json:"createdAt"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// Completed returns true if the whole content has been received.
+func (u Upload) Completed() bool {
+	return u.BlobHash != ""
+}
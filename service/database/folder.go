@@ -0,0 +1,183 @@
+package database
+
+import (
+	"database/sql"
+)
+
+func (db *appdbimpl) CreateFolder(f Folder) (Folder, error) {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return f, err
+	}
+
+	res, err := tx.Exec(`
+		INSERT INTO folders (user_id, name, include_groups, exclude_muted, only_unread) VALUES (?, ?, ?, ?, ?)
+	`, f.UserId, f.Name, f.IncludeGroups, f.ExcludeMuted, f.OnlyUnread)
+	if err != nil {
+		_ = tx.Rollback()
+		return f, err
+	}
+	f.ID, err = res.LastInsertId()
+	if err != nil {
+		_ = tx.Rollback()
+		return f, err
+	}
+
+	err = setFolderConversations(tx, f.ID, f.ConversationIds)
+	if err != nil {
+		_ = tx.Rollback()
+		return f, err
+	}
+
+	return f, tx.Commit()
+}
+
+// setFolderConversations replaces the conversations explicitly included in the folder.
+func setFolderConversations(tx *sql.Tx, folderId int64, conversationIds []int64) error {
+	_, err := tx.Exec("DELETE FROM folder_conversations WHERE folder_id = ?", folderId)
+	if err != nil {
+		return err
+	}
+	for _, id := range conversationIds {
+		_, err = tx.Exec(`
+			INSERT INTO folder_conversations (folder_id, conversation_id) VALUES (?, ?)
+			ON CONFLICT (folder_id, conversation_id) DO NOTHING
+		`, folderId, id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetFolder returns the folder of the user, or sql.ErrNoRows if the user has no such folder.
+func (db *appdbimpl) GetFolder(id int64, userId int64) (Folder, error) {
+	f := Folder{UserId: userId}
+	err := db.c.QueryRow(`
+		SELECT id, name, include_groups, exclude_muted, only_unread
+		FROM folders
+		WHERE id = ? AND user_id = ?
+	`, id, userId).Scan(&f.ID, &f.Name, &f.IncludeGroups, &f.ExcludeMuted, &f.OnlyUnread)
+	if err != nil {
+		return f, err
+	}
+
+	f.ConversationIds, err = db.getFolderConversations(f.ID)
+	return f, err
+}
+
+// GetFolders returns the folders of the user, in creation order.
+func (db *appdbimpl) GetFolders(userId int64) ([]Folder, error) {
+	rows, err := db.c.Query(`
+		SELECT id, name, include_groups, exclude_muted, only_unread
+		FROM folders
+		WHERE user_id = ?
+		ORDER BY id
+	`, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var folders []Folder
+	for rows.Next() {
+		f := Folder{UserId: userId}
+		if err := rows.Scan(&f.ID, &f.Name, &f.IncludeGroups, &f.ExcludeMuted, &f.OnlyUnread); err != nil {
+			return nil, err
+		}
+		folders = append(folders, f)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// The database has a single connection: the conversations are read once the folders are
+	for i := range folders {
+		folders[i].ConversationIds, err = db.getFolderConversations(folders[i].ID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return folders, nil
+}
+
+func (db *appdbimpl) getFolderConversations(folderId int64) ([]int64, error) {
+	rows, err := db.c.Query("SELECT conversation_id FROM folder_conversations WHERE folder_id = ? ORDER BY conversation_id", folderId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := []int64{}
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// UpdateFolder replaces the name, the rules and the conversations of the folder. It returns sql.ErrNoRows if the user
+// has no such folder.
+func (db *appdbimpl) UpdateFolder(f Folder) error {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return err
+	}
+
+	res, err := tx.Exec(`
+		UPDATE folders SET name = ?, include_groups = ?, exclude_muted = ?, only_unread = ?
+		WHERE id = ? AND user_id = ?
+	`, f.Name, f.IncludeGroups, f.ExcludeMuted, f.OnlyUnread, f.ID, f.UserId)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		_ = tx.Rollback()
+		if err != nil {
+			return err
+		}
+		return sql.ErrNoRows
+	}
+
+	err = setFolderConversations(tx, f.ID, f.ConversationIds)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// DeleteFolder deletes the folder of the user; the conversations are not affected. It returns sql.ErrNoRows if the
+// user has no such folder.
+func (db *appdbimpl) DeleteFolder(id int64, userId int64) error {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return err
+	}
+
+	res, err := tx.Exec("DELETE FROM folders WHERE id = ? AND user_id = ?", id, userId)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		_ = tx.Rollback()
+		if err != nil {
+			return err
+		}
+		return sql.ErrNoRows
+	}
+
+	_, err = tx.Exec("DELETE FROM folder_conversations WHERE folder_id = ?", id)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
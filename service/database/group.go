@@ -1,21 +1,476 @@
 package database
 
-func (db *appdbimpl) SetGroupName(id int64, name string) error {
-	_, err := db.c.Exec("UPDATE conversations SET name = ? WHERE id = ? AND is_group = 1", name, id)
-	return err
+import (
+	"database/sql"
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// SetGroupName renames the group on behalf of actorId.
+func (db *appdbimpl) SetGroupName(id int64, name string, actorId int64) error {
+	return db.UpdateGroup(id, GroupUpdate{Name: &name}, actorId)
 }
 
-func (db *appdbimpl) SetGroupPhoto(id int64, photoURL string) error {
-	_, err := db.c.Exec("UPDATE conversations SET photo_url = ? WHERE id = ? AND is_group = 1", photoURL, id)
-	return err
+// SetGroupPhoto changes the photo of the group on behalf of actorId. An actorId of 0 changes the photo without
+// recording it in the audit log, for migrations.
+func (db *appdbimpl) SetGroupPhoto(id int64, photoURL string, actorId int64) error {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return err
+	}
+
+	var oldURL string
+	err = tx.QueryRow("SELECT IFNULL(photo_url, '') FROM conversations WHERE id = ? AND is_group = 1", id).Scan(&oldURL)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	_, err = tx.Exec("UPDATE conversations SET photo_url = ? WHERE id = ?", photoURL, id)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	// Photo URLs are internal references, only the change is recorded
+	if actorId != 0 && photoURL != oldURL {
+		err = recordAudit(tx, id, actorId, AuditPhotoChanged, 0, "", "")
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
 }
 
-func (db *appdbimpl) AddMember(groupId int64, userId int64) error {
-	_, err := db.c.Exec("INSERT INTO participants (conversation_id, user_id) VALUES (?, ?)", groupId, userId)
-	return err
+// GetGroupProfile returns the profile of the group, or sql.ErrNoRows if there is no such group.
+func (db *appdbimpl) GetGroupProfile(id int64) (GroupProfile, error) {
+	var g GroupProfile
+	err := db.c.QueryRow(`
+		SELECT c.id, c.is_channel, IFNULL(c.name, ''), c.description, IFNULL(c.photo_url, ''),
+			(SELECT COUNT(*) FROM participants WHERE conversation_id = c.id),
+			c.only_admins_edit_info, c.only_admins_add_members, c.only_admins_send, c.slow_mode_seconds
+		FROM conversations c
+		WHERE c.id = ? AND c.is_group = 1
+	`, id).Scan(&g.ID, &g.IsChannel, &g.Name, &g.Description, &g.PhotoURL, &g.MemberCount,
+		&g.Settings.OnlyAdminsEditInfo, &g.Settings.OnlyAdminsAddMembers, &g.Settings.OnlyAdminsSend,
+		&g.Settings.SlowModeSeconds)
+	return g, err
+}
+
+// UpdateGroup changes the non-nil fields of u in the group profile on behalf of actorId, and records the changed
+// values in the audit log. It returns sql.ErrNoRows if there is no such group.
+func (db *appdbimpl) UpdateGroup(id int64, u GroupUpdate, actorId int64) error {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return err
+	}
+
+	var name, description string
+	var settings GroupSettings
+	err = tx.QueryRow(`
+		SELECT IFNULL(name, ''), description, only_admins_edit_info, only_admins_add_members, only_admins_send,
+			slow_mode_seconds
+		FROM conversations
+		WHERE id = ? AND is_group = 1
+	`, id).Scan(&name, &description, &settings.OnlyAdminsEditInfo, &settings.OnlyAdminsAddMembers,
+		&settings.OnlyAdminsSend, &settings.SlowModeSeconds)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	var sets []string
+	var args []interface{}
+	add := func(column string, value interface{}) {
+		sets = append(sets, column+" = ?")
+		args = append(args, value)
+	}
+	// The changed settings are recorded together, keyed by their JSON name
+	oldSettings := make(map[string]interface{})
+	newSettings := make(map[string]interface{})
+	setting := func(column string, key string, old interface{}, value interface{}) {
+		add(column, value)
+		if old != value {
+			oldSettings[key] = old
+			newSettings[key] = value
+		}
+	}
+	if u.Name != nil {
+		add("name", *u.Name)
+	}
+	if u.Description != nil {
+		add("description", *u.Description)
+	}
+	if u.OnlyAdminsEditInfo != nil {
+		setting("only_admins_edit_info", "onlyAdminsEditInfo", settings.OnlyAdminsEditInfo, *u.OnlyAdminsEditInfo)
+	}
+	if u.OnlyAdminsAddMembers != nil {
+		setting("only_admins_add_members", "onlyAdminsAddMembers", settings.OnlyAdminsAddMembers, *u.OnlyAdminsAddMembers)
+	}
+	if u.OnlyAdminsSend != nil {
+		setting("only_admins_send", "onlyAdminsSend", settings.OnlyAdminsSend, *u.OnlyAdminsSend)
+	}
+	if u.SlowModeSeconds != nil {
+		setting("slow_mode_seconds", "slowModeSeconds", settings.SlowModeSeconds, *u.SlowModeSeconds)
+	}
+	if len(sets) == 0 {
+		_ = tx.Rollback()
+		return nil
+	}
+
+	args = append(args, id)
+	_, err = tx.Exec("UPDATE conversations SET "+strings.Join(sets, ", ")+" WHERE id = ?", args...)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	if u.Name != nil && *u.Name != name {
+		err = recordAudit(tx, id, actorId, AuditNameChanged, 0, name, *u.Name)
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+	if u.Description != nil && *u.Description != description {
+		err = recordAudit(tx, id, actorId, AuditDescriptionChanged, 0, description, *u.Description)
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+	if len(newSettings) > 0 {
+		oldValue, err := json.Marshal(oldSettings)
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+		newValue, err := json.Marshal(newSettings)
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+		err = recordAudit(tx, id, actorId, AuditSettingsChanged, 0, string(oldValue), string(newValue))
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// recordMembership adds an entry to the membership history and to the audit log of the group. inviteToken is the
+// invite link used to join, if any.
+func recordMembership(tx *sql.Tx, groupId int64, userId int64, actorId int64, action string, inviteToken string) error {
+	_, err := tx.Exec(`
+		INSERT INTO membership_history (group_id, user_id, actor_id, action, invite_token, created_at)
+		VALUES (?, ?, ?, ?, NULLIF(?, ''), ?)
+	`, groupId, userId, actorId, action, inviteToken, time.Now())
+	if err != nil {
+		return err
+	}
+	return recordAudit(tx, groupId, actorId, action, userId, "", inviteToken)
+}
+
+// AddMember adds the user to the group on behalf of actorId: the user joins the group if actorId is the user itself.
+// Users added by someone they don't know receive the group as a message request.
+func (db *appdbimpl) AddMember(groupId int64, userId int64, actorId int64) error {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return err
+	}
+
+	known, err := knows(tx, userId, actorId)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	var requestFrom sql.NullInt64
+	if !known {
+		requestFrom = sql.NullInt64{Int64: actorId, Valid: true}
+	}
+
+	_, err = tx.Exec("INSERT INTO participants (conversation_id, user_id, role, joined_at, request_from) VALUES (?, ?, ?, ?, ?)",
+		groupId, userId, RoleMember, time.Now(), requestFrom)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	action := MembershipAdded
+	if actorId == userId {
+		action = MembershipJoined
+	}
+	err = recordMembership(tx, groupId, userId, actorId, action, "")
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// RemoveMember removes the user from the group on behalf of actorId: the user leaves the group if actorId is the user
+// itself. If the user is the owner, the ownership passes to the longest-standing admin or, if there are no admins, to
+// the longest-standing member.
+func (db *appdbimpl) RemoveMember(groupId int64, userId int64, actorId int64) error {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return err
+	}
+
+	err = removeParticipant(tx, groupId, userId, actorId)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
 }
 
-func (db *appdbimpl) RemoveMember(groupId int64, userId int64) error {
-	_, err := db.c.Exec("DELETE FROM participants WHERE conversation_id = ? AND user_id = ?", groupId, userId)
+// removeParticipant is RemoveMember within a transaction. It returns sql.ErrNoRows if the user is not a member.
+func removeParticipant(tx *sql.Tx, groupId int64, userId int64, actorId int64) error {
+	var role string
+	err := tx.QueryRow("SELECT role FROM participants WHERE conversation_id = ? AND user_id = ?", groupId, userId).Scan(&role)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM participants WHERE conversation_id = ? AND user_id = ?", groupId, userId)
+	if err != nil {
+		return err
+	}
+
+	action := MembershipRemoved
+	if actorId == userId {
+		action = MembershipLeft
+	}
+	err = recordMembership(tx, groupId, userId, actorId, action, "")
+	if err != nil {
+		return err
+	}
+
+	if role == RoleOwner {
+		// Members added before roles have no joined_at: the rowid keeps them in insertion order
+		_, err = tx.Exec(`
+			UPDATE participants SET role = ?
+			WHERE rowid = (
+				SELECT rowid FROM participants
+				WHERE conversation_id = ?
+				ORDER BY role = ? DESC, joined_at IS NOT NULL, joined_at, rowid
+				LIMIT 1
+			)
+		`, RoleOwner, groupId, RoleAdmin)
+	}
 	return err
 }
+
+// GetMemberRole returns the role of the user in the group, or sql.ErrNoRows if the user is not a member.
+func (db *appdbimpl) GetMemberRole(groupId int64, userId int64) (string, error) {
+	var role string
+	err := db.c.QueryRow("SELECT role FROM participants WHERE conversation_id = ? AND user_id = ?", groupId, userId).Scan(&role)
+	return role, err
+}
+
+// SetMemberRole changes the role of a member of the group on behalf of actorId. It returns sql.ErrNoRows if the user
+// is not a member.
+func (db *appdbimpl) SetMemberRole(groupId int64, userId int64, role string, actorId int64) error {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return err
+	}
+
+	var oldRole string
+	err = tx.QueryRow("SELECT role FROM participants WHERE conversation_id = ? AND user_id = ?", groupId, userId).Scan(&oldRole)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	if oldRole == role {
+		_ = tx.Rollback()
+		return nil
+	}
+
+	_, err = tx.Exec("UPDATE participants SET role = ? WHERE conversation_id = ? AND user_id = ?", role, groupId, userId)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	err = recordAudit(tx, groupId, actorId, AuditRoleChanged, userId, oldRole, role)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// TransferOwnership makes toId the owner of the group, and the previous owner fromId an admin. It returns
+// sql.ErrNoRows if fromId is not the owner or toId is not a member.
+func (db *appdbimpl) TransferOwnership(groupId int64, fromId int64, toId int64) error {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return err
+	}
+
+	res, err := tx.Exec("UPDATE participants SET role = ? WHERE conversation_id = ? AND user_id = ? AND role = ?",
+		RoleAdmin, groupId, fromId, RoleOwner)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		_ = tx.Rollback()
+		if err != nil {
+			return err
+		}
+		return sql.ErrNoRows
+	}
+
+	res, err = tx.Exec("UPDATE participants SET role = ? WHERE conversation_id = ? AND user_id = ?", RoleOwner, groupId, toId)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		_ = tx.Rollback()
+		if err != nil {
+			return err
+		}
+		return sql.ErrNoRows
+	}
+
+	err = recordAudit(tx, groupId, fromId, AuditOwnershipTransferred, toId, "", "")
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// BanMember prevents the user from being added back to the group, until UnbanMember is called. It doesn't remove the
+// user from the group.
+func (db *appdbimpl) BanMember(groupId int64, userId int64, bannedBy int64) error {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return err
+	}
+
+	res, err := tx.Exec(`
+		INSERT INTO group_bans (group_id, user_id, banned_by, created_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT (group_id, user_id) DO NOTHING
+	`, groupId, userId, bannedBy, time.Now())
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		_ = tx.Rollback()
+		return err
+	} else if n > 0 {
+		err = recordAudit(tx, groupId, bannedBy, AuditBanned, userId, "", "")
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// UnbanMember lifts the ban of the user on behalf of actorId. It returns sql.ErrNoRows if the user is not banned.
+func (db *appdbimpl) UnbanMember(groupId int64, userId int64, actorId int64) error {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return err
+	}
+
+	res, err := tx.Exec("DELETE FROM group_bans WHERE group_id = ? AND user_id = ?", groupId, userId)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	if n == 0 {
+		_ = tx.Rollback()
+		return sql.ErrNoRows
+	}
+
+	err = recordAudit(tx, groupId, actorId, AuditUnbanned, userId, "", "")
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (db *appdbimpl) IsBanned(groupId int64, userId int64) (bool, error) {
+	var count int
+	err := db.c.QueryRow("SELECT COUNT(*) FROM group_bans WHERE group_id = ? AND user_id = ?", groupId, userId).Scan(&count)
+	return count > 0, err
+}
+
+func (db *appdbimpl) GetBans(groupId int64) ([]Ban, error) {
+	rows, err := db.c.Query(`
+		SELECT b.user_id, IFNULL(u.name, ''), b.banned_by, b.created_at
+		FROM group_bans b
+		LEFT JOIN users u ON u.id = b.user_id
+		WHERE b.group_id = ?
+		ORDER BY b.created_at DESC
+	`, groupId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var bans []Ban
+	for rows.Next() {
+		var b Ban
+		if err := rows.Scan(&b.UserId, &b.Name, &b.BannedBy, &b.CreatedAt); err != nil {
+			return nil, err
+		}
+		bans = append(bans, b)
+	}
+	return bans, rows.Err()
+}
+
+func (db *appdbimpl) CountMembers(groupId int64) (int, error) {
+	var count int
+	err := db.c.QueryRow("SELECT COUNT(*) FROM participants WHERE conversation_id = ?", groupId).Scan(&count)
+	return count, err
+}
+
+// GetGroupAdmins returns the owner and the admins of the group.
+func (db *appdbimpl) GetGroupAdmins(groupId int64) ([]User, error) {
+	rows, err := db.c.Query(`
+		SELECT u.id, u.name, IFNULL(u.photo_url, ''), p.role
+		FROM users u
+		JOIN participants p ON u.id = p.user_id
+		WHERE p.conversation_id = ? AND p.role IN (?, ?)
+	`, groupId, RoleOwner, RoleAdmin)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var admins []User
+	for rows.Next() {
+		var u User
+		if err := rows.Scan(&u.ID, &u.Name, &u.PhotoURL, &u.Role); err != nil {
+			return nil, err
+		}
+		admins = append(admins, u)
+	}
+	return admins, rows.Err()
+}
@@ -0,0 +1,175 @@
+package database
+
+import (
+	"database/sql"
+	"time"
+)
+
+const inviteColumns = "token, group_id, created_by, created_at, expires_at, max_uses, uses, requires_approval, revoked"
+
+// scanInvite reads an invite selected with inviteColumns.
+func scanInvite(row interface{ Scan(...any) error }) (Invite, error) {
+	var inv Invite
+	var expiresAt sql.NullTime
+	err := row.Scan(&inv.Token, &inv.GroupId, &inv.CreatedBy, &inv.CreatedAt, &expiresAt, &inv.MaxUses, &inv.Uses,
+		&inv.RequiresApproval, &inv.Revoked)
+	if expiresAt.Valid {
+		inv.ExpiresAt = &expiresAt.Time
+	}
+	return inv, err
+}
+
+func (db *appdbimpl) CreateInvite(inv Invite) error {
+	var expiresAt sql.NullTime
+	if inv.ExpiresAt != nil {
+		expiresAt = sql.NullTime{Time: *inv.ExpiresAt, Valid: true}
+	}
+	tx, err := db.c.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO group_invites (token, group_id, created_by, created_at, expires_at, max_uses, requires_approval)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, inv.Token, inv.GroupId, inv.CreatedBy, inv.CreatedAt, expiresAt, inv.MaxUses, inv.RequiresApproval)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	err = recordAudit(tx, inv.GroupId, inv.CreatedBy, AuditInviteCreated, 0, "", inv.Token)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (db *appdbimpl) GetInvite(token string) (Invite, error) {
+	return scanInvite(db.c.QueryRow("SELECT "+inviteColumns+" FROM group_invites WHERE token = ?", token))
+}
+
+// GetInvites returns all the invite links of the group, including the ones no longer usable.
+func (db *appdbimpl) GetInvites(groupId int64) ([]Invite, error) {
+	rows, err := db.c.Query("SELECT "+inviteColumns+" FROM group_invites WHERE group_id = ? ORDER BY created_at DESC", groupId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var invites []Invite
+	for rows.Next() {
+		inv, err := scanInvite(rows)
+		if err != nil {
+			return nil, err
+		}
+		invites = append(invites, inv)
+	}
+	return invites, rows.Err()
+}
+
+// RevokeInvite makes the invite link of the group unusable on behalf of actorId. It returns sql.ErrNoRows if the group
+// has no such link.
+func (db *appdbimpl) RevokeInvite(groupId int64, token string, actorId int64) error {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return err
+	}
+
+	res, err := tx.Exec("UPDATE group_invites SET revoked = 1 WHERE group_id = ? AND token = ? AND revoked = 0", groupId, token)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	if n == 0 {
+		// Revoking twice is not an error
+		var count int
+		err = tx.QueryRow("SELECT COUNT(*) FROM group_invites WHERE group_id = ? AND token = ?", groupId, token).Scan(&count)
+		_ = tx.Rollback()
+		if err != nil {
+			return err
+		}
+		if count == 0 {
+			return sql.ErrNoRows
+		}
+		return nil
+	}
+
+	err = recordAudit(tx, groupId, actorId, AuditInviteRevoked, 0, token, "")
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// JoinByInvite adds the user to the group of the invite link, and returns the group ID. The join is recorded in the
+// membership history with the invite token. It returns sql.ErrNoRows if the link does not exist, and
+// ErrInviteNotUsable, ErrBanned, ErrAlreadyMember or ErrApprovalRequired if the user cannot join with it.
+func (db *appdbimpl) JoinByInvite(token string, userId int64) (int64, error) {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	inv, err := scanInvite(tx.QueryRow("SELECT "+inviteColumns+" FROM group_invites WHERE token = ?", token))
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+	if !inv.Usable(time.Now()) {
+		_ = tx.Rollback()
+		return inv.GroupId, ErrInviteNotUsable
+	}
+
+	var banned, member int
+	err = tx.QueryRow(`
+		SELECT
+			(SELECT COUNT(*) FROM group_bans WHERE group_id = ? AND user_id = ?),
+			(SELECT COUNT(*) FROM participants WHERE conversation_id = ? AND user_id = ?)
+	`, inv.GroupId, userId, inv.GroupId, userId).Scan(&banned, &member)
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+	switch {
+	case banned > 0:
+		_ = tx.Rollback()
+		return inv.GroupId, ErrBanned
+	case member > 0:
+		_ = tx.Rollback()
+		return inv.GroupId, ErrAlreadyMember
+	case inv.RequiresApproval:
+		_ = tx.Rollback()
+		return inv.GroupId, ErrApprovalRequired
+	}
+
+	_, err = tx.Exec("INSERT INTO participants (conversation_id, user_id, role, joined_at) VALUES (?, ?, ?, ?)",
+		inv.GroupId, userId, RoleMember, time.Now())
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+
+	_, err = tx.Exec("UPDATE group_invites SET uses = uses + 1 WHERE token = ?", token)
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+
+	err = recordMembership(tx, inv.GroupId, userId, userId, MembershipJoined, token)
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+
+	return inv.GroupId, tx.Commit()
+}
@@ -0,0 +1,185 @@
+package database
+
+import (
+	"database/sql"
+	"time"
+)
+
+const joinRequestColumns = `r.id, r.group_id, r.user_id, IFNULL(u.name, ''), IFNULL(r.invite_token, ''), r.message, r.status,
+	r.created_at`
+
+// scanJoinRequest reads a join request selected with joinRequestColumns.
+func scanJoinRequest(row interface{ Scan(...any) error }) (JoinRequest, error) {
+	var jr JoinRequest
+	err := row.Scan(&jr.ID, &jr.GroupId, &jr.UserId, &jr.UserName, &jr.InviteToken, &jr.Message, &jr.Status, &jr.CreatedAt)
+	return jr, err
+}
+
+// CreateJoinRequest records the request of the user to join the group. If the user already has a pending request for
+// the group, that request is returned instead.
+func (db *appdbimpl) CreateJoinRequest(groupId int64, userId int64, inviteToken string, message string) (JoinRequest, error) {
+	_, err := db.c.Exec(`
+		INSERT INTO join_requests (group_id, user_id, invite_token, message, status, created_at)
+		VALUES (?, ?, NULLIF(?, ''), ?, ?, ?)
+		ON CONFLICT (group_id, user_id) WHERE status = 'pending' DO NOTHING
+	`, groupId, userId, inviteToken, message, RequestPending, time.Now())
+	if err != nil {
+		return JoinRequest{}, err
+	}
+
+	return scanJoinRequest(db.c.QueryRow(`
+		SELECT `+joinRequestColumns+`
+		FROM join_requests r
+		LEFT JOIN users u ON u.id = r.user_id
+		WHERE r.group_id = ? AND r.user_id = ? AND r.status = ?
+	`, groupId, userId, RequestPending))
+}
+
+func (db *appdbimpl) GetJoinRequest(id int64) (JoinRequest, error) {
+	return scanJoinRequest(db.c.QueryRow(`
+		SELECT `+joinRequestColumns+`
+		FROM join_requests r
+		LEFT JOIN users u ON u.id = r.user_id
+		WHERE r.id = ?
+	`, id))
+}
+
+// GetPendingJoinRequests returns the requests to join the group waiting for a decision, oldest first.
+func (db *appdbimpl) GetPendingJoinRequests(groupId int64) ([]JoinRequest, error) {
+	rows, err := db.c.Query(`
+		SELECT `+joinRequestColumns+`
+		FROM join_requests r
+		LEFT JOIN users u ON u.id = r.user_id
+		WHERE r.group_id = ? AND r.status = ?
+		ORDER BY r.created_at
+	`, groupId, RequestPending)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var requests []JoinRequest
+	for rows.Next() {
+		jr, err := scanJoinRequest(rows)
+		if err != nil {
+			return nil, err
+		}
+		requests = append(requests, jr)
+	}
+	return requests, rows.Err()
+}
+
+// DecideJoinRequest approves or rejects a pending join request on behalf of deciderId, and notifies the requester of
+// the outcome. Approved users join the group, unless they have been banned in the meantime (ErrBanned) or the invite
+// link of the request can no longer be used (ErrInviteNotUsable). It returns ErrRequestDecided if the request is no
+// longer pending.
+func (db *appdbimpl) DecideJoinRequest(id int64, deciderId int64, approve bool) (JoinRequest, error) {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return JoinRequest{}, err
+	}
+
+	jr, err := scanJoinRequest(tx.QueryRow(`
+		SELECT `+joinRequestColumns+`
+		FROM join_requests r
+		LEFT JOIN users u ON u.id = r.user_id
+		WHERE r.id = ?
+	`, id))
+	if err != nil {
+		_ = tx.Rollback()
+		return jr, err
+	}
+	if jr.Status != RequestPending {
+		_ = tx.Rollback()
+		return jr, ErrRequestDecided
+	}
+
+	jr.Status = RequestRejected
+	notification := NotificationJoinRejected
+	if approve {
+		jr.Status = RequestApproved
+		notification = NotificationJoinApproved
+
+		var banned int
+		err = tx.QueryRow("SELECT COUNT(*) FROM group_bans WHERE group_id = ? AND user_id = ?", jr.GroupId, jr.UserId).Scan(&banned)
+		if err != nil {
+			_ = tx.Rollback()
+			return jr, err
+		}
+		if banned > 0 {
+			_ = tx.Rollback()
+			return jr, ErrBanned
+		}
+
+		// The link might have been revoked, expired or used up since the request was made
+		if jr.InviteToken != "" {
+			inv, err := scanInvite(tx.QueryRow("SELECT "+inviteColumns+" FROM group_invites WHERE token = ?", jr.InviteToken))
+			if err == nil && !inv.Usable(time.Now()) {
+				err = ErrInviteNotUsable
+			}
+			if err != nil {
+				_ = tx.Rollback()
+				return jr, err
+			}
+		}
+
+		// The user might have been added to the group in the meantime
+		res, err := tx.Exec(`
+			INSERT INTO participants (conversation_id, user_id, role, joined_at) VALUES (?, ?, ?, ?)
+			ON CONFLICT (conversation_id, user_id) DO NOTHING
+		`, jr.GroupId, jr.UserId, RoleMember, time.Now())
+		if err != nil {
+			_ = tx.Rollback()
+			return jr, err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			_ = tx.Rollback()
+			return jr, err
+		} else if n > 0 {
+			if jr.InviteToken != "" {
+				_, err = tx.Exec("UPDATE group_invites SET uses = uses + 1 WHERE token = ?", jr.InviteToken)
+				if err != nil {
+					_ = tx.Rollback()
+					return jr, err
+				}
+			}
+			err = recordMembership(tx, jr.GroupId, jr.UserId, deciderId, MembershipJoined, jr.InviteToken)
+			if err != nil {
+				_ = tx.Rollback()
+				return jr, err
+			}
+		}
+	}
+
+	_, err = tx.Exec("UPDATE join_requests SET status = ?, decided_by = ?, decided_at = ? WHERE id = ?",
+		jr.Status, deciderId, time.Now(), id)
+	if err != nil {
+		_ = tx.Rollback()
+		return jr, err
+	}
+	if !approve {
+		err = recordAudit(tx, jr.GroupId, deciderId, AuditRequestRejected, jr.UserId, "", "")
+		if err != nil {
+			_ = tx.Rollback()
+			return jr, err
+		}
+	}
+
+	var groupName sql.NullString
+	err = tx.QueryRow("SELECT name FROM conversations WHERE id = ?", jr.GroupId).Scan(&groupName)
+	if err != nil {
+		_ = tx.Rollback()
+		return jr, err
+	}
+	err = createNotification(tx, jr.UserId, notification, map[string]interface{}{
+		"requestId": jr.ID,
+		"groupId":   jr.GroupId,
+		"groupName": groupName.String,
+	})
+	if err != nil {
+		_ = tx.Rollback()
+		return jr, err
+	}
+
+	return jr, tx.Commit()
+}
@@ -0,0 +1,362 @@
+package database
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+)
+
+// CreateMedia saves a new media object with m.RefCount references, referencing the blob m.BlobHash and increasing the
+// blob reference count.
+func (db *appdbimpl) CreateMedia(m Media) error {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return err
+	}
+
+	err = retainBlob(tx, m.BlobHash, m.Size)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO media (id, conversation_id, uploader_id, blob_hash, mime_type, created_at, ref_count)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, m.ID, m.ConversationId, m.UploaderId, m.BlobHash, m.MimeType, time.Now(), m.RefCount)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (db *appdbimpl) GetMedia(id string) (Media, error) {
+	var m Media
+	var conversationId sql.NullInt64
+	var blobHash sql.NullString
+	var size sql.NullInt64
+	err := db.c.QueryRow(`
+		SELECT m.id, m.conversation_id, m.uploader_id, m.filename, m.blob_hash, b.size, m.mime_type, m.created_at
+		FROM media m
+		LEFT JOIN media_blobs b ON m.blob_hash = b.hash
+		WHERE m.id = ?
+	`, id).Scan(&m.ID, &conversationId, &m.UploaderId, &m.Filename, &blobHash, &size, &m.MimeType, &m.CreatedAt)
+	if conversationId.Valid {
+		m.ConversationId = &conversationId.Int64
+	}
+	m.BlobHash = blobHash.String
+	m.Size = size.Int64
+	return m, err
+}
+
+// GetExportMedia returns the media of the photos in the conversation that are not deleted and that the user has not
+// cleared from its history. Media sent more than once are returned once.
+func (db *appdbimpl) GetExportMedia(conversationId int64, userId int64) ([]Media, error) {
+	rows, err := db.c.Query(`
+		SELECT DISTINCT md.id, md.conversation_id, md.uploader_id, IFNULL(md.blob_hash, ''), md.mime_type, md.created_at
+		FROM messages m
+		JOIN participants p_me ON p_me.conversation_id = m.conversation_id AND p_me.user_id = ?
+		JOIN media md ON m.content = '/media/' || md.id
+		WHERE m.conversation_id = ? AND m.content_type = 'photo' AND m.is_deleted = 0
+		AND (p_me.cleared_at IS NULL OR m.created_at > p_me.cleared_at)
+	`, userId, conversationId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var media []Media
+	for rows.Next() {
+		var m Media
+		var mediaConversationId sql.NullInt64
+		if err := rows.Scan(&m.ID, &mediaConversationId, &m.UploaderId, &m.BlobHash, &m.MimeType, &m.CreatedAt); err != nil {
+			return nil, err
+		}
+		if mediaConversationId.Valid {
+			m.ConversationId = &mediaConversationId.Int64
+		}
+		media = append(media, m)
+	}
+	return media, rows.Err()
+}
+
+// GetUploadedMedia returns the media uploaded by the user, oldest first.
+func (db *appdbimpl) GetUploadedMedia(userId int64) ([]Media, error) {
+	rows, err := db.c.Query(`
+		SELECT m.id, m.conversation_id, m.uploader_id, IFNULL(m.blob_hash, ''), IFNULL(b.size, 0), m.mime_type, m.created_at
+		FROM media m
+		LEFT JOIN media_blobs b ON m.blob_hash = b.hash
+		WHERE m.uploader_id = ?
+		ORDER BY m.created_at, m.id
+	`, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var media []Media
+	for rows.Next() {
+		var m Media
+		var conversationId sql.NullInt64
+		if err := rows.Scan(&m.ID, &conversationId, &m.UploaderId, &m.BlobHash, &m.Size, &m.MimeType, &m.CreatedAt); err != nil {
+			return nil, err
+		}
+		if conversationId.Valid {
+			m.ConversationId = &conversationId.Int64
+		}
+		media = append(media, m)
+	}
+	return media, rows.Err()
+}
+
+// ReleaseMedia removes a reference to the media object. Once the last one is removed, the media object is deleted and
+// the reference count of its blob decreased. If that was the last reference to the blob, the blob is forgotten and
+// its hash is returned, so that the caller can remove the content. Otherwise, an empty string is returned.
+func (db *appdbimpl) ReleaseMedia(id string) (string, error) {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return "", err
+	}
+
+	var blobHash sql.NullString
+	var refCount int64
+	err = tx.QueryRow("UPDATE media SET ref_count = ref_count - 1 WHERE id = ? RETURNING blob_hash, ref_count", id).Scan(&blobHash, &refCount)
+	if err != nil {
+		_ = tx.Rollback()
+		return "", err
+	}
+	if refCount > 0 {
+		return "", tx.Commit()
+	}
+
+	_, err = tx.Exec("DELETE FROM media WHERE id = ?", id)
+	if err != nil {
+		_ = tx.Rollback()
+		return "", err
+	}
+
+	var released string
+	if blobHash.Valid {
+		released, err = releaseBlob(tx, blobHash.String)
+		if err != nil {
+			_ = tx.Rollback()
+			return "", err
+		}
+	}
+
+	return released, tx.Commit()
+}
+
+// GetLegacyMedia returns the media objects that are not stored as blobs yet.
+func (db *appdbimpl) GetLegacyMedia() ([]Media, error) {
+	rows, err := db.c.Query(`
+		SELECT id, conversation_id, uploader_id, filename, mime_type, created_at
+		FROM media WHERE blob_hash IS NULL
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var media []Media
+	for rows.Next() {
+		var m Media
+		var conversationId sql.NullInt64
+		if err := rows.Scan(&m.ID, &conversationId, &m.UploaderId, &m.Filename, &m.MimeType, &m.CreatedAt); err != nil {
+			return nil, err
+		}
+		if conversationId.Valid {
+			m.ConversationId = &conversationId.Int64
+		}
+		media = append(media, m)
+	}
+	return media, rows.Err()
+}
+
+// SetMediaBlob links a legacy media object to the blob now holding its content.
+func (db *appdbimpl) SetMediaBlob(id string, blobHash string, size int64) error {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return err
+	}
+
+	err = retainBlob(tx, blobHash, size)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	_, err = tx.Exec("UPDATE media SET blob_hash = ?, filename = '' WHERE id = ?", blobHash, id)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// retainMediaURL adds a reference to the media object of a photo message, if content is a media URL. It returns
+// sql.ErrNoRows if the media object has been released meanwhile.
+func retainMediaURL(tx *sql.Tx, content string, contentType string) error {
+	id, ok := strings.CutPrefix(content, "/media/")
+	if !ok || contentType != "photo" {
+		return nil
+	}
+	res, err := tx.Exec("UPDATE media SET ref_count = ref_count + 1 WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	affected, err := res.RowsAffected()
+	if err == nil && affected == 0 {
+		return sql.ErrNoRows
+	}
+	return err
+}
+
+// retainBlob adds a reference to the blob, creating it if it's not known yet.
+func retainBlob(tx *sql.Tx, blobHash string, size int64) error {
+	_, err := tx.Exec(`
+		INSERT INTO media_blobs (hash, size, ref_count, created_at) VALUES (?, ?, 1, ?)
+		ON CONFLICT(hash) DO UPDATE SET ref_count = ref_count + 1
+	`, blobHash, size, time.Now())
+	return err
+}
+
+// releaseBlob removes a reference to the blob. If it was the last one, the blob is forgotten and its hash is returned.
+func releaseBlob(tx *sql.Tx, blobHash string) (string, error) {
+	_, err := tx.Exec("UPDATE media_blobs SET ref_count = ref_count - 1 WHERE hash = ?", blobHash)
+	if err != nil {
+		return "", err
+	}
+
+	res, err := tx.Exec("DELETE FROM media_blobs WHERE hash = ? AND ref_count <= 0", blobHash)
+	if err != nil {
+		return "", err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		return blobHash, nil
+	}
+	return "", nil
+}
+
+// GetGroupsWithPhotoPrefix returns the groups whose photo URL starts with the given prefix.
+func (db *appdbimpl) GetGroupsWithPhotoPrefix(prefix string) ([]Conversation, error) {
+	rows, err := db.c.Query(`
+		SELECT id, IFNULL(name, ''), is_group, photo_url
+		FROM conversations
+		WHERE is_group = 1 AND substr(photo_url, 1, ?) = ?
+	`, len(prefix), prefix)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var groups []Conversation
+	for rows.Next() {
+		var c Conversation
+		if err := rows.Scan(&c.ID, &c.Name, &c.IsGroup, &c.PhotoURL); err != nil {
+			return nil, err
+		}
+		groups = append(groups, c)
+	}
+	return groups, rows.Err()
+}
+
+// unreferencedMedia is the condition on the media objects m that are not used as user photo, group photo or message
+// content.
+const unreferencedMedia = `
+	NOT EXISTS (SELECT 1 FROM users WHERE photo_url = '/media/' || m.id)
+	AND NOT EXISTS (SELECT 1 FROM conversations WHERE photo_url = '/media/' || m.id)
+	AND NOT EXISTS (SELECT 1 FROM messages WHERE content = '/media/' || m.id AND is_deleted = 0)
+`
+
+// GetUnreferencedMedia returns the media objects that are not used as user photo, group photo or message content.
+func (db *appdbimpl) GetUnreferencedMedia() ([]Media, error) {
+	rows, err := db.c.Query(`
+		SELECT m.id, m.conversation_id, m.uploader_id, IFNULL(m.blob_hash, ''), m.mime_type, m.created_at
+		FROM media m
+		WHERE ` + unreferencedMedia)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var media []Media
+	for rows.Next() {
+		var m Media
+		var conversationId sql.NullInt64
+		if err := rows.Scan(&m.ID, &conversationId, &m.UploaderId, &m.BlobHash, &m.MimeType, &m.CreatedAt); err != nil {
+			return nil, err
+		}
+		if conversationId.Valid {
+			m.ConversationId = &conversationId.Int64
+		}
+		media = append(media, m)
+	}
+	return media, rows.Err()
+}
+
+// ReleaseUnreferencedMedia deletes the media object if it's still not referenced and was created before cutoff,
+// whatever its reference count, and decreases the reference count of its blob. The check and the deletion are atomic,
+// so a media object getting a reference from another process meanwhile is kept: sql.ErrNoRows is returned then. The
+// hash of the blob is returned if that was its last reference, as in ReleaseMedia.
+func (db *appdbimpl) ReleaseUnreferencedMedia(id string, cutoff time.Time) (string, error) {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return "", err
+	}
+
+	var blobHash sql.NullString
+	err = tx.QueryRow(`
+		DELETE FROM media AS m WHERE m.id = ? AND m.created_at < ? AND `+unreferencedMedia+`
+		RETURNING blob_hash
+	`, id, cutoff).Scan(&blobHash)
+	if err != nil {
+		_ = tx.Rollback()
+		return "", err
+	}
+
+	var released string
+	if blobHash.Valid {
+		released, err = releaseBlob(tx, blobHash.String)
+		if err != nil {
+			_ = tx.Rollback()
+			return "", err
+		}
+	}
+
+	return released, tx.Commit()
+}
+
+// GetBlobReferenceCounts returns the reference count of every known blob.
+func (db *appdbimpl) GetBlobReferenceCounts() (map[string]int64, error) {
+	rows, err := db.c.Query("SELECT hash, ref_count FROM media_blobs")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int64)
+	for rows.Next() {
+		var hash string
+		var count int64
+		if err := rows.Scan(&hash, &count); err != nil {
+			return nil, err
+		}
+		counts[hash] = count
+	}
+	return counts, rows.Err()
+}
+
+// IsURLReferenced checks whether url is used as user photo, group photo or message content.
+func (db *appdbimpl) IsURLReferenced(url string) (bool, error) {
+	var referenced bool
+	err := db.c.QueryRow(`
+		SELECT EXISTS (SELECT 1 FROM users WHERE photo_url = ?)
+		OR EXISTS (SELECT 1 FROM conversations WHERE photo_url = ?)
+		OR EXISTS (SELECT 1 FROM messages WHERE content = ?)
+	`, url, url, url).Scan(&referenced)
+	return referenced, err
+}
@@ -2,6 +2,7 @@ package database
 
 import (
 	"database/sql"
+	"strings"
 	"time"
 )
 
@@ -37,6 +38,13 @@ func (db *appdbimpl) SendMessage(conversationId int64, senderId int64, content s
 		return message, err
 	}
 
+	// The photo is not released while a message uses it
+	err = retainMediaURL(tx, content, contentType)
+	if err != nil {
+		_ = tx.Rollback()
+		return message, err
+	}
+
 	// Update Conversation LastMessageAt
 	_, err = tx.Exec("UPDATE conversations SET last_message_at = ? WHERE id = ?", time.Now(), conversationId)
 	if err != nil {
@@ -44,6 +52,31 @@ func (db *appdbimpl) SendMessage(conversationId int64, senderId int64, content s
 		return message, err
 	}
 
+	// Replying to a message request accepts it
+	_, err = tx.Exec("UPDATE participants SET request_from = NULL WHERE conversation_id = ? AND user_id = ?", conversationId, senderId)
+	if err != nil {
+		_ = tx.Rollback()
+		return message, err
+	}
+
+	// New messages bring deleted conversations back to the list
+	_, err = tx.Exec("UPDATE participants SET hidden = 0 WHERE conversation_id = ? AND hidden = 1", conversationId)
+	if err != nil {
+		_ = tx.Rollback()
+		return message, err
+	}
+
+	// New messages bring archived conversations back to the list, unless they are muted
+	_, err = tx.Exec(`
+		UPDATE participants SET archived = 0
+		WHERE conversation_id = ? AND archived = 1
+		AND NOT (muted = 1 AND (muted_until IS NULL OR muted_until > ?))
+	`, conversationId, time.Now())
+	if err != nil {
+		_ = tx.Rollback()
+		return message, err
+	}
+
 	err = tx.Commit()
 	if err != nil {
 		return message, err
@@ -62,7 +95,8 @@ func (db *appdbimpl) SendMessage(conversationId int64, senderId int64, content s
 	return message, nil
 }
 
-func (db *appdbimpl) GetMessages(conversationId int64) ([]Message, error) {
+// GetMessages returns the messages of the conversation that the user has not cleared from its history.
+func (db *appdbimpl) GetMessages(conversationId int64, userId int64) ([]Message, error) {
 	rows, err := db.c.Query(`
 		SELECT 
 			m.id, 
@@ -74,21 +108,25 @@ func (db *appdbimpl) GetMessages(conversationId int64) ([]Message, error) {
 			m.content_type, 
 			m.reply_to_id, 
 			CASE 
+				WHEN c.is_channel = 1 THEN m.status
 				WHEN m.status >= 2 THEN 2
 				WHEN NOT EXISTS (
 					SELECT 1 FROM participants p 
 					WHERE p.conversation_id = m.conversation_id 
 					AND p.user_id != m.sender_id 
-					AND (p.last_read_at IS NULL OR p.last_read_at < m.created_at)
+					AND (p.last_read_at IS NULL OR p.last_read_at < m.created_at OR p.request_from IS NOT NULL)
 				) THEN 2
 				ELSE m.status
 			END as status,
 			m.is_deleted
 		FROM messages m
 		JOIN users u ON m.sender_id = u.id
+		JOIN conversations c ON c.id = m.conversation_id
+		JOIN participants p_me ON p_me.conversation_id = m.conversation_id AND p_me.user_id = ?
 		WHERE m.conversation_id = ?
+		AND (p_me.cleared_at IS NULL OR m.created_at > p_me.cleared_at)
 		ORDER BY m.created_at ASC
-	`, conversationId)
+	`, userId, conversationId)
 	if err != nil {
 		return nil, err
 	}
@@ -119,6 +157,106 @@ func (db *appdbimpl) GetMessages(conversationId int64) ([]Message, error) {
 	return messages, rows.Err()
 }
 
+// exportPageSize is the number of messages that exports read at a time
+const exportPageSize = 500
+
+// ExportMessages calls fn for each message of the conversation that the user has not cleared from its history, in
+// chronological order and with their reactions, without loading them all in memory. The status of the messages is not
+// computed. Messages are read in pages, and fn is only called once a page has been read, so that the connection is not
+// held while the caller writes them out.
+func (db *appdbimpl) ExportMessages(conversationId int64, userId int64, fn func(Message) error) error {
+	return exportPages(func(afterId int64) ([]Message, error) {
+		return db.exportMessagePage(conversationId, userId, afterId)
+	}, fn)
+}
+
+// exportPages calls fn for each message of the pages returned by next, which returns the page following the message
+// afterId, until a page is not full.
+func exportPages(next func(afterId int64) ([]Message, error), fn func(Message) error) error {
+	var afterId int64
+	for {
+		page, err := next(afterId)
+		if err != nil {
+			return err
+		}
+		for _, m := range page {
+			if err := fn(m); err != nil {
+				return err
+			}
+		}
+		if len(page) < exportPageSize {
+			return nil
+		}
+		afterId = page[len(page)-1].ID
+	}
+}
+
+// exportMessagePage returns the page of ExportMessages following the message afterId, which is 0 for the first page.
+// The position of afterId is read from the database, since the times of the messages are compared as stored.
+func (db *appdbimpl) exportMessagePage(conversationId int64, userId int64, afterId int64) ([]Message, error) {
+	rows, err := db.c.Query(`
+		SELECT m.id, m.conversation_id, m.sender_id, u.name, m.created_at, m.content, m.content_type, m.reply_to_id,
+			m.is_deleted
+		FROM messages m
+		JOIN users u ON m.sender_id = u.id
+		JOIN participants p_me ON p_me.conversation_id = m.conversation_id AND p_me.user_id = ?1
+		WHERE m.conversation_id = ?2
+		AND (p_me.cleared_at IS NULL OR m.created_at > p_me.cleared_at)
+		AND (?3 = 0 OR (m.created_at, m.id) > ((SELECT created_at FROM messages WHERE id = ?3), ?3))
+		ORDER BY m.created_at, m.id
+		LIMIT ?4
+	`, userId, conversationId, afterId, exportPageSize)
+	if err != nil {
+		return nil, err
+	}
+
+	var page []Message
+	index := make(map[int64]int)
+	for rows.Next() {
+		var m Message
+		var replyTo sql.NullInt64
+		if err := rows.Scan(&m.ID, &m.ConversationId, &m.SenderId, &m.SenderName, &m.TimeStamp, &m.Content, &m.ContentType, &replyTo, &m.IsDeleted); err != nil {
+			_ = rows.Close()
+			return nil, err
+		}
+		if replyTo.Valid {
+			m.ReplyToId = &replyTo.Int64
+		}
+		index[m.ID] = len(page)
+		page = append(page, m)
+	}
+	_ = rows.Close()
+	if err := rows.Err(); err != nil || len(page) == 0 {
+		return page, err
+	}
+
+	args := make([]interface{}, 0, len(page))
+	for _, m := range page {
+		args = append(args, m.ID)
+	}
+	rows, err = db.c.Query(`
+		SELECT r.message_id, r.user_id, IFNULL(ru.name, ''), r.emoticon
+		FROM reactions r
+		LEFT JOIN users ru ON ru.id = r.user_id
+		WHERE r.message_id IN (?`+strings.Repeat(", ?", len(args)-1)+`)
+		ORDER BY r.rowid
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var r Reaction
+		if err := rows.Scan(&r.MessageID, &r.UserID, &r.ReactorName, &r.Emoticon); err != nil {
+			return nil, err
+		}
+		m := &page[index[r.MessageID]]
+		m.Reactions = append(m.Reactions, r)
+	}
+	return page, rows.Err()
+}
+
 func (db *appdbimpl) GetMessage(id int64) (Message, error) {
 	var m Message
 	var replyTo sql.NullInt64
@@ -144,3 +282,15 @@ func (db *appdbimpl) SetMessageStatus(id int64, status int) error {
 	_, err := db.c.Exec("UPDATE messages SET status = ? WHERE id = ?", status, id)
 	return err
 }
+
+// GetLastMessageTime returns when the user last sent a message to the conversation, ignoring system messages. It
+// returns sql.ErrNoRows if the user never sent one.
+func (db *appdbimpl) GetLastMessageTime(conversationId int64, senderId int64) (time.Time, error) {
+	var t time.Time
+	err := db.c.QueryRow(`
+		SELECT created_at FROM messages
+		WHERE conversation_id = ? AND sender_id = ? AND content_type != 'system'
+		ORDER BY created_at DESC LIMIT 1
+	`, conversationId, senderId).Scan(&t)
+	return t, err
+}
@@ -0,0 +1,91 @@
+package database
+
+import (
+	"database/sql"
+	"time"
+)
+
+// knows reports whether userId knows otherId: both take part in a conversation other than a channel, and neither of
+// them is still deciding on a message request there.
+func knows(tx *sql.Tx, userId int64, otherId int64) (bool, error) {
+	if userId == otherId {
+		return true, nil
+	}
+	var known bool
+	err := tx.QueryRow(`
+		SELECT EXISTS (
+			SELECT 1
+			FROM participants p1
+			JOIN participants p2 ON p2.conversation_id = p1.conversation_id
+			JOIN conversations c ON c.id = p1.conversation_id
+			WHERE p1.user_id = ? AND p2.user_id = ?
+			AND p1.request_from IS NULL AND p2.request_from IS NULL
+			AND c.is_channel = 0
+		)
+	`, userId, otherId).Scan(&known)
+	return known, err
+}
+
+// AcceptMessageRequest moves the conversation from the message requests of the user to the conversation list. It
+// returns sql.ErrNoRows if the conversation is not a message request of the user.
+func (db *appdbimpl) AcceptMessageRequest(conversationId int64, userId int64) error {
+	res, err := db.c.Exec(`
+		UPDATE participants SET request_from = NULL
+		WHERE conversation_id = ? AND user_id = ? AND request_from IS NOT NULL
+	`, conversationId, userId)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// DeclineMessageRequest removes the conversation from the requests of the user and returns the user who sent the
+// request. Declined 1-on-1 conversations are hidden and cleared for the user only, so the sender keeps its history; a
+// new message brings the request back. Declined groups are left. It returns sql.ErrNoRows if the conversation is not a
+// message request of the user.
+func (db *appdbimpl) DeclineMessageRequest(conversationId int64, userId int64) (int64, error) {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	var requestFrom int64
+	var isGroup bool
+	err = tx.QueryRow(`
+		SELECT p.request_from, c.is_group
+		FROM participants p
+		JOIN conversations c ON c.id = p.conversation_id
+		WHERE p.conversation_id = ? AND p.user_id = ? AND p.request_from IS NOT NULL
+	`, conversationId, userId).Scan(&requestFrom, &isGroup)
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+
+	if isGroup {
+		err = removeParticipant(tx, conversationId, userId, userId)
+		if err != nil {
+			_ = tx.Rollback()
+			return 0, err
+		}
+		return requestFrom, tx.Commit()
+	}
+
+	_, err = tx.Exec(`
+		UPDATE participants SET cleared_at = ?, hidden = 1, archived = 0, pinned_at = NULL
+		WHERE conversation_id = ? AND user_id = ?
+	`, time.Now(), conversationId, userId)
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+
+	return requestFrom, tx.Commit()
+}
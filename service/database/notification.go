@@ -0,0 +1,62 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+)
+
+// createNotification notifies the user. The payload is stored as JSON.
+func createNotification(tx *sql.Tx, userId int64, notificationType string, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO notifications (user_id, type, payload, created_at) VALUES (?, ?, ?, ?)",
+		userId, notificationType, string(data), time.Now())
+	return err
+}
+
+// GetNotifications returns the notifications of the user, newest first.
+func (db *appdbimpl) GetNotifications(userId int64, unreadOnly bool) ([]Notification, error) {
+	rows, err := db.c.Query(`
+		SELECT id, type, payload, created_at, read_at IS NOT NULL
+		FROM notifications
+		WHERE user_id = ? AND (? = 0 OR read_at IS NULL)
+		ORDER BY created_at DESC, id DESC
+	`, userId, unreadOnly)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var notifications []Notification
+	for rows.Next() {
+		var n Notification
+		var payload string
+		if err := rows.Scan(&n.ID, &n.Type, &payload, &n.CreatedAt, &n.Read); err != nil {
+			return nil, err
+		}
+		n.Payload = json.RawMessage(payload)
+		notifications = append(notifications, n)
+	}
+	return notifications, rows.Err()
+}
+
+// MarkNotificationRead marks the notification of the user as read. It returns sql.ErrNoRows if the user has no such
+// notification.
+func (db *appdbimpl) MarkNotificationRead(id int64, userId int64) error {
+	res, err := db.c.Exec("UPDATE notifications SET read_at = IFNULL(read_at, ?) WHERE id = ? AND user_id = ?",
+		time.Now(), id, userId)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
@@ -0,0 +1,32 @@
+package database
+
+import "time"
+
+// RecordSession adds a login of the user to its session history.
+func (db *appdbimpl) RecordSession(userId int64, userAgent string, newUser bool) error {
+	_, err := db.c.Exec(`
+		INSERT INTO sessions (user_id, created_at, user_agent, new_user) VALUES (?, ?, ?, ?)
+	`, userId, time.Now(), userAgent, newUser)
+	return err
+}
+
+// GetSessions returns the session history of the user, oldest first.
+func (db *appdbimpl) GetSessions(userId int64) ([]Session, error) {
+	rows, err := db.c.Query(`
+		SELECT created_at, user_agent, new_user FROM sessions WHERE user_id = ? ORDER BY created_at, id
+	`, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sessions []Session
+	for rows.Next() {
+		var s Session
+		if err := rows.Scan(&s.CreatedAt, &s.UserAgent, &s.NewUser); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, s)
+	}
+	return sessions, rows.Err()
+}
@@ -0,0 +1,201 @@
+package database
+
+import (
+	"database/sql"
+	"time"
+)
+
+func (db *appdbimpl) CreateTakeout(t Takeout) error {
+	_, err := db.c.Exec(`
+		INSERT INTO takeouts (id, user_id, status, created_at) VALUES (?, ?, ?, ?)
+	`, t.ID, t.UserId, TakeoutPending, t.CreatedAt)
+	return err
+}
+
+// takeoutColumns are the columns read by scanTakeout
+const takeoutColumns = "id, user_id, status, size, created_at, completed_at, expires_at"
+
+// scanTakeout reads a row of takeoutColumns.
+func scanTakeout(row interface{ Scan(...interface{}) error }) (Takeout, error) {
+	var t Takeout
+	var completedAt, expiresAt sql.NullTime
+	err := row.Scan(&t.ID, &t.UserId, &t.Status, &t.Size, &t.CreatedAt, &completedAt, &expiresAt)
+	if completedAt.Valid {
+		t.CompletedAt = &completedAt.Time
+	}
+	if expiresAt.Valid {
+		t.ExpiresAt = &expiresAt.Time
+	}
+	return t, err
+}
+
+func (db *appdbimpl) GetTakeout(id string) (Takeout, error) {
+	return scanTakeout(db.c.QueryRow("SELECT "+takeoutColumns+" FROM takeouts WHERE id = ?", id))
+}
+
+// GetCurrentTakeout returns the latest takeout of the user that is still being built or is ready, even if expired. It
+// returns sql.ErrNoRows if there is none.
+func (db *appdbimpl) GetCurrentTakeout(userId int64) (Takeout, error) {
+	return scanTakeout(db.c.QueryRow(`
+		SELECT `+takeoutColumns+` FROM takeouts
+		WHERE user_id = ? AND status IN (?, ?)
+		ORDER BY rowid DESC LIMIT 1
+	`, userId, TakeoutPending, TakeoutReady))
+}
+
+// CompleteTakeout marks the takeout as ready to be downloaded until expiresAt. It returns sql.ErrNoRows if the takeout
+// is not pending anymore, e.g. because the user was deleted meanwhile.
+func (db *appdbimpl) CompleteTakeout(id string, size int64, expiresAt time.Time) error {
+	res, err := db.c.Exec(`
+		UPDATE takeouts SET status = ?, size = ?, completed_at = ?, expires_at = ? WHERE id = ? AND status = ?
+	`, TakeoutReady, size, time.Now(), expiresAt, id, TakeoutPending)
+	if err != nil {
+		return err
+	}
+	affected, err := res.RowsAffected()
+	if err == nil && affected == 0 {
+		return sql.ErrNoRows
+	}
+	return err
+}
+
+func (db *appdbimpl) FailTakeout(id string) error {
+	_, err := db.c.Exec("UPDATE takeouts SET status = ?, completed_at = ? WHERE id = ?", TakeoutFailed, time.Now(), id)
+	return err
+}
+
+// FailPendingTakeouts marks as failed the takeouts whose building was interrupted, e.g. by a restart.
+func (db *appdbimpl) FailPendingTakeouts() error {
+	_, err := db.c.Exec("UPDATE takeouts SET status = ?, completed_at = ? WHERE status = ?", TakeoutFailed, time.Now(), TakeoutPending)
+	return err
+}
+
+// GetExpiredTakeouts returns the ready takeouts that expired before now, and the failed ones.
+func (db *appdbimpl) GetExpiredTakeouts(now time.Time) ([]Takeout, error) {
+	rows, err := db.c.Query("SELECT "+takeoutColumns+" FROM takeouts WHERE status != ?", TakeoutPending)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var takeouts []Takeout
+	for rows.Next() {
+		t, err := scanTakeout(rows)
+		if err != nil {
+			return nil, err
+		}
+		if t.Status == TakeoutFailed || (t.ExpiresAt != nil && t.ExpiresAt.Before(now)) {
+			takeouts = append(takeouts, t)
+		}
+	}
+	return takeouts, rows.Err()
+}
+
+func (db *appdbimpl) DeleteTakeout(id string) error {
+	_, err := db.c.Exec("DELETE FROM takeouts WHERE id = ?", id)
+	return err
+}
+
+// GetMemberships returns all the conversations the user is in, including archived, deleted and message requests.
+func (db *appdbimpl) GetMemberships(userId int64) ([]Membership, error) {
+	rows, err := db.c.Query(`
+		SELECT c.id,
+			CASE WHEN c.is_group = 1 THEN IFNULL(c.name, '') ELSE IFNULL((
+				SELECT u.name FROM participants p2 JOIN users u ON u.id = p2.user_id
+				WHERE p2.conversation_id = c.id AND p2.user_id != p.user_id
+			), '') END,
+			c.is_group, c.is_channel, c.saved_by IS NOT NULL,
+			p.role, p.joined_at, p.archived, p.muted, p.pinned_at IS NOT NULL, p.request_from IS NOT NULL, p.hidden,
+			p.cleared_at
+		FROM participants p
+		JOIN conversations c ON c.id = p.conversation_id
+		WHERE p.user_id = ?
+		ORDER BY c.id
+	`, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var memberships []Membership
+	for rows.Next() {
+		var m Membership
+		var joinedAt, clearedAt sql.NullTime
+		if err := rows.Scan(&m.ConversationId, &m.Name, &m.IsGroup, &m.IsChannel, &m.IsSaved, &m.Role, &joinedAt, &m.Archived, &m.Muted, &m.Pinned, &m.Request, &m.Hidden, &clearedAt); err != nil {
+			return nil, err
+		}
+		if joinedAt.Valid {
+			m.JoinedAt = &joinedAt.Time
+		}
+		if clearedAt.Valid {
+			m.ClearedAt = &clearedAt.Time
+		}
+		memberships = append(memberships, m)
+	}
+	return memberships, rows.Err()
+}
+
+// ExportUserMessages calls fn with each message sent by the user, in all conversations and including the deleted
+// ones, oldest first. Messages are read in pages, like in ExportMessages, so fn can use the database.
+func (db *appdbimpl) ExportUserMessages(userId int64, fn func(Message) error) error {
+	return exportPages(func(afterId int64) ([]Message, error) {
+		return db.exportUserMessagePage(userId, afterId)
+	}, fn)
+}
+
+// exportUserMessagePage returns the page of ExportUserMessages following the message afterId, which is 0 for the first
+// page.
+func (db *appdbimpl) exportUserMessagePage(userId int64, afterId int64) ([]Message, error) {
+	rows, err := db.c.Query(`
+		SELECT m.id, m.conversation_id, m.sender_id, u.name, m.created_at, m.content, m.content_type, m.reply_to_id,
+			IFNULL(m.status, 0), m.is_deleted
+		FROM messages m
+		JOIN users u ON m.sender_id = u.id
+		WHERE m.sender_id = ?1
+		AND (?2 = 0 OR (m.created_at, m.id) > ((SELECT created_at FROM messages WHERE id = ?2), ?2))
+		ORDER BY m.created_at, m.id
+		LIMIT ?3
+	`, userId, afterId, exportPageSize)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var page []Message
+	for rows.Next() {
+		var m Message
+		var replyTo sql.NullInt64
+		if err := rows.Scan(&m.ID, &m.ConversationId, &m.SenderId, &m.SenderName, &m.TimeStamp, &m.Content, &m.ContentType, &replyTo, &m.Status, &m.IsDeleted); err != nil {
+			return nil, err
+		}
+		if replyTo.Valid {
+			m.ReplyToId = &replyTo.Int64
+		}
+		page = append(page, m)
+	}
+	return page, rows.Err()
+}
+
+func (db *appdbimpl) GetGivenReactions(userId int64) ([]GivenReaction, error) {
+	rows, err := db.c.Query(`
+		SELECT r.message_id, m.conversation_id, r.emoticon
+		FROM reactions r
+		JOIN messages m ON m.id = r.message_id
+		WHERE r.user_id = ?
+		ORDER BY r.message_id
+	`, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var reactions []GivenReaction
+	for rows.Next() {
+		var r GivenReaction
+		if err := rows.Scan(&r.MessageId, &r.ConversationId, &r.Emoticon); err != nil {
+			return nil, err
+		}
+		reactions = append(reactions, r)
+	}
+	return reactions, rows.Err()
+}
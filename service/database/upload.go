@@ -0,0 +1,116 @@
+package database
+
+import (
+	"database/sql"
+	"time"
+)
+
+func (db *appdbimpl) CreateUpload(u Upload) error {
+	_, err := db.c.Exec(`
+		INSERT INTO uploads (id, user_id, length, metadata, created_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, u.ID, u.UserId, u.Length, u.Metadata, time.Now(), u.ExpiresAt)
+	return err
+}
+
+func (db *appdbimpl) GetUpload(id string) (Upload, error) {
+	var u Upload
+	var blobHash sql.NullString
+	err := db.c.QueryRow(`
+		SELECT id, user_id, length, upload_offset, metadata, blob_hash, mime_type, created_at, expires_at
+		FROM uploads WHERE id = ?
+	`, id).Scan(&u.ID, &u.UserId, &u.Length, &u.Offset, &u.Metadata, &blobHash, &u.MimeType, &u.CreatedAt, &u.ExpiresAt)
+	u.BlobHash = blobHash.String
+	return u, err
+}
+
+func (db *appdbimpl) SetUploadOffset(id string, offset int64, expiresAt time.Time) error {
+	_, err := db.c.Exec("UPDATE uploads SET upload_offset = ?, expires_at = ? WHERE id = ?", offset, expiresAt, id)
+	return err
+}
+
+// CompleteUpload links the upload to the blob holding its content, adding a reference to the blob.
+func (db *appdbimpl) CompleteUpload(id string, blobHash string, mimeType string) error {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return err
+	}
+
+	var length int64
+	err = tx.QueryRow("SELECT length FROM uploads WHERE id = ?", id).Scan(&length)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	err = retainBlob(tx, blobHash, length)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	_, err = tx.Exec("UPDATE uploads SET blob_hash = ?, mime_type = ?, upload_offset = length WHERE id = ?", blobHash, mimeType, id)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// DeleteUpload deletes the upload. If it was the last reference to its blob, the blob is forgotten and its hash is
+// returned, so that the caller can remove the content. Otherwise, an empty string is returned.
+func (db *appdbimpl) DeleteUpload(id string) (string, error) {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return "", err
+	}
+
+	var blobHash sql.NullString
+	err = tx.QueryRow("SELECT blob_hash FROM uploads WHERE id = ?", id).Scan(&blobHash)
+	if err != nil {
+		_ = tx.Rollback()
+		return "", err
+	}
+
+	_, err = tx.Exec("DELETE FROM uploads WHERE id = ?", id)
+	if err != nil {
+		_ = tx.Rollback()
+		return "", err
+	}
+
+	var released string
+	if blobHash.Valid {
+		released, err = releaseBlob(tx, blobHash.String)
+		if err != nil {
+			_ = tx.Rollback()
+			return "", err
+		}
+	}
+
+	return released, tx.Commit()
+}
+
+// GetExpiredUploads returns the uploads (complete or not) that expired before now.
+func (db *appdbimpl) GetExpiredUploads(now time.Time) ([]Upload, error) {
+	rows, err := db.c.Query(`
+		SELECT id, user_id, length, upload_offset, metadata, IFNULL(blob_hash, ''), mime_type, created_at, expires_at
+		FROM uploads
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var uploads []Upload
+	for rows.Next() {
+		var u Upload
+		if err := rows.Scan(&u.ID, &u.UserId, &u.Length, &u.Offset, &u.Metadata, &u.BlobHash, &u.MimeType, &u.CreatedAt, &u.ExpiresAt); err != nil {
+			return nil, err
+		}
+		if u.ExpiresAt.Before(now) {
+			uploads = append(uploads, u)
+		}
+	}
+	return uploads, rows.Err()
+}
@@ -1,12 +1,13 @@
 package database
 
+// ListUsers returns the users whose name contains query. Deactivated, deleted and placeholder users are not listed.
 func (db *appdbimpl) ListUsers(query string) ([]User, error) {
 	var users []User
-	sqlQuery := "SELECT id, name, IFNULL(photo_url, '') FROM users"
+	sqlQuery := "SELECT id, name, IFNULL(photo_url, '') FROM users WHERE deactivated_at IS NULL AND deleted_at IS NULL AND placeholder_of IS NULL"
 	var args []interface{}
 
 	if query != "" {
-		sqlQuery += " WHERE name LIKE ?"
+		sqlQuery += " AND name LIKE ?"
 		args = append(args, "%"+query+"%")
 	}
 
@@ -49,16 +50,50 @@ func (db *appdbimpl) CreateUser(name string) (User, error) {
 
 func (db *appdbimpl) GetUser(id int64) (User, error) {
 	var u User
-	err := db.c.QueryRow("SELECT id, name, IFNULL(photo_url, '') FROM users WHERE id = ?", id).Scan(&u.ID, &u.Name, &u.PhotoURL)
+	err := db.c.QueryRow("SELECT id, name, IFNULL(photo_url, ''), deactivated_at IS NOT NULL FROM users WHERE id = ?", id).Scan(&u.ID, &u.Name, &u.PhotoURL, &u.Deactivated)
 	return u, err
 }
 
+// GetUserByName returns the user with the given name. Deleted users are never returned, as they all have the same name,
+// and neither are placeholder users, whose names are not unique.
 func (db *appdbimpl) GetUserByName(name string) (User, error) {
 	var u User
-	err := db.c.QueryRow("SELECT id, name, IFNULL(photo_url, '') FROM users WHERE name = ?", name).Scan(&u.ID, &u.Name, &u.PhotoURL)
+	err := db.c.QueryRow("SELECT id, name, IFNULL(photo_url, ''), deactivated_at IS NOT NULL FROM users WHERE name = ? AND deleted_at IS NULL AND placeholder_of IS NULL", name).Scan(&u.ID, &u.Name, &u.PhotoURL, &u.Deactivated)
 	return u, err
 }
 
+// GetPlaceholderUser returns the placeholder user with the given name created by ownerId. Placeholder users are the
+// authors of imported messages who are not the user importing them: they are not accounts, so nobody can log in as
+// them, find them or add them to a conversation. They are created on first use: created reports whether it was
+// created by this call, even when imports run concurrently (see the users_placeholder index).
+func (db *appdbimpl) GetPlaceholderUser(ownerId int64, name string) (User, bool, error) {
+	u := User{Name: name}
+	tx, err := db.c.Begin()
+	if err != nil {
+		return u, false, err
+	}
+
+	res, err := tx.Exec(`
+		INSERT INTO users (name, placeholder_of) VALUES (?, ?)
+		ON CONFLICT (placeholder_of, name) WHERE placeholder_of IS NOT NULL DO NOTHING
+	`, name, ownerId)
+	if err != nil {
+		_ = tx.Rollback()
+		return u, false, err
+	}
+	created, err := res.RowsAffected()
+	if err != nil {
+		_ = tx.Rollback()
+		return u, false, err
+	}
+	err = tx.QueryRow("SELECT id FROM users WHERE placeholder_of = ? AND name = ?", ownerId, name).Scan(&u.ID)
+	if err != nil {
+		_ = tx.Rollback()
+		return u, false, err
+	}
+	return u, created > 0, tx.Commit()
+}
+
 func (db *appdbimpl) SetUserName(id int64, name string) error {
 	_, err := db.c.Exec("UPDATE users SET name = ? WHERE id = ?", name, id)
 	return err
@@ -0,0 +1,376 @@
+/*
+Package mediagc removes uploaded files that are not used anymore. A file is in use when it's referenced as a user
+photo, a group photo or a message content (see database.AppDatabase.IsURLReferenced).
+
+These kinds of garbage are collected:
+  - media objects that nothing references (e.g., uploaded but never sent), releasing their blob if unused
+  - expired resumable uploads, complete or not, with their partial content or their blob if unused
+  - files in the media store that are not known blobs (e.g., leftovers of interrupted uploads)
+  - legacy files in the static directory (like `user-<id>-<ts>.jpg`) that are not referenced
+  - expired and failed account takeouts, with their archive
+
+Files and media objects are only removed when older than the grace period, so that uploads in progress are not
+collected. In dry-run mode nothing is removed, and the Report lists what would have been removed.
+
+The collector may run in another process than the web API server (see cmd/mediagc), so the Store lock is not enough
+to keep it from removing what the server is referencing again. Media objects are claimed in the database, by deleting
+them only if they are still unreferenced, and blobs are removed with mediastore.Store.RemoveUnused, which keeps the
+ones saved again during the grace period.
+*/
+package mediagc
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"git.phoebe2z/WASAText/service/database"
+	"git.phoebe2z/WASAText/service/globaltime"
+	"git.phoebe2z/WASAText/service/mediastore"
+	"github.com/sirupsen/logrus"
+)
+
+// Config is used to provide dependencies and configuration to the Run function.
+type Config struct {
+	// Database is the instance of database.AppDatabase holding the references to files
+	Database database.AppDatabase
+
+	// Store is the media store to clean
+	Store *mediastore.Store
+
+	// StaticDir is the directory holding legacy uploaded files
+	StaticDir string
+
+	// UploadsDir is the directory holding the partial content of resumable uploads
+	UploadsDir string
+
+	// TakeoutsDir is the directory holding the archives of account takeouts
+	TakeoutsDir string
+
+	// GracePeriod is the minimum age of a file (or media object) before it's removed
+	GracePeriod time.Duration
+
+	// DryRun disables the removal: the report lists what would be removed
+	DryRun bool
+
+	// Logger where log entries are sent
+	Logger logrus.FieldLogger
+
+	// OnUploadRemoved, if not nil, is called with the ID of each expired upload removed, so that the web API server
+	// can forget it
+	OnUploadRemoved func(id string)
+}
+
+// Report lists what has been removed (or would be removed, in dry-run mode).
+type Report struct {
+	DryRun bool `json:"dryRun"`
+
+	// Media are the IDs of the released media objects
+	Media []string `json:"media"`
+
+	// Files are the paths of the removed files
+	Files []string `json:"files"`
+
+	// Bytes is the space freed by removing Files
+	Bytes int64 `json:"bytes"`
+}
+
+func (r *Report) addFile(path string, size int64) {
+	r.Files = append(r.Files, path)
+	r.Bytes += size
+}
+
+// Run collects the garbage once.
+func Run(cfg Config) (Report, error) {
+	report := Report{DryRun: cfg.DryRun}
+	if cfg.Database == nil || cfg.Store == nil || cfg.Logger == nil {
+		return report, errors.New("database, store and logger are required")
+	}
+	cutoff := globaltime.Now().Add(-cfg.GracePeriod)
+
+	// Hold the store lock, so that no reference is added to a blob being removed by this process. Other processes are
+	// handled by the claims in the database and by RemoveUnused.
+	cfg.Store.Lock()
+	defer cfg.Store.Unlock()
+
+	err := collectMedia(cfg, cutoff, &report)
+	if err != nil {
+		return report, fmt.Errorf("collecting media: %w", err)
+	}
+
+	err = collectUploads(cfg, cutoff, &report)
+	if err != nil {
+		return report, fmt.Errorf("collecting expired uploads: %w", err)
+	}
+
+	err = collectTakeouts(cfg, &report)
+	if err != nil {
+		return report, fmt.Errorf("collecting expired takeouts: %w", err)
+	}
+
+	err = collectStore(cfg, cutoff, &report)
+	if err != nil {
+		return report, fmt.Errorf("collecting unknown blobs: %w", err)
+	}
+
+	if cfg.StaticDir != "" {
+		err = collectStatic(cfg, cutoff, &report)
+		if err != nil {
+			return report, fmt.Errorf("collecting static files: %w", err)
+		}
+	}
+
+	return report, nil
+}
+
+// collectMedia releases media objects that are not referenced anymore.
+func collectMedia(cfg Config, cutoff time.Time, report *Report) error {
+	media, err := cfg.Database.GetUnreferencedMedia()
+	if err != nil {
+		return err
+	}
+	counts, err := cfg.Database.GetBlobReferenceCounts()
+	if err != nil {
+		return err
+	}
+
+	for _, m := range media {
+		if m.CreatedAt.After(cutoff) {
+			continue
+		}
+
+		if cfg.DryRun {
+			report.Media = append(report.Media, m.ID)
+			// Simulate the release, to report the blobs that would be removed
+			counts[m.BlobHash]--
+			if counts[m.BlobHash] == 0 {
+				reportBlob(cfg, m.BlobHash, report)
+			}
+			continue
+		}
+
+		// The media may have been referenced since it was listed
+		hash, err := cfg.Database.ReleaseUnreferencedMedia(m.ID, cutoff)
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		report.Media = append(report.Media, m.ID)
+		if hash != "" {
+			err = removeBlob(cfg, hash, cutoff, report)
+			if err != nil {
+				return err
+			}
+		}
+		cfg.Logger.WithField("media", m.ID).Debug("unreferenced media released")
+	}
+	return nil
+}
+
+func reportBlob(cfg Config, hash string, report *Report) {
+	p, err := cfg.Store.Path(hash)
+	if err != nil {
+		return
+	}
+	if info, err := os.Stat(p); err == nil {
+		report.addFile(p, info.Size())
+	}
+}
+
+// removeBlob removes a blob whose last reference has been released, unless it was saved again after cutoff by another
+// process, which is adding a reference to it. Blobs that are kept without a reference are removed by collectStore
+// later.
+func removeBlob(cfg Config, hash string, cutoff time.Time, report *Report) error {
+	p, err := cfg.Store.Path(hash)
+	if err != nil {
+		return err
+	}
+	info, statErr := os.Stat(p)
+
+	removed, err := cfg.Store.RemoveUnused(hash, cutoff)
+	if err != nil {
+		return err
+	}
+	if removed && statErr == nil {
+		report.addFile(p, info.Size())
+	}
+	return nil
+}
+
+// collectUploads removes expired resumable uploads, and files in the uploads directory without an upload.
+func collectUploads(cfg Config, cutoff time.Time, report *Report) error {
+	expired, err := cfg.Database.GetExpiredUploads(globaltime.Now())
+	if err != nil {
+		return err
+	}
+
+	for _, u := range expired {
+		if cfg.UploadsDir != "" {
+			p := filepath.Join(cfg.UploadsDir, u.ID)
+			if info, err := os.Stat(p); err == nil {
+				report.addFile(p, info.Size())
+			}
+		}
+		if cfg.DryRun {
+			continue
+		}
+
+		hash, err := cfg.Database.DeleteUpload(u.ID)
+		if err != nil {
+			return err
+		}
+		if cfg.UploadsDir != "" {
+			_ = os.Remove(filepath.Join(cfg.UploadsDir, u.ID))
+		}
+		if hash != "" {
+			err = removeBlob(cfg, hash, cutoff, report)
+			if err != nil {
+				return err
+			}
+		}
+		if cfg.OnUploadRemoved != nil {
+			cfg.OnUploadRemoved(u.ID)
+		}
+		cfg.Logger.WithField("upload", u.ID).Debug("expired upload removed")
+	}
+
+	if cfg.UploadsDir == "" {
+		return nil
+	}
+	entries, err := os.ReadDir(cfg.UploadsDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || !entry.Type().IsRegular() || info.ModTime().After(cutoff) {
+			continue
+		}
+		if _, err := cfg.Database.GetUpload(entry.Name()); !errors.Is(err, sql.ErrNoRows) {
+			continue
+		}
+
+		p := filepath.Join(cfg.UploadsDir, entry.Name())
+		report.addFile(p, info.Size())
+		if !cfg.DryRun {
+			_ = os.Remove(p)
+		}
+	}
+	return nil
+}
+
+// collectTakeouts removes expired and failed takeouts with their archive. Takeouts expire long after being built, so
+// there is no grace period.
+func collectTakeouts(cfg Config, report *Report) error {
+	expired, err := cfg.Database.GetExpiredTakeouts(globaltime.Now())
+	if err != nil {
+		return err
+	}
+
+	for _, t := range expired {
+		var p string
+		if cfg.TakeoutsDir != "" {
+			p = filepath.Join(cfg.TakeoutsDir, t.ID+".zip")
+			if info, err := os.Stat(p); err == nil {
+				report.addFile(p, info.Size())
+			}
+		}
+		if cfg.DryRun {
+			continue
+		}
+
+		err = cfg.Database.DeleteTakeout(t.ID)
+		if err != nil {
+			return err
+		}
+		if p != "" {
+			_ = os.Remove(p)
+		}
+		cfg.Logger.WithField("takeout", t.ID).Debug("expired takeout removed")
+	}
+	return nil
+}
+
+// collectStore removes the files in the store that are not known blobs.
+func collectStore(cfg Config, cutoff time.Time, report *Report) error {
+	counts, err := cfg.Database.GetBlobReferenceCounts()
+	if err != nil {
+		return err
+	}
+
+	return cfg.Store.Walk(func(e mediastore.Entry) error {
+		if e.ModTime.After(cutoff) {
+			return nil
+		}
+		if _, known := counts[e.Hash]; known && e.Hash != "" {
+			return nil
+		}
+
+		if cfg.DryRun {
+			report.addFile(e.Path, e.Size)
+			return nil
+		}
+		cfg.Logger.WithField("path", e.Path).Debug("removing unknown file from the media store")
+		if e.Hash == "" {
+			report.addFile(e.Path, e.Size)
+			return os.Remove(e.Path)
+		}
+
+		// Another process may be saving the blob again, before adding it to the database
+		removed, err := cfg.Store.RemoveUnused(e.Hash, cutoff)
+		if removed {
+			report.addFile(e.Path, e.Size)
+		}
+		return err
+	})
+}
+
+// collectStatic removes legacy files in the static directory that are not referenced anymore. Sub-directories (like the
+// media store) are skipped.
+func collectStatic(cfg Config, cutoff time.Time, report *Report) error {
+	entries, err := os.ReadDir(cfg.StaticDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		if info.ModTime().After(cutoff) {
+			continue
+		}
+
+		referenced, err := cfg.Database.IsURLReferenced("/static/" + entry.Name())
+		if err != nil {
+			return err
+		}
+		if referenced {
+			continue
+		}
+
+		p := filepath.Join(cfg.StaticDir, entry.Name())
+		report.addFile(p, info.Size())
+		if cfg.DryRun {
+			continue
+		}
+		cfg.Logger.WithField("path", p).Debug("removing unreferenced static file")
+		err = os.Remove(p)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,190 @@
+/*
+Package mediastore stores uploaded files on disk. Files are content-addressed: each blob is stored once, under the
+hex-encoded SHA-256 of its content, so uploading the same content twice reuses the same file.
+
+Reference counting is not handled here: it's up to the caller to track which blobs are in use (see the media tables
+in service/database) and to remove the blobs that are not referenced anymore. Callers must hold the Store lock while
+changing blobs together with their reference counts, so that a blob is never removed while a new reference is added.
+
+The lock only works within a process. Blobs that may be referenced again by another process sharing the store (e.g.,
+the web API server while the mediagc command runs) are removed with RemoveUnused, which keeps the blobs that
+PutReader found again recently.
+*/
+package mediastore
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ErrInvalidHash is returned when a hash is not a hex-encoded SHA-256
+var ErrInvalidHash = errors.New("invalid blob hash")
+
+// Store is a content-addressed blob store rooted in a directory
+type Store struct {
+	sync.Mutex
+
+	root string
+}
+
+// Entry is a file found in the store
+type Entry struct {
+	// Hash is the blob hash, or an empty string if the file is not a blob (e.g., a leftover temporary file)
+	Hash string
+
+	Path    string
+	Size    int64
+	ModTime time.Time
+}
+
+// New returns a Store saving blobs inside the directory root.
+func New(root string) *Store {
+	return &Store{root: root}
+}
+
+// Path returns the path of the blob with the given hash. Blobs are spread in sub-directories named after the first two
+// characters of the hash, to avoid huge directories.
+func (s *Store) Path(hash string) (string, error) {
+	if len(hash) != sha256.Size*2 {
+		return "", ErrInvalidHash
+	}
+	if _, err := hex.DecodeString(hash); err != nil {
+		return "", ErrInvalidHash
+	}
+	return filepath.Join(s.root, hash[:2], hash), nil
+}
+
+// Put saves data in the store (if not already present) and returns its hash.
+func (s *Store) Put(data []byte) (string, error) {
+	return s.PutReader(bytes.NewReader(data))
+}
+
+// PutReader saves the content read from r in the store (if not already present) and returns its hash. The content is
+// streamed to disk, so it's never entirely kept in memory.
+func (s *Store) PutReader(r io.Reader) (string, error) {
+	err := os.MkdirAll(s.root, 0755)
+	if err != nil {
+		return "", err
+	}
+
+	// Write to a temporary file first, so that a blob is either complete or missing
+	tmp, err := os.CreateTemp(s.root, ".upload-*")
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tmp, h), r)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", err
+	}
+
+	hash := hex.EncodeToString(h.Sum(nil))
+	p, err := s.Path(hash)
+	if err != nil {
+		return "", err
+	}
+
+	// Refresh the modification time of existing blobs, so that they are not collected as unused while a new
+	// reference is being added
+	if _, err := os.Stat(p); err == nil {
+		now := time.Now()
+		return hash, os.Chtimes(p, now, now)
+	}
+
+	err = os.MkdirAll(filepath.Dir(p), 0755)
+	if err != nil {
+		return "", err
+	}
+	return hash, os.Rename(tmp.Name(), p)
+}
+
+// Open opens the blob with the given hash for reading.
+func (s *Store) Open(hash string) (*os.File, error) {
+	p, err := s.Path(hash)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(p)
+}
+
+// Remove deletes the blob with the given hash. Removing a missing blob is not an error.
+func (s *Store) Remove(hash string) error {
+	p, err := s.Path(hash)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(p)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// RemoveUnused deletes the blob with the given hash, unless it was modified after cutoff: PutReader refreshes the
+// modification time of the blobs it finds, so a blob that is getting a new reference is kept. The blob is moved aside
+// before checking, so that a concurrent PutReader either refreshed it before or saves it again. It reports whether the
+// blob was removed; removing a missing blob is not an error.
+func (s *Store) RemoveUnused(hash string, cutoff time.Time) (bool, error) {
+	p, err := s.Path(hash)
+	if err != nil {
+		return false, err
+	}
+
+	aside := filepath.Join(filepath.Dir(p), ".gc-"+hash)
+	err = os.Rename(p, aside)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	info, err := os.Stat(aside)
+	if err != nil {
+		return false, err
+	}
+	if info.ModTime().After(cutoff) {
+		// The content is the same, even if PutReader saved the blob again meanwhile
+		return false, os.Rename(aside, p)
+	}
+	return true, os.Remove(aside)
+}
+
+// Walk calls fn for each file in the store.
+func (s *Store) Walk(fn func(e Entry) error) error {
+	err := filepath.WalkDir(s.root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		e := Entry{Path: p, Size: info.Size(), ModTime: info.ModTime()}
+		if expected, err := s.Path(d.Name()); err == nil && expected == p {
+			e.Hash = d.Name()
+		}
+		return fn(e)
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}